@@ -0,0 +1,267 @@
+package AnnotationsManager
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"openify/ConfigurationManager"
+	"openify/FilesManager"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	TrackAnnotation  = "track"
+	AlbumAnnotation  = "album"
+	ArtistAnnotation = "artist"
+)
+
+// The key of a track is its fingerprint, so the annotation follows the file when it is
+// moved, and Path is the last known location used when its tags were edited.
+// The key of an album is the album artist and the album, the one of an artist is its name.
+type Annotation struct {
+	Type      string    `json:"type"`
+	Key       string    `json:"key"`
+	Path      string    `json:"path,omitempty"`
+	Name      string    `json:"name"`
+	Artist    string    `json:"artist,omitempty"`
+	Starred   bool      `json:"starred"`
+	StarredAt time.Time `json:"starred-at"`
+	Rating    int       `json:"rating"`
+	Note      string    `json:"note"`
+	Updated   time.Time `json:"updated"`
+	// Resolved when the annotation is read, -1 when no file matches
+	Id int `json:"id"`
+}
+
+type AnnotationsJsonConfig struct {
+	Users map[string][]Annotation `json:"users"`
+}
+
+var mutex sync.Mutex
+var annotations = map[string][]Annotation{}
+
+func GetAnnotationsFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().AnnotationsList, "annotations.json")
+}
+
+func LoadAnnotations() {
+	path := GetAnnotationsFile()
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("[INFO] No annotations file found, it will be created ::> %s\n", path)
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read the annotations file ::> %s\n%s"+
+			"\nPlease insure that the file has the reading right", path, err)
+	}
+	var ac AnnotationsJsonConfig
+	err = json.Unmarshal(b, &ac)
+	if err != nil {
+		log.Fatalf("[ERROR] Annotations file incorrect ::> %s\n%s", path, err)
+	}
+	mutex.Lock()
+	if ac.Users != nil {
+		annotations = ac.Users
+	}
+	mutex.Unlock()
+	log.Printf("[INFO] Annotations of %d users loaded\n", len(ac.Users))
+}
+
+// saveAnnotations must be called with the mutex locked
+func saveAnnotations() error {
+	b, err := json.Marshal(AnnotationsJsonConfig{Users: annotations})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetAnnotationsFile(), b, 0644)
+}
+
+// NewAnnotation returns an empty annotation of the track, or of its album or its artist.
+func NewAnnotation(kind string, t FilesManager.Track) (Annotation, error) {
+	switch kind {
+	case TrackAnnotation:
+		return Annotation{Type: kind, Key: t.Fingerprint, Path: t.Path, Name: t.Title, Artist: t.Artist}, nil
+	case AlbumAnnotation:
+		if t.Album == "" {
+			return Annotation{}, errors.New("the file has no album")
+		}
+		artist := t.AlbumArtist
+		if artist == "" {
+			artist = t.Artist
+		}
+		return Annotation{Type: kind, Key: FilesManager.AlbumKey(t), Name: t.Album, Artist: artist}, nil
+	case ArtistAnnotation:
+		if t.Artist == "" {
+			return Annotation{}, errors.New("the file has no artist")
+		}
+		return NewArtistAnnotation(t.Artist), nil
+	}
+	return Annotation{}, errors.New("unknown annotation type, expected track, album or artist")
+}
+
+func NewArtistAnnotation(artist string) Annotation {
+	return Annotation{Type: ArtistAnnotation, Key: strings.ToLower(artist), Name: artist}
+}
+
+// GetAnnotation returns the annotation of the user matching a, or a itself when there is none.
+func GetAnnotation(username string, a Annotation) Annotation {
+	mutex.Lock()
+	defer mutex.Unlock()
+	var r resolver
+	if i := indexOf(username, a); i != -1 {
+		return r.resolve(annotations[username][i])
+	}
+	return r.resolve(a)
+}
+
+// EditAnnotation applies edit on the annotation of the user matching a and saves it.
+// An annotation left without star, rating nor note is removed.
+func EditAnnotation(username string, a Annotation, edit func(a *Annotation) error) (Annotation, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	i := indexOf(username, a)
+	if i != -1 {
+		existing := annotations[username][i]
+		existing.Key, existing.Path, existing.Name, existing.Artist = a.Key, a.Path, a.Name, a.Artist
+		a = existing
+	}
+	if err := edit(&a); err != nil {
+		return Annotation{}, err
+	}
+	if a.Rating < 0 || a.Rating > 5 {
+		return Annotation{}, errors.New("the rating must be between 1 and 5, or 0 to remove it")
+	}
+	a.Updated = time.Now()
+	list := annotations[username]
+	empty := !a.Starred && a.Rating == 0 && a.Note == ""
+	switch {
+	case i != -1 && empty:
+		list = append(list[:i], list[i+1:]...)
+	case i != -1:
+		list[i] = a
+	case !empty:
+		list = append(list, a)
+	}
+	annotations[username] = list
+	var r resolver
+	return r.resolve(a), saveAnnotations()
+}
+
+// SetStarred changes the star of an annotation and remembers when it was starred.
+func SetStarred(a *Annotation, starred bool) {
+	if starred && !a.Starred {
+		a.StarredAt = time.Now()
+	}
+	if !starred {
+		a.StarredAt = time.Time{}
+	}
+	a.Starred = starred
+}
+
+// GetStarred returns the starred items of a type, the last starred first.
+func GetStarred(username string, kind string) []Annotation {
+	var r resolver
+	mutex.Lock()
+	result := []Annotation{}
+	for _, a := range annotations[username] {
+		if a.Starred && (kind == "" || a.Type == kind) {
+			result = append(result, r.resolve(a))
+		}
+	}
+	mutex.Unlock()
+	sort.SliceStable(result, func(i, j int) bool { return result[i].StarredAt.After(result[j].StarredAt) })
+	return result
+}
+
+// GetTrackAnnotation returns the annotation of a track, used by the smart playlists.
+func GetTrackAnnotation(username string, t FilesManager.Track) Annotation {
+	a, _ := NewAnnotation(TrackAnnotation, t)
+	mutex.Lock()
+	defer mutex.Unlock()
+	if i := indexOf(username, a); i != -1 {
+		return annotations[username][i]
+	}
+	return a
+}
+
+// indexOf must be called with the mutex locked. The track annotations are found
+// by fingerprint, or by path when the tags of the file changed.
+func indexOf(username string, a Annotation) int {
+	byPath := -1
+	for i, existing := range annotations[username] {
+		if existing.Type != a.Type {
+			continue
+		}
+		if existing.Key == a.Key {
+			return i
+		}
+		if a.Type == TrackAnnotation && a.Path != "" && existing.Path == a.Path {
+			byPath = i
+		}
+	}
+	if byPath != -1 {
+		// The file at this path may be another one now
+		if _, err := FilesManager.GetTrackByFingerprint(annotations[username][byPath].Key); err == nil {
+			return -1
+		}
+	}
+	return byPath
+}
+
+// resolver finds the files of the annotations of a request. The first file of every album
+// and of every artist is indexed once, when an album or an artist is resolved.
+type resolver struct {
+	albums  map[string]int
+	artists map[string]int
+}
+
+func (r *resolver) index() {
+	if r.albums != nil {
+		return
+	}
+	r.albums, r.artists = map[string]int{}, map[string]int{}
+	for _, t := range FilesManager.GetTracks() {
+		if t.Album != "" {
+			if _, ok := r.albums[FilesManager.AlbumKey(t)]; !ok {
+				r.albums[FilesManager.AlbumKey(t)] = t.Id
+			}
+		}
+		for _, artist := range []string{t.Artist, t.AlbumArtist} {
+			if _, ok := r.artists[strings.ToLower(artist)]; !ok && artist != "" {
+				r.artists[strings.ToLower(artist)] = t.Id
+			}
+		}
+	}
+}
+
+// resolve finds the ID of a file matching the annotation: the file itself for
+// a track, and the first file of the album or of the artist for the others.
+func (r *resolver) resolve(a Annotation) Annotation {
+	a.Id = -1
+	switch a.Type {
+	case TrackAnnotation:
+		if t, err := FilesManager.GetTrackByFingerprint(a.Key); err == nil {
+			a.Id = t.Id
+			a.Path = t.Path
+		} else if t, err := FilesManager.GetTrackByPath(a.Path); err == nil {
+			a.Id = t.Id
+		}
+	case AlbumAnnotation:
+		r.index()
+		if id, ok := r.albums[a.Key]; ok {
+			a.Id = id
+		}
+	case ArtistAnnotation:
+		r.index()
+		if id, ok := r.artists[a.Key]; ok {
+			a.Id = id
+		}
+	}
+	return a
+}
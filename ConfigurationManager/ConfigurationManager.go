@@ -5,17 +5,164 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path/filepath"
+	"time"
 )
 
 type Configuration struct {
 	DocumentRoot string
 	Port string
+	PublicURL string
 	UsersList string
+	PlaylistsList string
+	PlaysList string
+	ScrobblersList string
+	ScrobbleQueue string
+	AnnotationsList string
+	QueuesList string
+	SharesList string
+	SessionsList string
+	TwoFactorList string
+	ApiKeysList string
 	SupportedExtensions []string
+	Streaming StreamingConfig
+	Channels []ChannelConfig
+	History HistoryConfig
+	Scrobbling ScrobblingConfig
+	Tokens TokensConfig
+	Roles map[string][]string
+	LibraryAccess map[string]LibraryAccessConfig
+	LoginProtection LoginProtectionConfig
+	TwoFactor TwoFactorConfig
+	AuthProviders []AuthProviderConfig
 }
 
+type StreamingConfig struct {
+	UserBandwidthKbps int64
+	GlobalBandwidthKbps int64
+	MaxStreamsPerUser int
+	RetryAfter int
+}
+
+// PlayedFraction is the part of a file which must be streamed
+// to count as a play when the client does not scrobble it.
+type HistoryConfig struct {
+	PlayedFraction float64
+}
+
+// The URLs of the services can be replaced, by a compatible service or a local stub.
+// The API key and the secret of an application are required to use Last.fm.
+type ScrobblingConfig struct {
+	ListenBrainzURL string
+	LastFmURL string
+	LastFmApiKey string
+	LastFmSecret string
+}
+
+// The access tokens are short-lived, the clients get a new one with their refresh token
+// until it expires. The defaults are 15 minutes and 30 days.
+// Algorithm signs them, one of HS256, RS256, PS256 and ES256 (the default). A new key is made
+// every KeyRotationDays, never with 0, and the old one still verifies for KeyGraceHours (24 by default).
+type TokensConfig struct {
+	AccessTokenMinutes int
+	RefreshTokenDays int
+	Algorithm string
+	KeyRotationDays int
+	KeyGraceHours int
+}
+
+// The folders a role can see, relative to the DocumentRoot. No allowed folder means
+// the whole library, a denied folder is hidden even inside an allowed one.
+type LibraryAccessConfig struct {
+	AllowedFolders []string
+	DeniedFolders []string
+}
+
+// After a failed login, a client and a username wait BackoffSeconds doubled on each new failure,
+// and MaxFailures locks them for LockoutMinutes. The defaults are 1 second, 5 failures and 15 minutes.
+// TrustForwardedFor takes the address of the clients from X-Forwarded-For, behind a proxy.
+type LoginProtectionConfig struct {
+	MaxFailures int
+	LockoutMinutes int
+	BackoffSeconds int
+	TrustForwardedFor bool
+}
+
+// Issuer is the name shown by the authenticator applications, Openify by default.
+// RequiredForAdministrators makes the administrators enroll at their next login.
+type TwoFactorConfig struct {
+	Issuer string
+	RequiredForAdministrators bool
+}
+
+// A directory or an identity provider the users can log in with, besides the users file. Name
+// identifies it in the users file and Type is ldap or oidc. The first of the Groups the user is
+// member of gives its role, DefaultRole otherwise unless RequireGroup is set.
+// An ldap user is searched under BaseDN with UserFilter, where %s is the username, then its DN is
+// bound with the password. Its groups are the GroupAttribute values of the user, and the DNs found
+// under GroupBaseDN with GroupFilter, where %s is the DN of the user.
+// An oidc user logs in with the authorization code flow of IssuerUrl. Its username and its groups
+// are the UsernameClaim and the GroupsClaim of the ID token. RedirectUrl is the callback registered
+// for the client, and AllowedRedirects are the URL prefixes of the clients, besides the server itself.
+type AuthProviderConfig struct {
+	Name string
+	Type string
+	Url string
+	InsecureSkipVerify bool
+	TimeoutSeconds int
+	BindDN string
+	BindPassword string
+	BaseDN string
+	UserFilter string
+	GroupAttribute string
+	GroupBaseDN string
+	GroupFilter string
+	IssuerUrl string
+	ClientId string
+	ClientSecret string
+	RedirectUrl string
+	Scopes []string
+	UsernameClaim string
+	GroupsClaim string
+	AllowedRedirects []string
+	Groups []GroupRoleConfig
+	DefaultRole string
+	RequireGroup bool
+}
+
+// Group is a DN, the value of the first RDN of a DN like admins for cn=admins,ou=groups, or a group name.
+type GroupRoleConfig struct {
+	Group string
+	Role string
+}
+
+type ChannelConfig struct {
+	Name string
+	Description string
+	Folder string
+	// The ID of a playlist played instead of the folder
+	Playlist string
+	Format string
+	Shuffle bool
+}
+
+// The keys signing the access tokens, the last one signs and the retired ones still verify during
+// the grace period. Key is the HMAC secret of the files written before the keysets, and LinkKey
+// signs the links which work without a token.
 type JWTConfig struct {
-	Key string `json:"key"`
+	Key string `json:"key,omitempty"`
+	Keys []JWTKey `json:"keys"`
+	LinkKey string `json:"link-key"`
+}
+
+// PrivateKey is a PKCS #8 PEM block for the RS, PS and ES algorithms, Secret the base64 key of HS256.
+type JWTKey struct {
+	Kid string `json:"kid"`
+	Algorithm string `json:"alg"`
+	PrivateKey string `json:"private-key,omitempty"`
+	Secret string `json:"secret,omitempty"`
+	Created time.Time `json:"created"`
+	Retired *time.Time `json:"retired,omitempty"`
 }
 
 var version = "1.0.0"
@@ -40,10 +187,11 @@ func OpenConfiguration() Configuration {
 	return config
 }
 
-func LoadJWTKey() JWTConfig {
+// LoadJWTKey reads the keys file, the second result is false when there is no file yet.
+func LoadJWTKey() (JWTConfig, bool) {
 	if _, err := os.Stat("jwt.json"); err != nil {
-		log.Fatalf("[ERROR] The JWT Key file is not found ::> jwt.json\n%s" +
-			"\nPlease insure that the file is in the same directory as the executable", err)
+		log.Printf("[INFO] No JWT Key file found, it will be created ::> jwt.json\n")
+		return JWTConfig{}, false
 	}
 	configJson, err:= ioutil.ReadFile("jwt.json")
 	if err != nil {
@@ -54,10 +202,27 @@ func LoadJWTKey() JWTConfig {
 	err = json.Unmarshal(configJson, &jwt)
 
 	if err != nil {
-		log.Fatalf("[ERROR] JWT Key file incorrect ::> config.json\n%s", err)
+		log.Fatalf("[ERROR] JWT Key file incorrect ::> jwt.json\n%s", err)
 	}
 
-	return jwt
+	return jwt, true
+}
+
+func SaveJWTKey(jwt JWTConfig) error {
+	b, err := json.MarshalIndent(jwt, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile("jwt.json", b, 0600)
+}
+
+// GetDataFile returns the path of a storage file of the server. When it is not
+// set in the configuration, the file is stored next to the users file.
+func GetDataFile(configured string, name string) string {
+	if configured != "" {
+		return configured
+	}
+	return filepath.Join(filepath.Dir(config.UsersList), name)
 }
 
 func GetConfiguration() Configuration {
@@ -0,0 +1,277 @@
+package FilesManager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"math"
+	"path/filepath"
+	"strings"
+)
+
+// ReadDuration returns the duration of an audio file in milliseconds, or 0 if it can not be found.
+func ReadDuration(r io.ReadSeeker, path string, size int64) int {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0
+	}
+	var seconds float64
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".mp3", ".aac":
+		seconds = readMPEGDuration(r, size)
+	case ".flac":
+		seconds = readFLACDuration(r)
+	case ".m4a", ".m4b", ".mp4":
+		seconds = readMP4Duration(r, size)
+	case ".ogg", ".oga", ".opus":
+		seconds = readOggDuration(r, size)
+	case ".wav":
+		seconds = readWAVDuration(r)
+	case ".aiff", ".aif":
+		seconds = readAIFFDuration(r)
+	}
+	if seconds <= 0 || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return 0
+	}
+	return int(seconds * 1000)
+}
+
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// The frame count of the Xing/Info header is used when present,
+// otherwise the duration is estimated from the bitrate of the first frame.
+func readMPEGDuration(r io.Reader, size int64) float64 {
+	cr := &countingReader{r: r}
+	br := bufio.NewReader(cr)
+	f, err := ReadFrame(br)
+	if err != nil || f.SampleRate == 0 {
+		return 0
+	}
+	if IsInfoFrame(f) {
+		for _, offset := range []int{4 + 9, 4 + 17, 4 + 32} {
+			id := string(f.Data[offset : offset+4])
+			if (id == "Xing" || id == "Info") && len(f.Data) >= offset+12 {
+				flags := binary.BigEndian.Uint32(f.Data[offset+4 : offset+8])
+				if flags&0x01 != 0 {
+					frames := binary.BigEndian.Uint32(f.Data[offset+8 : offset+12])
+					return float64(frames) * float64(f.Samples) / float64(f.SampleRate)
+				}
+			}
+		}
+	}
+	start := cr.n - int64(br.Buffered()) - int64(len(f.Data))
+	bitrate := float64(len(f.Data)) * 8 * float64(f.SampleRate) / float64(f.Samples)
+	return float64(size-start) * 8 / bitrate
+}
+
+func readFLACDuration(r io.ReadSeeker) float64 {
+	h := make([]byte, 10)
+	if _, err := io.ReadFull(r, h); err != nil {
+		return 0
+	}
+	if string(h[:3]) == "ID3" {
+		size := int64(h[6])<<21 | int64(h[7])<<14 | int64(h[8])<<7 | int64(h[9])
+		if _, err := r.Seek(10+size, io.SeekStart); err != nil {
+			return 0
+		}
+	} else if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0
+	}
+	b := make([]byte, 4+4+34)
+	if _, err := io.ReadFull(r, b); err != nil || string(b[:4]) != "fLaC" {
+		return 0
+	}
+	info := b[8:]
+	sampleRate := int64(info[10])<<12 | int64(info[11])<<4 | int64(info[12])>>4
+	total := int64(info[13]&0x0F)<<32 | int64(binary.BigEndian.Uint32(info[14:18]))
+	if sampleRate == 0 {
+		return 0
+	}
+	return float64(total) / float64(sampleRate)
+}
+
+// readMP4Duration walks the atoms until moov/mvhd which holds the timescale and the duration.
+func readMP4Duration(r io.ReadSeeker, end int64) float64 {
+	var pos int64
+	for pos+8 <= end {
+		if _, err := r.Seek(pos, io.SeekStart); err != nil {
+			return 0
+		}
+		h := make([]byte, 8)
+		if _, err := io.ReadFull(r, h); err != nil {
+			return 0
+		}
+		size := int64(binary.BigEndian.Uint32(h[:4]))
+		name := string(h[4:])
+		header := int64(8)
+		if size == 1 {
+			ext := make([]byte, 8)
+			if _, err := io.ReadFull(r, ext); err != nil {
+				return 0
+			}
+			size = int64(binary.BigEndian.Uint64(ext))
+			header = 16
+		} else if size == 0 {
+			size = end - pos
+		}
+		if size < header {
+			return 0
+		}
+		switch name {
+		case "moov":
+			return readMP4Duration(&sectionSeeker{r: r, base: pos + header}, size-header)
+		case "mvhd":
+			b := make([]byte, 32)
+			n, _ := io.ReadFull(r, b)
+			if n < 20 {
+				return 0
+			}
+			if b[0] == 1 && n >= 32 {
+				scale := binary.BigEndian.Uint32(b[20:24])
+				duration := binary.BigEndian.Uint64(b[24:32])
+				if scale == 0 {
+					return 0
+				}
+				return float64(duration) / float64(scale)
+			}
+			scale := binary.BigEndian.Uint32(b[12:16])
+			duration := binary.BigEndian.Uint32(b[16:20])
+			if scale == 0 {
+				return 0
+			}
+			return float64(duration) / float64(scale)
+		}
+		pos += size
+	}
+	return 0
+}
+
+// sectionSeeker makes the offsets of a reader relative to base.
+type sectionSeeker struct {
+	r    io.ReadSeeker
+	base int64
+}
+
+func (s *sectionSeeker) Read(p []byte) (int, error) {
+	return s.r.Read(p)
+}
+
+func (s *sectionSeeker) Seek(offset int64, whence int) (int64, error) {
+	if whence == io.SeekStart {
+		offset += s.base
+	}
+	n, err := s.r.Seek(offset, whence)
+	return n - s.base, err
+}
+
+// readOggDuration uses the granule position of the last page and the sample rate of the identification header.
+func readOggDuration(r io.ReadSeeker, size int64) float64 {
+	b := make([]byte, 128)
+	n, _ := io.ReadFull(r, b)
+	b = b[:n]
+	var rate float64
+	var preSkip float64
+	if i := bytes.Index(b, []byte("\x01vorbis")); i >= 0 && len(b) >= i+16 {
+		rate = float64(binary.LittleEndian.Uint32(b[i+12 : i+16]))
+	} else if i := bytes.Index(b, []byte("OpusHead")); i >= 0 && len(b) >= i+12 {
+		rate = 48000
+		preSkip = float64(binary.LittleEndian.Uint16(b[i+10 : i+12]))
+	} else if i := bytes.Index(b, []byte("\x7fFLAC")); i >= 0 && len(b) >= i+9+4+34 {
+		info := b[i+17:]
+		rate = float64(int64(info[10])<<12 | int64(info[11])<<4 | int64(info[12])>>4)
+	}
+	if rate == 0 {
+		return 0
+	}
+	tail := int64(64 * 1024)
+	if tail > size {
+		tail = size
+	}
+	if _, err := r.Seek(size-tail, io.SeekStart); err != nil {
+		return 0
+	}
+	b = make([]byte, tail)
+	n, _ = io.ReadFull(r, b)
+	b = b[:n]
+	i := bytes.LastIndex(b, []byte("OggS"))
+	if i < 0 || len(b) < i+14 {
+		return 0
+	}
+	granule := float64(binary.LittleEndian.Uint64(b[i+6 : i+14]))
+	return (granule - preSkip) / rate
+}
+
+func readWAVDuration(r io.Reader) float64 {
+	h := make([]byte, 12)
+	if _, err := io.ReadFull(r, h); err != nil || string(h[:4]) != "RIFF" || string(h[8:]) != "WAVE" {
+		return 0
+	}
+	var byteRate uint32
+	for {
+		ch := make([]byte, 8)
+		if _, err := io.ReadFull(r, ch); err != nil {
+			return 0
+		}
+		size := binary.LittleEndian.Uint32(ch[4:])
+		switch string(ch[:4]) {
+		case "fmt ":
+			b := make([]byte, size)
+			if _, err := io.ReadFull(r, b); err != nil || len(b) < 12 {
+				return 0
+			}
+			byteRate = binary.LittleEndian.Uint32(b[8:12])
+		case "data":
+			if byteRate == 0 {
+				return 0
+			}
+			return float64(size) / float64(byteRate)
+		default:
+			if _, err := io.CopyN(ioutil.Discard, r, int64(size+size%2)); err != nil {
+				return 0
+			}
+		}
+	}
+}
+
+func readAIFFDuration(r io.Reader) float64 {
+	h := make([]byte, 12)
+	if _, err := io.ReadFull(r, h); err != nil || string(h[:4]) != "FORM" {
+		return 0
+	}
+	for {
+		ch := make([]byte, 8)
+		if _, err := io.ReadFull(r, ch); err != nil {
+			return 0
+		}
+		size := binary.BigEndian.Uint32(ch[4:])
+		if string(ch[:4]) != "COMM" {
+			if _, err := io.CopyN(ioutil.Discard, r, int64(size+size%2)); err != nil {
+				return 0
+			}
+			continue
+		}
+		b := make([]byte, size)
+		if _, err := io.ReadFull(r, b); err != nil || len(b) < 18 {
+			return 0
+		}
+		frames := float64(binary.BigEndian.Uint32(b[2:6]))
+		// The sample rate is an 80 bit IEEE 754 extended precision number
+		exponent := int(binary.BigEndian.Uint16(b[8:10])&0x7FFF) - 16383
+		mantissa := float64(binary.BigEndian.Uint64(b[10:18]))
+		rate := mantissa * math.Pow(2, float64(exponent-63))
+		if rate == 0 {
+			return 0
+		}
+		return frames / rate
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"sync"
 )
 
 
@@ -15,6 +16,7 @@ type File struct {
 	Name string `json:"name"`
 	Ext  string `json:"ext"`
 	Id int `json:"id"`
+	Lyrics bool `json:"lyrics"`
 }
 
 type Folder struct {
@@ -38,7 +40,15 @@ var root = Folder {
 
 var references []Reference
 
+var PlaylistExtensions = []string{".m3u", ".m3u8", ".pls", ".xspf"}
+var playlistFiles []string
+
+// The scans share the folders and the library being built, they run one at a time
+var scanMutex sync.Mutex
+
 func ScanFolder(_rootPath string) Folder {
+	scanMutex.Lock()
+	defer scanMutex.Unlock()
 	total:= 0
 	ClearRoot()
 	if _, err := os.Stat(_rootPath); err != nil {
@@ -46,8 +56,14 @@ func ScanFolder(_rootPath string) Folder {
 	}
 	log.Printf("[INFO] Scanning music folder (%s)", _rootPath)
 	err := filepath.Walk(_rootPath, func(path string, info os.FileInfo, err error) error {
+		for _, ext := range PlaylistExtensions {
+			if strings.HasSuffix(strings.ToLower(path), ext) {
+				playlistFiles = append(playlistFiles, path[len(_rootPath)+1:])
+			}
+		}
 		for _, ext := range ConfigurationManager.GetConfiguration().SupportedExtensions {
 			if strings.HasSuffix(path, ext) {
+				IndexFile(total, path[len(_rootPath)+1:])
 				AddToFolder(path[len(_rootPath)+1:], ext, total)
 				total++
 			}
@@ -57,13 +73,17 @@ func ScanFolder(_rootPath string) Folder {
 	if err != nil {
 		log.Printf("[ERROR] %s\n", err)
 	}
+	CommitLibrary()
 	log.Printf("[INFO] %d files found", total)
+	log.Printf("[INFO] %d playlist files found", len(playlistFiles))
 	return root
 }
 
 func ClearRoot() {
 	root.Folders = root.Folders[:0]
 	root.Files = root.Files[:0]
+	references = references[:0]
+	playlistFiles = playlistFiles[:0]
 }
 
 func AddToFolder(path string, ext string, id int) {
@@ -102,6 +122,7 @@ func Append(files *[]File, id int, name string, ext string, path string) {
 		Name: name,
 		Ext:  ext,
 		Id: id,
+		Lyrics: scanning[id].HasLyrics,
 	})
 	references = append(references, Reference{
 		Id: id,
@@ -148,6 +169,43 @@ func GetAbsolutePath(path string) string {
 	return fmt.Sprintf("%s%s", abs, path)
 }
 
+// GetPlaylistFiles returns the paths of the playlist files found by the last scan.
+func GetPlaylistFiles() []string {
+	return append([]string{}, playlistFiles...)
+}
+
+func Stat(path string) (os.FileInfo, error) {
+	return os.Stat(GetAbsolutePath(path))
+}
+
 func GetRoot() Folder {
 	return root
+}
+
+// GetFilteredRoot returns a copy of the tree holding only the files whose path is kept,
+// the folders left empty are removed.
+func GetFilteredRoot(keep func(path string) bool) Folder {
+	result := filterFolder(root, "", keep)
+	result.Success = true
+	return result
+}
+
+func filterFolder(f Folder, prefix string, keep func(path string) bool) Folder {
+	result := Folder{
+		Name:    f.Name,
+		Folders: []Folder{},
+		Files:   []File{},
+	}
+	for _, file := range f.Files {
+		if keep(prefix + file.Name) {
+			result.Files = append(result.Files, file)
+		}
+	}
+	for _, sub := range f.Folders {
+		filtered := filterFolder(sub, prefix+sub.Name+"/", keep)
+		if len(filtered.Files) > 0 || len(filtered.Folders) > 0 {
+			result.Folders = append(result.Folders, filtered)
+		}
+	}
+	return result
 }
\ No newline at end of file
@@ -0,0 +1,105 @@
+package FilesManager
+
+import (
+	"bufio"
+	"io"
+)
+
+type Frame struct {
+	Data       []byte
+	Samples    int
+	SampleRate int
+}
+
+var mpeg1Layer3Bitrates = []int{0, 32, 40, 48, 56, 64, 80, 96, 112, 128, 160, 192, 224, 256, 320}
+var mpeg2Layer3Bitrates = []int{0, 8, 16, 24, 32, 40, 48, 56, 64, 80, 96, 112, 128, 144, 160}
+var mpegSampleRates = map[byte][]int{
+	3: {44100, 48000, 32000},
+	2: {22050, 24000, 16000},
+	0: {11025, 12000, 8000},
+}
+
+// ReadFrame returns the next MP3 (layer III) frame of the stream,
+// skipping ID3 tags and garbage between frames. It returns io.EOF at the end of the stream.
+func ReadFrame(r *bufio.Reader) (Frame, error) {
+	for {
+		h, err := r.Peek(10)
+		if err != nil {
+			if len(h) < 4 {
+				return Frame{}, io.EOF
+			}
+		}
+		if len(h) >= 10 && string(h[:3]) == "ID3" {
+			size := int(h[6])<<21 | int(h[7])<<14 | int(h[8])<<7 | int(h[9])
+			size += 10
+			if h[5]&0x10 != 0 {
+				size += 10
+			}
+			if _, err := r.Discard(size); err != nil {
+				return Frame{}, io.EOF
+			}
+			continue
+		}
+		if string(h[:3]) == "TAG" {
+			if _, err := r.Discard(128); err != nil {
+				return Frame{}, io.EOF
+			}
+			continue
+		}
+		if h[0] == 0xFF {
+			if f, length, ok := parseMPEGHeader(h); ok {
+				return readFrameData(r, f, length)
+			}
+		}
+		if _, err := r.Discard(1); err != nil {
+			return Frame{}, io.EOF
+		}
+	}
+}
+
+func readFrameData(r *bufio.Reader, f Frame, length int) (Frame, error) {
+	f.Data = make([]byte, length)
+	if _, err := io.ReadFull(r, f.Data); err != nil {
+		return Frame{}, io.EOF
+	}
+	return f, nil
+}
+
+func parseMPEGHeader(h []byte) (Frame, int, bool) {
+	if len(h) < 4 || h[1]&0xE0 != 0xE0 {
+		return Frame{}, 0, false
+	}
+	version := (h[1] >> 3) & 0x03
+	layer := (h[1] >> 1) & 0x03
+	bitrateIndex := int(h[2] >> 4)
+	rateIndex := int((h[2] >> 2) & 0x03)
+	if version == 1 || layer != 1 || bitrateIndex == 0 || bitrateIndex == 15 || rateIndex == 3 {
+		return Frame{}, 0, false
+	}
+	padding := int((h[2] >> 1) & 0x01)
+	sampleRate := mpegSampleRates[version][rateIndex]
+	f := Frame{SampleRate: sampleRate}
+	var length int
+	if version == 3 {
+		f.Samples = 1152
+		length = 144*mpeg1Layer3Bitrates[bitrateIndex]*1000/sampleRate + padding
+	} else {
+		f.Samples = 576
+		length = 72*mpeg2Layer3Bitrates[bitrateIndex]*1000/sampleRate + padding
+	}
+	return f, length, true
+}
+
+// IsInfoFrame reports whether an MP3 frame only carries a Xing/Info header.
+func IsInfoFrame(f Frame) bool {
+	if len(f.Data) < 40 {
+		return false
+	}
+	for _, offset := range []int{4 + 9, 4 + 17, 4 + 32} {
+		id := string(f.Data[offset : offset+4])
+		if id == "Xing" || id == "Info" {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,251 @@
+package FilesManager
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dhowden/tag"
+)
+
+type Track struct {
+	Id          int           `json:"id"`
+	Path        string        `json:"path"`
+	Title       string        `json:"title"`
+	Album       string        `json:"album"`
+	Artist      string        `json:"artist"`
+	AlbumArtist string        `json:"album-artist"`
+	Composer    string        `json:"composer"`
+	Genre       string        `json:"genre"`
+	Year        int           `json:"year"`
+	TrackNumber int           `json:"track"`
+	DiscNumber  int           `json:"disc"`
+	Codec       string        `json:"codec"`
+	Duration    int           `json:"duration"` // milliseconds
+	HasLyrics   bool          `json:"lyrics"`
+	Size        int64         `json:"size"`
+	Modified    time.Time     `json:"modified"`
+	Playback    PlaybackHints `json:"playback"`
+	Fingerprint string        `json:"fingerprint"`
+}
+
+var library = map[int]Track{}
+var paths = map[string]int{}
+var fingerprints = map[string]int{}
+// scanning is the library built by the current scan, it is guarded by the scan mutex
+var scanning = map[int]Track{}
+var libraryMutex sync.RWMutex
+
+// IndexFile reads the tags of a scanned file and stores them in the library
+// being built by the current scan.
+func IndexFile(id int, path string) {
+	t := Track{
+		Id:   id,
+		Path: path,
+	}
+	f, err := os.Open(GetAbsolutePath(path))
+	if err != nil {
+		log.Printf("[WARN] %s\n", err)
+		scanning[id] = t
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err == nil {
+		t.Size = info.Size()
+		t.Modified = info.ModTime()
+	}
+	m, err := tag.ReadFrom(f)
+	if err != nil {
+		m = nil
+	} else {
+		t.Title = m.Title()
+		t.Album = m.Album()
+		t.Artist = m.Artist()
+		t.AlbumArtist = m.AlbumArtist()
+		t.Composer = m.Composer()
+		t.Genre = m.Genre()
+		t.Year = m.Year()
+		t.TrackNumber, _ = m.Track()
+		t.DiscNumber, _ = m.Disc()
+		t.Codec = string(m.FileType())
+	}
+	t.Playback = ReadPlaybackHints(f, m)
+	t.Duration = ReadDuration(f, path, t.Size)
+	t.HasLyrics = HasLyrics(GetAbsolutePath(path), m)
+	t.Fingerprint = Fingerprint(t)
+	scanning[id] = t
+}
+
+// Fingerprint identifies a file by its size and its tags,
+// so it does not change when the file is moved or renamed.
+func Fingerprint(t Track) string {
+	sum := sha1.Sum([]byte(fmt.Sprintf("%d\x00%s\x00%s\x00%s\x00%d\x00%d", t.Size,
+		strings.ToLower(t.Artist), strings.ToLower(t.Album), strings.ToLower(t.Title), t.TrackNumber, t.DiscNumber)))
+	return hex.EncodeToString(sum[:])
+}
+
+// CommitLibrary replaces the library with the one built by the current scan.
+func CommitLibrary() {
+	p := make(map[string]int, len(scanning))
+	f := make(map[string]int, len(scanning))
+	for id, t := range scanning {
+		p[filepath.ToSlash(t.Path)] = id
+		// Identical copies of a file share the fingerprint of the first one
+		if other, ok := f[t.Fingerprint]; !ok || id < other {
+			f[t.Fingerprint] = id
+		}
+	}
+	libraryMutex.Lock()
+	library = scanning
+	paths = p
+	fingerprints = f
+	scanning = map[int]Track{}
+	libraryMutex.Unlock()
+}
+
+func GetTrack(id int) (Track, error) {
+	libraryMutex.RLock()
+	defer libraryMutex.RUnlock()
+	t, ok := library[id]
+	if !ok {
+		return Track{}, errors.New("ID not found")
+	}
+	return t, nil
+}
+
+func GetTrackByPath(path string) (Track, error) {
+	libraryMutex.RLock()
+	defer libraryMutex.RUnlock()
+	id, ok := paths[filepath.ToSlash(path)]
+	if !ok {
+		return Track{}, errors.New("path not found")
+	}
+	return library[id], nil
+}
+
+func GetTrackByFingerprint(fingerprint string) (Track, error) {
+	libraryMutex.RLock()
+	defer libraryMutex.RUnlock()
+	id, ok := fingerprints[fingerprint]
+	if !ok {
+		return Track{}, errors.New("fingerprint not found")
+	}
+	return library[id], nil
+}
+
+// GetTracks returns every indexed track ordered by ID.
+func GetTracks() []Track {
+	libraryMutex.RLock()
+	result := make([]Track, 0, len(library))
+	for _, t := range library {
+		result = append(result, t)
+	}
+	libraryMutex.RUnlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Id < result[j].Id })
+	return result
+}
+
+// GetAlbumTracks returns the tracks sharing the album of t, ordered by disc and track number.
+func GetAlbumTracks(t Track) []Track {
+	key := AlbumKey(t)
+	var result []Track
+	for _, other := range GetTracks() {
+		if t.Album != "" && AlbumKey(other) == key {
+			result = append(result, other)
+		}
+	}
+	if len(result) == 0 {
+		result = append(result, t)
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		if result[i].DiscNumber != result[j].DiscNumber {
+			return result[i].DiscNumber < result[j].DiscNumber
+		}
+		return result[i].TrackNumber < result[j].TrackNumber
+	})
+	return result
+}
+
+func AlbumKey(t Track) string {
+	artist := t.AlbumArtist
+	if artist == "" {
+		artist = t.Artist
+	}
+	return strings.ToLower(artist) + "\x00" + strings.ToLower(t.Album)
+}
+
+var mimeTypes = map[string]string{
+	".mp3":  "audio/mpeg",
+	".aac":  "audio/aac",
+	".m4a":  "audio/mp4",
+	".m4b":  "audio/mp4",
+	".ogg":  "audio/ogg",
+	".oga":  "audio/ogg",
+	".opus": "audio/ogg",
+	".flac": "audio/flac",
+	".wav":  "audio/wav",
+	".aiff": "audio/aiff",
+	".aif":  "audio/aiff",
+}
+
+func GetMimeType(path string) string {
+	if m, ok := mimeTypes[strings.ToLower(filepath.Ext(path))]; ok {
+		return m
+	}
+	return "application/octet-stream"
+}
+
+// GetFolderTracks returns the tracks inside a folder of the DocumentRoot and its sub folders.
+func GetFolderTracks(folder string) []Track {
+	folder = strings.Trim(filepath.ToSlash(folder), "/")
+	var result []Track
+	for _, t := range GetTracks() {
+		if folder == "" || strings.HasPrefix(filepath.ToSlash(t.Path), folder+"/") {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+var coverNames = []string{"cover.jpg", "cover.jpeg", "cover.png", "folder.jpg", "folder.png", "front.jpg", "front.png"}
+
+// ReadPicture returns the picture embedded in a file, or the cover image of its folder.
+func ReadPicture(path string) (*tag.Picture, error) {
+	abs := GetAbsolutePath(path)
+	f, err := os.Open(abs)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	m, err := tag.ReadFrom(f)
+	if err == nil && m.Picture() != nil {
+		return m.Picture(), nil
+	}
+	for _, name := range coverNames {
+		b, err := ioutil.ReadFile(filepath.Join(filepath.Dir(abs), name))
+		if err == nil {
+			return &tag.Picture{
+				Ext:      strings.TrimPrefix(filepath.Ext(name), "."),
+				MIMEType: GetImageMimeType(name),
+				Data:     b,
+			}, nil
+		}
+	}
+	return nil, errors.New("no picture found")
+}
+
+func GetImageMimeType(name string) string {
+	if strings.HasSuffix(name, ".png") {
+		return "image/png"
+	}
+	return "image/jpeg"
+}
@@ -0,0 +1,242 @@
+package FilesManager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/dhowden/tag"
+)
+
+// Time is in milliseconds
+type LyricsLine struct {
+	Time int    `json:"time"`
+	Text string `json:"text"`
+}
+
+type Lyrics struct {
+	Unsynchronized string       `json:"unsynchronized"`
+	Synchronized   []LyricsLine `json:"synchronized"`
+	Source         string       `json:"source"`
+}
+
+var lrcTimestamp = regexp.MustCompile(`\[(\d+):(\d{1,2})(?:[.:](\d{1,3}))?\]`)
+var lrcOffset = regexp.MustCompile(`(?i)^\[offset:\s*([+-]?\d+)\s*\]`)
+
+// ReadLyrics returns the lyrics of a file. The synchronized lyrics come from
+// the .lrc file next to it when there is one, otherwise from the ID3 SYLT frame.
+func ReadLyrics(path string) Lyrics {
+	result := Lyrics{
+		Synchronized: []LyricsLine{},
+		Source:       "none",
+	}
+	abs := GetAbsolutePath(path)
+	f, err := os.Open(abs)
+	if err == nil {
+		defer f.Close()
+		m, err := tag.ReadFrom(f)
+		if err == nil {
+			result.Unsynchronized = m.Lyrics()
+			if result.Unsynchronized != "" {
+				result.Source = "embedded"
+			}
+			if lines := ReadSYLT(m, abs); len(lines) > 0 {
+				result.Synchronized = lines
+				result.Source = "sylt"
+			}
+		}
+	}
+	if lrc, err := FindLRCFile(abs); err == nil {
+		if lines := ParseLRC(lrc); len(lines) > 0 {
+			result.Synchronized = lines
+			result.Source = "lrc"
+		}
+	}
+	return result
+}
+
+// HasLyrics tells if a file has lyrics without parsing them.
+func HasLyrics(abs string, m tag.Metadata) bool {
+	if m != nil {
+		if m.Lyrics() != "" {
+			return true
+		}
+		for k := range m.Raw() {
+			if strings.HasPrefix(k, "SYLT") || strings.HasPrefix(k, "SLT") {
+				return true
+			}
+		}
+	}
+	_, err := FindLRCFile(abs)
+	return err == nil
+}
+
+func FindLRCFile(abs string) (string, error) {
+	base := strings.TrimSuffix(abs, filepath.Ext(abs))
+	for _, ext := range []string{".lrc", ".LRC"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext, nil
+		}
+	}
+	return "", os.ErrNotExist
+}
+
+func ParseLRC(path string) []LyricsLine {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	var lines []LyricsLine
+	offset := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(s.Text(), "\uFEFF"))
+		if m := lrcOffset.FindStringSubmatch(line); m != nil {
+			offset, _ = strconv.Atoi(m[1])
+			continue
+		}
+		stamps := lrcTimestamp.FindAllStringSubmatchIndex(line, -1)
+		if len(stamps) == 0 || stamps[0][0] != 0 {
+			continue
+		}
+		end := 0
+		var times []int
+		for _, st := range stamps {
+			if st[0] != end {
+				break
+			}
+			end = st[1]
+			min, _ := strconv.Atoi(line[st[2]:st[3]])
+			sec, _ := strconv.Atoi(line[st[4]:st[5]])
+			ms := 0
+			if st[6] >= 0 {
+				frac := line[st[6]:st[7]]
+				ms, _ = strconv.Atoi(frac)
+				for i := len(frac); i < 3; i++ {
+					ms *= 10
+				}
+			}
+			times = append(times, (min*60+sec)*1000+ms)
+		}
+		text := strings.TrimSpace(line[end:])
+		for _, t := range times {
+			// A positive offset shows the lyrics sooner
+			t -= offset
+			if t < 0 {
+				t = 0
+			}
+			lines = append(lines, LyricsLine{Time: t, Text: text})
+		}
+	}
+	sort.SliceStable(lines, func(i, j int) bool { return lines[i].Time < lines[j].Time })
+	return lines
+}
+
+// ReadSYLT decodes the first ID3 synchronised lyrics frame, which the tag library keeps as raw bytes.
+func ReadSYLT(m tag.Metadata, abs string) []LyricsLine {
+	var b []byte
+	for k, v := range m.Raw() {
+		if k == "SYLT" || k == "SLT" {
+			b, _ = v.([]byte)
+		}
+	}
+	if len(b) < 6 {
+		return nil
+	}
+	enc := b[0]
+	format := b[4]
+	rest := b[6:]
+	_, rest = splitEncodedText(rest, enc)
+	frameDuration := 0.0
+	if format == 1 {
+		frameDuration = readFrameDuration(abs)
+		if frameDuration == 0 {
+			return nil
+		}
+	}
+	var lines []LyricsLine
+	for len(rest) > 0 {
+		var text string
+		text, rest = splitEncodedText(rest, enc)
+		if len(rest) < 4 {
+			break
+		}
+		stamp := int(binary.BigEndian.Uint32(rest[:4]))
+		rest = rest[4:]
+		if format == 1 {
+			stamp = int(float64(stamp) * frameDuration)
+		}
+		lines = append(lines, LyricsLine{
+			Time: stamp,
+			Text: strings.TrimSpace(strings.Trim(text, "\n\r")),
+		})
+	}
+	return lines
+}
+
+// splitEncodedText returns the first null terminated string of b and what follows it.
+func splitEncodedText(b []byte, enc byte) (string, []byte) {
+	if enc == 1 || enc == 2 {
+		for i := 0; i+1 < len(b); i += 2 {
+			if b[i] == 0 && b[i+1] == 0 {
+				return decodeUTF16(b[:i], enc == 2), b[i+2:]
+			}
+		}
+		return decodeUTF16(b, enc == 2), nil
+	}
+	i := bytes.IndexByte(b, 0)
+	if i < 0 {
+		return decodeText(b, enc), nil
+	}
+	return decodeText(b[:i], enc), b[i+1:]
+}
+
+func decodeText(b []byte, enc byte) string {
+	if enc == 0 {
+		r := make([]rune, len(b))
+		for i, c := range b {
+			r[i] = rune(c)
+		}
+		return string(r)
+	}
+	return string(b)
+}
+
+func decodeUTF16(b []byte, bigEndian bool) string {
+	var order binary.ByteOrder = binary.BigEndian
+	if !bigEndian && len(b) >= 2 {
+		if b[0] == 0xFF && b[1] == 0xFE {
+			order = binary.LittleEndian
+			b = b[2:]
+		} else if b[0] == 0xFE && b[1] == 0xFF {
+			b = b[2:]
+		}
+	}
+	s := make([]uint16, 0, len(b)/2)
+	for i := 0; i+1 < len(b); i += 2 {
+		s = append(s, order.Uint16(b[i:i+2]))
+	}
+	return string(utf16.Decode(s))
+}
+
+// readFrameDuration returns the duration of an MPEG frame of the file in milliseconds.
+func readFrameDuration(abs string) float64 {
+	f, err := os.Open(abs)
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	frame, err := ReadFrame(bufio.NewReader(f))
+	if err != nil || frame.SampleRate == 0 {
+		return 0
+	}
+	return float64(frame.Samples) * 1000 / float64(frame.SampleRate)
+}
@@ -0,0 +1,195 @@
+package FilesManager
+
+import (
+	"encoding/binary"
+	"io"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/dhowden/tag"
+)
+
+// MP3 decoders add 528 + 1 samples of delay on top of what LAME records,
+// the values sent to the clients already include it.
+const mp3DecoderDelay = 529
+
+type PlaybackHints struct {
+	EncoderDelay   int      `json:"encoder-delay"`
+	EncoderPadding int      `json:"encoder-padding"`
+	GaplessSource  string   `json:"gapless-source,omitempty"`
+	TrackGain      *float64 `json:"track-gain,omitempty"`
+	TrackPeak      *float64 `json:"track-peak,omitempty"`
+	AlbumGain      *float64 `json:"album-gain,omitempty"`
+	AlbumPeak      *float64 `json:"album-peak,omitempty"`
+}
+
+// ReadPlaybackHints extracts the gapless and ReplayGain information of a file.
+// m can be nil if the tags could not be read.
+func ReadPlaybackHints(r io.ReadSeeker, m tag.Metadata) PlaybackHints {
+	var hints PlaybackHints
+	if m != nil {
+		for k, v := range m.Raw() {
+			key, value := rawTagText(k, v)
+			switch strings.ToLower(key) {
+			case "itunsmpb":
+				delay, padding, ok := parseITunSMPB(value)
+				if ok {
+					hints.EncoderDelay = delay
+					hints.EncoderPadding = padding
+					hints.GaplessSource = "itunsmpb"
+				}
+			case "replaygain_track_gain":
+				hints.TrackGain = parseGain(value)
+			case "replaygain_track_peak":
+				hints.TrackPeak = parseGain(value)
+			case "replaygain_album_gain":
+				hints.AlbumGain = parseGain(value)
+			case "replaygain_album_peak":
+				hints.AlbumPeak = parseGain(value)
+			}
+		}
+	}
+	if hints.GaplessSource == "" && (m == nil || m.FileType() == tag.MP3) {
+		delay, padding, ok := readLAMEHeader(r)
+		if ok {
+			hints.EncoderDelay = delay + mp3DecoderDelay
+			hints.EncoderPadding = padding - mp3DecoderDelay
+			if hints.EncoderPadding < 0 {
+				hints.EncoderPadding = 0
+			}
+			hints.GaplessSource = "lame"
+		}
+	}
+	return hints
+}
+
+// rawTagText returns the name and the text of a raw tag. ID3 stores the
+// user-defined values (TXXX, COMM) with their real name in the description.
+func rawTagText(k string, v interface{}) (string, string) {
+	switch value := v.(type) {
+	case *tag.Comm:
+		return value.Description, value.Text
+	case string:
+		return k, value
+	}
+	return k, ""
+}
+
+// trimTagText removes the spaces and the NUL bytes around a value. The MP4 freeform (----)
+// atoms keep the 4 bytes of their locale, which are zeros, in front of the text.
+func trimTagText(s string) string {
+	return strings.TrimFunc(s, func(r rune) bool { return r == 0 || unicode.IsSpace(r) })
+}
+
+func parseGain(s string) *float64 {
+	s = trimTagText(s)
+	s = strings.TrimSuffix(strings.TrimSuffix(s, "dB"), "db")
+	f, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil {
+		return nil
+	}
+	return &f
+}
+
+// iTunSMPB is a list of hexadecimal values, the second and third ones are
+// the encoder delay and the padding in samples.
+func parseITunSMPB(s string) (int, int, bool) {
+	fields := strings.Fields(trimTagText(s))
+	if len(fields) < 3 {
+		return 0, 0, false
+	}
+	delay, err := strconv.ParseInt(fields[1], 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	padding, err := strconv.ParseInt(fields[2], 16, 64)
+	if err != nil {
+		return 0, 0, false
+	}
+	return int(delay), int(padding), true
+}
+
+// readLAMEHeader looks for the Xing/Info frame at the start of an MP3 stream
+// and reads the delay and padding written by LAME in its extension.
+func readLAMEHeader(r io.ReadSeeker) (int, int, bool) {
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, false
+	}
+	buf := make([]byte, 16*1024)
+	n, _ := io.ReadFull(r, buf)
+	buf = buf[:n]
+	start := 0
+	if len(buf) >= 10 && string(buf[:3]) == "ID3" {
+		size := int(buf[6])<<21 | int(buf[7])<<14 | int(buf[8])<<7 | int(buf[9])
+		start = 10 + size
+		if buf[5]&0x10 != 0 {
+			start += 10
+		}
+		if start+4 > len(buf) {
+			if _, err := r.Seek(int64(start), io.SeekStart); err != nil {
+				return 0, 0, false
+			}
+			n, _ = io.ReadFull(r, buf)
+			buf = buf[:n]
+			start = 0
+		}
+	}
+	for i := start; i+4 <= len(buf); i++ {
+		if buf[i] != 0xFF || buf[i+1]&0xE0 != 0xE0 {
+			continue
+		}
+		frame := buf[i:]
+		version := (frame[1] >> 3) & 0x03
+		layer := (frame[1] >> 1) & 0x03
+		if version == 1 || layer != 1 {
+			continue
+		}
+		mono := (frame[3]>>6)&0x03 == 3
+		var sideInfo int
+		switch {
+		case version == 3 && mono:
+			sideInfo = 17
+		case version == 3:
+			sideInfo = 32
+		case mono:
+			sideInfo = 9
+		default:
+			sideInfo = 17
+		}
+		x := 4 + sideInfo
+		if len(frame) < x+8 {
+			return 0, 0, false
+		}
+		id := string(frame[x : x+4])
+		if id != "Xing" && id != "Info" {
+			return 0, 0, false
+		}
+		flags := binary.BigEndian.Uint32(frame[x+4 : x+8])
+		pos := x + 8
+		if flags&0x01 != 0 {
+			pos += 4
+		}
+		if flags&0x02 != 0 {
+			pos += 4
+		}
+		if flags&0x04 != 0 {
+			pos += 100
+		}
+		if flags&0x08 != 0 {
+			pos += 4
+		}
+		if len(frame) < pos+24 {
+			return 0, 0, false
+		}
+		lame := frame[pos : pos+24]
+		encoder := string(lame[:4])
+		if encoder != "LAME" && encoder != "Lavc" && encoder != "Lavf" {
+			return 0, 0, false
+		}
+		delay := int(lame[21])<<4 | int(lame[22])>>4
+		padding := int(lame[22]&0x0F)<<8 | int(lame[23])
+		return delay, padding, true
+	}
+	return 0, 0, false
+}
@@ -0,0 +1,61 @@
+package FilesManager
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/dhowden/tag"
+)
+
+func atom(name string, children ...[]byte) []byte {
+	body := bytes.Join(children, nil)
+	b := make([]byte, 8, 8+len(body))
+	binary.BigEndian.PutUint32(b, uint32(8+len(body)))
+	copy(b[4:], name)
+	return append(b, body...)
+}
+
+// freeformAtom is an iTunes ---- atom as written by iTunes and foobar2000: the mean and name
+// atoms start with their version and flags, the data atom with its type (1 is UTF-8) and its locale.
+func freeformAtom(name string, value string) []byte {
+	return atom("----",
+		atom("mean", []byte("\x00\x00\x00\x00com.apple.iTunes")),
+		atom("name", []byte("\x00\x00\x00\x00"+name)),
+		atom("data", []byte("\x00\x00\x00\x01\x00\x00\x00\x00"+value)),
+	)
+}
+
+func TestReadPlaybackHintsMP4(t *testing.T) {
+	m4a := bytes.Join([][]byte{
+		atom("ftyp", []byte("M4A \x00\x00\x00\x00M4A mp42isom")),
+		atom("moov", atom("udta", atom("meta", []byte("\x00\x00\x00\x00"), atom("ilst",
+			freeformAtom("iTunSMPB", " 00000000 00000840 000001CA 00000000003F31F6 00000000 00000000 00000000 00000000 00000000 00000000 00000000 00000000"),
+			freeformAtom("replaygain_track_gain", "-6.54 dB"),
+			freeformAtom("replaygain_track_peak", "0.988553"),
+		)))),
+	}, nil)
+	r := bytes.NewReader(m4a)
+	m, err := tag.ReadFrom(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hints := ReadPlaybackHints(r, m)
+	if hints.GaplessSource != "itunsmpb" || hints.EncoderDelay != 0x840 || hints.EncoderPadding != 0x1CA {
+		t.Errorf("gapless = %q %d %d, want itunsmpb 2112 458", hints.GaplessSource, hints.EncoderDelay, hints.EncoderPadding)
+	}
+	if hints.TrackGain == nil || *hints.TrackGain != -6.54 {
+		t.Errorf("track gain = %v, want -6.54", hints.TrackGain)
+	}
+	if hints.TrackPeak == nil || *hints.TrackPeak != 0.988553 {
+		t.Errorf("track peak = %v, want 0.988553", hints.TrackPeak)
+	}
+}
+
+func TestParseGain(t *testing.T) {
+	for _, s := range []string{"-6.54 dB", " -6.54 db\n", "\x00\x00\x00\x00-6.54 dB"} {
+		if g := parseGain(s); g == nil || *g != -6.54 {
+			t.Errorf("parseGain(%q) = %v, want -6.54", s, g)
+		}
+	}
+}
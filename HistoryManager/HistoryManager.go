@@ -0,0 +1,345 @@
+package HistoryManager
+
+import (
+	"bufio"
+	"encoding/json"
+	"log"
+	"openify/ConfigurationManager"
+	"openify/FilesManager"
+	"openify/ScrobblerManager"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultPlayedFraction = 0.5
+
+// A play is never recorded twice for the same file within this delay,
+// or within the duration of the file when it is longer.
+const minimumReplayDelay = 30 * time.Second
+
+// A partial stream which is not continued for this long is forgotten.
+const streamTimeout = 30 * time.Minute
+
+// The plays keep the path of the file because the IDs change on every scan.
+// Source is scrobble when the client sent it, stream when it was guessed by the server.
+type Play struct {
+	Id          int       `json:"id"`
+	Username    string    `json:"username"`
+	Path        string    `json:"path"`
+	Title       string    `json:"title"`
+	Artist      string    `json:"artist"`
+	AlbumArtist string    `json:"album-artist"`
+	Album       string    `json:"album"`
+	Genre       string    `json:"genre"`
+	Duration    int       `json:"duration"`
+	Time        time.Time `json:"time"`
+	Source      string    `json:"source"`
+	Missing     bool      `json:"missing"`
+}
+
+type NowPlaying struct {
+	Id       int       `json:"id"`
+	Username string    `json:"username"`
+	Path     string    `json:"path"`
+	Title    string    `json:"title"`
+	Artist   string    `json:"artist"`
+	Album    string    `json:"album"`
+	Duration int       `json:"duration"`
+	Player   string    `json:"player"`
+	Started  time.Time `json:"started"`
+}
+
+type PlayCount struct {
+	Count      int       `json:"count"`
+	LastPlayed time.Time `json:"last-played"`
+}
+
+type streamProgress struct {
+	bytes    int64
+	last     time.Time
+	recorded bool
+}
+
+var mutex sync.RWMutex
+var plays = map[string][]Play{}
+var counts = map[string]map[string]PlayCount{}
+var nowPlaying = map[string]NowPlaying{}
+var streams = map[string]*streamProgress{}
+
+func GetPlaysFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().PlaysList, "plays.log")
+}
+
+// LoadPlays reads the plays file, it contains one JSON play per line.
+func LoadPlays() {
+	path := GetPlaysFile()
+	f, err := os.Open(path)
+	if err != nil {
+		log.Printf("[INFO] No plays file found, it will be created ::> %s\n", path)
+		return
+	}
+	defer f.Close()
+	mutex.Lock()
+	defer mutex.Unlock()
+	total := 0
+	s := bufio.NewScanner(f)
+	s.Buffer(make([]byte, 64*1024), 1024*1024)
+	for s.Scan() {
+		var p Play
+		if err := json.Unmarshal(s.Bytes(), &p); err != nil || p.Username == "" {
+			log.Printf("[WARN] Invalid line in the plays file ::> %s\n", path)
+			continue
+		}
+		addPlay(p)
+		total++
+	}
+	if err := s.Err(); err != nil {
+		log.Fatalf("[ERROR] Unable to read the plays file ::> %s\n%s", path, err)
+	}
+	log.Printf("[INFO] %d plays loaded\n", total)
+}
+
+// addPlay must be called with the mutex locked
+func addPlay(p Play) {
+	list := plays[p.Username]
+	// The plays are kept sorted by time, scrobbles of an offline client may come late
+	i := sort.Search(len(list), func(i int) bool { return list[i].Time.After(p.Time) })
+	list = append(list, Play{})
+	copy(list[i+1:], list[i:])
+	list[i] = p
+	plays[p.Username] = list
+	if counts[p.Username] == nil {
+		counts[p.Username] = map[string]PlayCount{}
+	}
+	c := counts[p.Username][p.Path]
+	c.Count++
+	if p.Time.After(c.LastPlayed) {
+		c.LastPlayed = p.Time
+	}
+	counts[p.Username][p.Path] = c
+	addToRollup(p)
+}
+
+func appendPlay(p Play) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(GetPlaysFile(), os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = f.Write(append(b, '\n'))
+	return err
+}
+
+// Record saves a play of a track at the given time. It returns false
+// when the same track was already recorded for the user at that time.
+func Record(username string, t FilesManager.Track, at time.Time, source string) (bool, error) {
+	p := Play{
+		Username:    username,
+		Path:        t.Path,
+		Title:       t.Title,
+		Artist:      t.Artist,
+		AlbumArtist: t.AlbumArtist,
+		Album:       t.Album,
+		Genre:       t.Genre,
+		Duration:    t.Duration,
+		Time:        at,
+		Source:      source,
+	}
+	mutex.Lock()
+	if isDuplicate(p) {
+		mutex.Unlock()
+		return false, nil
+	}
+	addPlay(p)
+	if np, ok := nowPlaying[username]; ok && np.Path == t.Path {
+		delete(nowPlaying, username)
+	}
+	err := appendPlay(p)
+	mutex.Unlock()
+	// The scrobble queue is saved to the disk, it is not done while the plays are locked
+	ScrobblerManager.Submit(NewListen(username, t, at))
+	return true, err
+}
+
+func NewListen(username string, t FilesManager.Track, at time.Time) ScrobblerManager.Listen {
+	return ScrobblerManager.Listen{
+		Username: username,
+		Title:    t.Title,
+		Artist:   t.Artist,
+		Album:    t.Album,
+		Duration: t.Duration,
+		Track:    t.TrackNumber,
+		Time:     at,
+	}
+}
+
+// isDuplicate must be called with the mutex locked
+func isDuplicate(p Play) bool {
+	delay := time.Duration(p.Duration) * time.Millisecond
+	if delay < minimumReplayDelay {
+		delay = minimumReplayDelay
+	}
+	list := plays[p.Username]
+	for i := len(list) - 1; i >= 0; i-- {
+		if list[i].Time.Before(p.Time.Add(-delay)) {
+			break
+		}
+		if list[i].Path == p.Path && list[i].Time.Before(p.Time.Add(delay)) {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordStream is called after a part of a file was streamed to a user. The parts of
+// a file requested with ranges are added, and a play is recorded once PlayedFraction
+// of the file was sent. A request from the start of the file, restart, begins a new play.
+func RecordStream(username string, t FilesManager.Track, bytes int64, restart bool) {
+	fraction := ConfigurationManager.GetConfiguration().History.PlayedFraction
+	if fraction < 0 || t.Size <= 0 || bytes <= 0 {
+		return
+	}
+	if fraction == 0 {
+		fraction = defaultPlayedFraction
+	}
+	key := username + "\x00" + t.Path
+	now := time.Now()
+	mutex.Lock()
+	for k, s := range streams {
+		if now.Sub(s.last) > streamTimeout {
+			delete(streams, k)
+		}
+	}
+	s, ok := streams[key]
+	if !ok || restart {
+		s = &streamProgress{}
+		streams[key] = s
+	}
+	s.bytes += bytes
+	s.last = now
+	done := !s.recorded && float64(s.bytes) >= fraction*float64(t.Size)
+	if done {
+		s.recorded = true
+	}
+	mutex.Unlock()
+	if done {
+		if _, err := Record(username, t, now, "stream"); err != nil {
+			log.Printf("[ERROR] Unable to save the play ::> %s\n", err)
+		}
+	}
+}
+
+func SetNowPlaying(username string, t FilesManager.Track, player string) {
+	mutex.Lock()
+	nowPlaying[username] = NowPlaying{
+		Username: username,
+		Path:     t.Path,
+		Title:    t.Title,
+		Artist:   t.Artist,
+		Album:    t.Album,
+		Duration: t.Duration,
+		Player:   player,
+		Started:  time.Now(),
+	}
+	mutex.Unlock()
+	ScrobblerManager.NowPlaying(NewListen(username, t, time.Time{}))
+}
+
+// GetNowPlaying returns what the users are listening to, the entries
+// expire one minute after the end of the track.
+func GetNowPlaying() []NowPlaying {
+	now := time.Now()
+	mutex.Lock()
+	defer mutex.Unlock()
+	result := []NowPlaying{}
+	for username, np := range nowPlaying {
+		duration := time.Duration(np.Duration) * time.Millisecond
+		if duration <= 0 {
+			duration = 10 * time.Minute
+		}
+		if now.After(np.Started.Add(duration + time.Minute)) {
+			delete(nowPlaying, username)
+			continue
+		}
+		if t, err := FilesManager.GetTrackByPath(np.Path); err == nil {
+			np.Id = t.Id
+		} else {
+			np.Id = -1
+		}
+		result = append(result, np)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Username < result[j].Username })
+	return result
+}
+
+// GetRecentPlays returns the last plays of a user, the most recent first.
+func GetRecentPlays(username string, limit int) []Play {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	list := plays[username]
+	result := []Play{}
+	for i := len(list) - 1; i >= 0 && (limit <= 0 || len(result) < limit); i-- {
+		result = append(result, resolve(list[i]))
+	}
+	return result
+}
+
+func GetPlayCount(username string, path string) PlayCount {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	return counts[username][path]
+}
+
+func resolve(p Play) Play {
+	if t, err := FilesManager.GetTrackByPath(p.Path); err == nil {
+		p.Id = t.Id
+		p.Missing = false
+	} else {
+		p.Id = -1
+		p.Missing = true
+	}
+	return p
+}
+
+// GetLastPlayed returns when the user last played each file, by path.
+func GetLastPlayed(username string) map[string]time.Time {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	result := map[string]time.Time{}
+	for path, c := range counts[username] {
+		result[path] = c.LastPlayed
+	}
+	return result
+}
+
+// GetCoPlays counts, over the plays of every user, the files played within the
+// window before or after one of the given files.
+func GetCoPlays(seeds map[string]bool, window time.Duration) map[string]int {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	result := map[string]int{}
+	for _, list := range plays {
+		for i, p := range list {
+			if !seeds[p.Path] {
+				continue
+			}
+			for j := i - 1; j >= 0 && p.Time.Sub(list[j].Time) <= window; j-- {
+				if !seeds[list[j].Path] {
+					result[list[j].Path]++
+				}
+			}
+			for j := i + 1; j < len(list) && list[j].Time.Sub(p.Time) <= window; j++ {
+				if !seeds[list[j].Path] {
+					result[list[j].Path]++
+				}
+			}
+		}
+	}
+	return result
+}
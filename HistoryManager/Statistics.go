@@ -0,0 +1,303 @@
+package HistoryManager
+
+import (
+	"openify/FilesManager"
+	"sort"
+	"strings"
+	"time"
+)
+
+const dayFormat = "2006-01-02"
+
+const (
+	TopTracks  = "tracks"
+	TopArtists = "artists"
+	TopAlbums  = "albums"
+	TopGenres  = "genres"
+)
+
+// DailyRollup sums the plays of a user during a day, the statistics are computed
+// from the rollups so they do not have to go through every play.
+type DailyRollup struct {
+	Plays   int
+	Time    int // milliseconds
+	Tracks  map[string]int
+	Artists map[string]int
+	Albums  map[string]int
+	Genres  map[string]int
+}
+
+type Count struct {
+	// The ID of the file for the tracks, or of a file of the album or the artist, -1 when missing
+	Id     int    `json:"id"`
+	Name   string `json:"name"`
+	Artist string `json:"artist,omitempty"`
+	Count  int    `json:"count"`
+}
+
+type DayCount struct {
+	Day   string `json:"day"`
+	Plays int    `json:"plays"`
+	Time  int    `json:"time"`
+}
+
+type NewArtist struct {
+	Name        string    `json:"name"`
+	FirstPlayed time.Time `json:"first-played"`
+	Plays       int       `json:"plays"`
+}
+
+type trackInfo struct {
+	Title  string
+	Artist string
+}
+
+var rollups = map[string]map[string]*DailyRollup{}
+var firstPlayed = map[string]map[string]time.Time{}
+
+// The names are displayed as they were first seen, the keys are in lower case
+var names = map[string]string{}
+var tracks = map[string]trackInfo{}
+
+// addToRollup must be called with the mutex locked
+func addToRollup(p Play) {
+	day := p.Time.In(time.Local).Format(dayFormat)
+	if rollups[p.Username] == nil {
+		rollups[p.Username] = map[string]*DailyRollup{}
+		firstPlayed[p.Username] = map[string]time.Time{}
+	}
+	r, ok := rollups[p.Username][day]
+	if !ok {
+		r = &DailyRollup{
+			Tracks:  map[string]int{},
+			Artists: map[string]int{},
+			Albums:  map[string]int{},
+			Genres:  map[string]int{},
+		}
+		rollups[p.Username][day] = r
+	}
+	r.Plays++
+	r.Time += p.Duration
+	r.Tracks[p.Path]++
+	tracks[p.Path] = trackInfo{Title: p.Title, Artist: p.Artist}
+	if p.Artist != "" {
+		key := addName(p.Artist)
+		r.Artists[key]++
+		if first, ok := firstPlayed[p.Username][key]; !ok || p.Time.Before(first) {
+			firstPlayed[p.Username][key] = p.Time
+		}
+	}
+	if p.Album != "" {
+		artist := p.AlbumArtist
+		if artist == "" {
+			artist = p.Artist
+		}
+		r.Albums[addName(artist)+"\x00"+addName(p.Album)]++
+	}
+	if p.Genre != "" {
+		r.Genres[addName(p.Genre)]++
+	}
+}
+
+func addName(name string) string {
+	key := strings.ToLower(strings.TrimSpace(name))
+	if _, ok := names[key]; !ok {
+		names[key] = strings.TrimSpace(name)
+	}
+	return key
+}
+
+// forEachRollup must be called with the mutex locked, an empty username goes through every user.
+func forEachRollup(username string, from time.Time, to time.Time, f func(username string, day string, r *DailyRollup)) {
+	first := from.In(time.Local).Format(dayFormat)
+	last := to.In(time.Local).Format(dayFormat)
+	for u, days := range rollups {
+		if username != "" && u != username {
+			continue
+		}
+		for day, r := range days {
+			if day >= first && day <= last {
+				f(u, day, r)
+			}
+		}
+	}
+}
+
+// GetTop returns the most played items of a kind between two days included,
+// for a user or for everyone when username is empty.
+func GetTop(username string, kind string, from time.Time, to time.Time, limit int) []Count {
+	mutex.RLock()
+	sums := map[string]int{}
+	forEachRollup(username, from, to, func(_ string, _ string, r *DailyRollup) {
+		var counts map[string]int
+		switch kind {
+		case TopTracks:
+			counts = r.Tracks
+		case TopArtists:
+			counts = r.Artists
+		case TopAlbums:
+			counts = r.Albums
+		case TopGenres:
+			counts = r.Genres
+		}
+		for k, n := range counts {
+			sums[k] += n
+		}
+	})
+	keys := make([]string, 0, len(sums))
+	for k := range sums {
+		keys = append(keys, k)
+	}
+	result := make([]Count, len(keys))
+	for i, k := range keys {
+		result[i] = Count{Id: -1, Name: names[k], Count: sums[k]}
+		switch kind {
+		case TopTracks:
+			result[i].Name = tracks[k].Title
+			result[i].Artist = tracks[k].Artist
+		case TopAlbums:
+			parts := strings.SplitN(k, "\x00", 2)
+			result[i].Artist = names[parts[0]]
+			result[i].Name = names[parts[1]]
+		}
+	}
+	mutex.RUnlock()
+	order := make([]int, len(keys))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		a, b := result[order[i]], result[order[j]]
+		if a.Count != b.Count {
+			return a.Count > b.Count
+		}
+		if strings.ToLower(a.Name) != strings.ToLower(b.Name) {
+			return strings.ToLower(a.Name) < strings.ToLower(b.Name)
+		}
+		return keys[order[i]] < keys[order[j]]
+	})
+	if limit > 0 && len(order) > limit {
+		order = order[:limit]
+	}
+	top := make([]Count, len(order))
+	for i, index := range order {
+		top[i] = result[index]
+		top[i].Id = resolveCount(kind, keys[index])
+	}
+	return top
+}
+
+// resolveCount returns the ID of the file of a track, or of the first file of an album or an artist.
+func resolveCount(kind string, key string) int {
+	switch kind {
+	case TopTracks:
+		if t, err := FilesManager.GetTrackByPath(key); err == nil {
+			return t.Id
+		}
+	case TopArtists, TopAlbums:
+		for _, t := range FilesManager.GetTracks() {
+			if kind == TopArtists && strings.ToLower(strings.TrimSpace(t.Artist)) == key {
+				return t.Id
+			}
+			if kind == TopAlbums && t.Album != "" && FilesManager.AlbumKey(t) == key {
+				return t.Id
+			}
+		}
+	}
+	return -1
+}
+
+// GetDaily returns the number of plays and the listening time of every day between two days included.
+func GetDaily(username string, from time.Time, to time.Time) []DayCount {
+	days := getDayCounts(username, from, to)
+	result := []DayCount{}
+	for d := from.In(time.Local); d.Format(dayFormat) <= to.In(time.Local).Format(dayFormat); d = d.AddDate(0, 0, 1) {
+		day := d.Format(dayFormat)
+		if c, ok := days[day]; ok {
+			result = append(result, *c)
+		} else {
+			result = append(result, DayCount{Day: day})
+		}
+	}
+	return result
+}
+
+// GetActiveDays returns the days with plays between two days included, in order,
+// unlike GetDaily it does not walk the days of the window.
+func GetActiveDays(username string, from time.Time, to time.Time) []DayCount {
+	result := []DayCount{}
+	for _, d := range getDayCounts(username, from, to) {
+		if d.Plays > 0 {
+			result = append(result, *d)
+		}
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Day < result[j].Day })
+	return result
+}
+
+func getDayCounts(username string, from time.Time, to time.Time) map[string]*DayCount {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	days := map[string]*DayCount{}
+	forEachRollup(username, from, to, func(_ string, day string, r *DailyRollup) {
+		d, ok := days[day]
+		if !ok {
+			d = &DayCount{Day: day}
+			days[day] = d
+		}
+		d.Plays += r.Plays
+		d.Time += r.Time
+	})
+	return days
+}
+
+// GetTotals returns the number of plays and the listening time between two days included.
+func GetTotals(username string, from time.Time, to time.Time) (int, int) {
+	mutex.RLock()
+	defer mutex.RUnlock()
+	plays, total := 0, 0
+	forEachRollup(username, from, to, func(_ string, _ string, r *DailyRollup) {
+		plays += r.Plays
+		total += r.Time
+	})
+	return plays, total
+}
+
+// GetActiveUsers returns the users who played something between two days included.
+func GetActiveUsers(from time.Time, to time.Time) []string {
+	mutex.RLock()
+	active := map[string]bool{}
+	forEachRollup("", from, to, func(username string, _ string, _ *DailyRollup) {
+		active[username] = true
+	})
+	mutex.RUnlock()
+	result := []string{}
+	for username := range active {
+		result = append(result, username)
+	}
+	sort.Strings(result)
+	return result
+}
+
+// GetNewArtists returns the artists a user played for the first time between two days included.
+func GetNewArtists(username string, from time.Time, to time.Time) []NewArtist {
+	first := from.In(time.Local).Format(dayFormat)
+	last := to.In(time.Local).Format(dayFormat)
+	mutex.RLock()
+	result := []NewArtist{}
+	for key, t := range firstPlayed[username] {
+		day := t.In(time.Local).Format(dayFormat)
+		if day >= first && day <= last {
+			result = append(result, NewArtist{Name: names[key], FirstPlayed: t})
+		}
+	}
+	for i := range result {
+		key := strings.ToLower(result[i].Name)
+		forEachRollup(username, from, to, func(_ string, _ string, r *DailyRollup) {
+			result[i].Plays += r.Artists[key]
+		})
+	}
+	mutex.RUnlock()
+	sort.SliceStable(result, func(i, j int) bool { return result[i].FirstPlayed.Before(result[j].FirstPlayed) })
+	return result
+}
@@ -0,0 +1,528 @@
+package LdapManager
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The small part of LDAPv3 (RFC 4511) needed to authenticate the users: simple bind and search.
+// The messages are encoded with the BER rules of ASN.1 (X.690).
+
+const (
+	ScopeBase    = 0
+	ScopeOne     = 1
+	ScopeSubtree = 2
+)
+
+const resultSuccess = 0
+const resultInvalidCredentials = 49
+
+const (
+	tagBoolean     = 0x01
+	tagInteger     = 0x02
+	tagOctetString = 0x04
+	tagEnumerated  = 0x0a
+	tagSequence    = 0x30
+
+	appBindRequest     = 0x60
+	appBindResponse    = 0x61
+	appUnbindRequest   = 0x42
+	appSearchRequest   = 0x63
+	appSearchEntry     = 0x64
+	appSearchDone      = 0x65
+	appSearchReference = 0x73
+	contextSimpleAuth  = 0x80
+
+	filterAnd         = 0xa0
+	filterOr          = 0xa1
+	filterNot         = 0xa2
+	filterEquality    = 0xa3
+	filterSubstrings  = 0xa4
+	filterGreaterOrEq = 0xa5
+	filterLessOrEq    = 0xa6
+	filterPresent     = 0x87
+	filterApprox      = 0xa8
+	substringInitial  = 0x80
+	substringAny      = 0x81
+	substringFinal    = 0x82
+)
+
+const defaultLdapPort = "389"
+const defaultLdapsPort = "636"
+const defaultTimeout = 10 * time.Second
+
+// The answers of the server larger than this are refused.
+const maxElementLength = 16 << 20
+
+var ErrInvalidCredentials = errors.New("invalid credentials")
+
+// Error is a result of the server other than a success.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("LDAP result %d: %s", e.Code, e.Message)
+}
+
+type Entry struct {
+	DN         string
+	Attributes map[string][]string
+}
+
+// GetAttributeValues returns the values of an attribute, whose name is compared without case.
+func (e Entry) GetAttributeValues(name string) []string {
+	for n, values := range e.Attributes {
+		if strings.EqualFold(n, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+type Conn struct {
+	conn      net.Conn
+	reader    *bufio.Reader
+	timeout   time.Duration
+	mutex     sync.Mutex
+	messageId int64
+}
+
+// Dialer opens the connection to the server, it can be replaced to reach a server in the process.
+type Dialer func(network string, address string, timeout time.Duration) (net.Conn, error)
+
+// Dial connects to an ldap:// or an ldaps:// URL.
+func Dial(rawUrl string, insecureSkipVerify bool, timeout time.Duration, dialer Dialer) (*Conn, error) {
+	u, err := url.Parse(rawUrl)
+	if err != nil {
+		return nil, err
+	}
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	if dialer == nil {
+		dialer = net.DialTimeout
+	}
+	host, port := u.Hostname(), u.Port()
+	switch u.Scheme {
+	case "ldap":
+		if port == "" {
+			port = defaultLdapPort
+		}
+	case "ldaps":
+		if port == "" {
+			port = defaultLdapsPort
+		}
+	default:
+		return nil, errors.New("unsupported LDAP URL scheme: " + u.Scheme)
+	}
+	c, err := dialer("tcp", net.JoinHostPort(host, port), timeout)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme == "ldaps" {
+		tc := tls.Client(c, &tls.Config{ServerName: host, InsecureSkipVerify: insecureSkipVerify})
+		if err := tc.SetDeadline(time.Now().Add(timeout)); err == nil {
+			err = tc.Handshake()
+		}
+		if err != nil {
+			_ = c.Close()
+			return nil, err
+		}
+		c = tc
+	}
+	return &Conn{conn: c, reader: bufio.NewReader(c), timeout: timeout}, nil
+}
+
+// Close sends an unbind request and closes the connection.
+func (c *Conn) Close() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.messageId++
+	_ = c.conn.SetDeadline(time.Now().Add(c.timeout))
+	_, _ = c.conn.Write(encode(tagSequence, encodeInteger(c.messageId), encode(appUnbindRequest)))
+	return c.conn.Close()
+}
+
+// Bind authenticates the connection with a DN and a password. An empty password is refused,
+// since the servers accept it as an anonymous bind.
+func (c *Conn) Bind(dn string, password string) error {
+	if password == "" {
+		return ErrInvalidCredentials
+	}
+	res, err := c.request(encode(appBindRequest,
+		encodeInteger(3),
+		encodeString(dn),
+		encodeTag(contextSimpleAuth, []byte(password)),
+	), appBindResponse)
+	if err != nil {
+		return err
+	}
+	return getResult(res[0])
+}
+
+// Search returns the entries matching the filter under the base DN.
+func (c *Conn) Search(baseDN string, scope int, filter string, attributes []string) ([]Entry, error) {
+	f, err := compileFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	var attrs [][]byte
+	for _, a := range attributes {
+		attrs = append(attrs, encodeString(a))
+	}
+	res, err := c.request(encode(appSearchRequest,
+		encodeString(baseDN),
+		encodeTag(tagEnumerated, encodeIntegerValue(int64(scope))),
+		encodeTag(tagEnumerated, encodeIntegerValue(0)),
+		encodeInteger(0),
+		encodeInteger(int64(c.timeout/time.Second)),
+		encodeTag(tagBoolean, []byte{0}),
+		f,
+		encode(tagSequence, attrs...),
+	), appSearchDone)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, p := range res {
+		switch p.tag {
+		case appSearchEntry:
+			e, err := getEntry(p)
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, e)
+		case appSearchDone:
+			if err := getResult(p); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return entries, nil
+}
+
+// request sends a message and returns the operations answered to it, until the one of the last tag.
+func (c *Conn) request(op []byte, last byte) ([]element, error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.messageId++
+	id := c.messageId
+	if err := c.conn.SetDeadline(time.Now().Add(c.timeout)); err != nil {
+		return nil, err
+	}
+	if _, err := c.conn.Write(encode(tagSequence, encodeInteger(id), op)); err != nil {
+		return nil, err
+	}
+	var result []element
+	for {
+		msg, err := readElement(c.reader)
+		if err != nil {
+			return nil, err
+		}
+		if msg.tag != tagSequence || len(msg.children) < 2 {
+			return nil, errors.New("malformed LDAP message")
+		}
+		if msgId, err := msg.children[0].integer(); err != nil || msgId != id {
+			continue
+		}
+		p := msg.children[1]
+		if p.tag == appSearchReference {
+			continue
+		}
+		result = append(result, p)
+		if p.tag == last {
+			return result, nil
+		}
+	}
+}
+
+func getResult(p element) error {
+	if len(p.children) < 3 {
+		return errors.New("malformed LDAP result")
+	}
+	code, err := p.children[0].integer()
+	if err != nil {
+		return err
+	}
+	switch code {
+	case resultSuccess:
+		return nil
+	case resultInvalidCredentials:
+		return ErrInvalidCredentials
+	}
+	return &Error{Code: int(code), Message: string(p.children[2].value)}
+}
+
+func getEntry(p element) (Entry, error) {
+	if len(p.children) < 2 {
+		return Entry{}, errors.New("malformed LDAP entry")
+	}
+	e := Entry{DN: string(p.children[0].value), Attributes: map[string][]string{}}
+	for _, a := range p.children[1].children {
+		if len(a.children) < 2 {
+			return Entry{}, errors.New("malformed LDAP attribute")
+		}
+		name := string(a.children[0].value)
+		for _, v := range a.children[1].children {
+			e.Attributes[name] = append(e.Attributes[name], string(v.value))
+		}
+	}
+	return e, nil
+}
+
+// EscapeFilter escapes a value to be put in a filter, as described by RFC 4515.
+func EscapeFilter(value string) string {
+	var sb strings.Builder
+	for i := 0; i < len(value); i++ {
+		switch b := value[i]; b {
+		case '\\', '*', '(', ')', 0:
+			sb.WriteString(fmt.Sprintf("\\%02x", b))
+		default:
+			sb.WriteByte(b)
+		}
+	}
+	return sb.String()
+}
+
+// compileFilter encodes a filter in the string form of RFC 4515, like (&(objectClass=person)(uid=bob)).
+func compileFilter(filter string) ([]byte, error) {
+	filter = strings.TrimSpace(filter)
+	if !strings.HasPrefix(filter, "(") {
+		filter = "(" + filter + ")"
+	}
+	b, rest, err := parseFilter(filter)
+	if err != nil {
+		return nil, err
+	}
+	if rest != "" {
+		return nil, errors.New("unexpected characters after the LDAP filter: " + rest)
+	}
+	return b, nil
+}
+
+// parseFilter encodes the filter at the start of s and returns what follows it.
+func parseFilter(s string) ([]byte, string, error) {
+	if len(s) < 3 || s[0] != '(' {
+		return nil, "", errors.New("malformed LDAP filter: " + s)
+	}
+	switch s[1] {
+	case '&', '|':
+		tag := byte(filterAnd)
+		if s[1] == '|' {
+			tag = filterOr
+		}
+		var children [][]byte
+		rest := s[2:]
+		for strings.HasPrefix(rest, "(") {
+			child, r, err := parseFilter(rest)
+			if err != nil {
+				return nil, "", err
+			}
+			children = append(children, child)
+			rest = r
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("malformed LDAP filter: " + s)
+		}
+		return encode(tag, children...), rest[1:], nil
+	case '!':
+		child, rest, err := parseFilter(s[2:])
+		if err != nil {
+			return nil, "", err
+		}
+		if !strings.HasPrefix(rest, ")") {
+			return nil, "", errors.New("malformed LDAP filter: " + s)
+		}
+		return encode(filterNot, child), rest[1:], nil
+	}
+	end := strings.IndexByte(s, ')')
+	if end == -1 {
+		return nil, "", errors.New("malformed LDAP filter: " + s)
+	}
+	item, rest := s[1:end], s[end+1:]
+	i := strings.IndexByte(item, '=')
+	if i < 1 {
+		return nil, "", errors.New("malformed LDAP filter: " + s)
+	}
+	attr, value, tag := item[:i], item[i+1:], byte(filterEquality)
+	switch attr[len(attr)-1] {
+	case '>':
+		attr, tag = attr[:len(attr)-1], filterGreaterOrEq
+	case '<':
+		attr, tag = attr[:len(attr)-1], filterLessOrEq
+	case '~':
+		attr, tag = attr[:len(attr)-1], filterApprox
+	}
+	if tag == filterEquality && value == "*" {
+		return encodeTag(filterPresent, []byte(attr)), rest, nil
+	}
+	if tag == filterEquality && strings.Contains(value, "*") {
+		parts := strings.Split(value, "*")
+		var substrings [][]byte
+		for j, part := range parts {
+			if part == "" {
+				continue
+			}
+			v, err := unescapeFilter(part)
+			if err != nil {
+				return nil, "", err
+			}
+			switch j {
+			case 0:
+				substrings = append(substrings, encodeTag(substringInitial, v))
+			case len(parts) - 1:
+				substrings = append(substrings, encodeTag(substringFinal, v))
+			default:
+				substrings = append(substrings, encodeTag(substringAny, v))
+			}
+		}
+		return encode(filterSubstrings, encodeString(attr), encode(tagSequence, substrings...)), rest, nil
+	}
+	v, err := unescapeFilter(value)
+	if err != nil {
+		return nil, "", err
+	}
+	return encode(tag, encodeString(attr), encodeTag(tagOctetString, v)), rest, nil
+}
+
+func unescapeFilter(value string) ([]byte, error) {
+	var result []byte
+	for i := 0; i < len(value); i++ {
+		if value[i] != '\\' {
+			result = append(result, value[i])
+			continue
+		}
+		if i+2 >= len(value) {
+			return nil, errors.New("malformed escape in the LDAP filter: " + value)
+		}
+		b, err := strconv.ParseUint(value[i+1:i+3], 16, 8)
+		if err != nil {
+			return nil, errors.New("malformed escape in the LDAP filter: " + value)
+		}
+		result = append(result, byte(b))
+		i += 2
+	}
+	return result, nil
+}
+
+// element is a decoded BER element, with its children when it is constructed.
+type element struct {
+	tag      byte
+	value    []byte
+	children []element
+}
+
+func (e element) integer() (int64, error) {
+	if len(e.value) == 0 || len(e.value) > 8 {
+		return 0, errors.New("malformed BER integer")
+	}
+	var v int64
+	if e.value[0]&0x80 != 0 {
+		v = -1
+	}
+	for _, b := range e.value {
+		v = v<<8 | int64(b)
+	}
+	return v, nil
+}
+
+func readElement(r io.Reader) (element, error) {
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return element{}, err
+	}
+	// The long form of the length gives the number of the bytes of the length
+	length := int(header[1])
+	if header[1]&0x80 != 0 {
+		n := int(header[1] & 0x7f)
+		if n == 0 || n > 4 {
+			return element{}, errors.New("unsupported BER length")
+		}
+		b := make([]byte, n)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return element{}, err
+		}
+		length = 0
+		for _, x := range b {
+			length = length<<8 | int(x)
+		}
+	}
+	if length > maxElementLength {
+		return element{}, errors.New("BER element too large")
+	}
+	value := make([]byte, length)
+	if _, err := io.ReadFull(r, value); err != nil {
+		return element{}, err
+	}
+	return parseElement(header[0], value)
+}
+
+func parseElement(tag byte, value []byte) (element, error) {
+	e := element{tag: tag, value: value}
+	// The bit 6 of the tag is set for the constructed elements
+	if tag&0x20 == 0 {
+		return e, nil
+	}
+	r := strings.NewReader(string(value))
+	for r.Len() > 0 {
+		child, err := readElement(r)
+		if err != nil {
+			return element{}, err
+		}
+		e.children = append(e.children, child)
+	}
+	return e, nil
+}
+
+func encodeTag(tag byte, value []byte) []byte {
+	var b []byte
+	b = append(b, tag)
+	if len(value) < 0x80 {
+		b = append(b, byte(len(value)))
+	} else {
+		var length []byte
+		for n := len(value); n > 0; n >>= 8 {
+			length = append([]byte{byte(n)}, length...)
+		}
+		b = append(b, 0x80|byte(len(length)))
+		b = append(b, length...)
+	}
+	return append(b, value...)
+}
+
+func encode(tag byte, children ...[]byte) []byte {
+	var value []byte
+	for _, c := range children {
+		value = append(value, c...)
+	}
+	return encodeTag(tag, value)
+}
+
+func encodeString(s string) []byte {
+	return encodeTag(tagOctetString, []byte(s))
+}
+
+// encodeIntegerValue returns the shortest two's complement of v.
+func encodeIntegerValue(v int64) []byte {
+	b := []byte{byte(v)}
+	for v > 127 || v < -128 {
+		v >>= 8
+		b = append([]byte{byte(v)}, b...)
+	}
+	return b
+}
+
+func encodeInteger(v int64) []byte {
+	return encodeTag(tagInteger, encodeIntegerValue(v))
+}
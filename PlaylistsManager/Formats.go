@@ -0,0 +1,206 @@
+package PlaylistsManager
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+type Entry struct {
+	Location string
+	Title    string
+}
+
+type Xspf struct {
+	XMLName   xml.Name    `xml:"http://xspf.org/ns/0/ playlist"`
+	Version   string      `xml:"version,attr"`
+	Title     string      `xml:"title,omitempty"`
+	Creator   string      `xml:"creator,omitempty"`
+	TrackList []XspfTrack `xml:"trackList>track"`
+}
+
+type XspfTrack struct {
+	Location string `xml:"location"`
+	Title    string `xml:"title,omitempty"`
+	Creator  string `xml:"creator,omitempty"`
+	Album    string `xml:"album,omitempty"`
+	Duration int    `xml:"duration,omitempty"`
+}
+
+// ParsePlaylistFile reads a M3U, M3U8, PLS or XSPF file and returns its title and its entries.
+func ParsePlaylistFile(abs string) (string, []Entry, error) {
+	b, err := ioutil.ReadFile(abs)
+	if err != nil {
+		return "", nil, err
+	}
+	name := strings.TrimSuffix(filepath.Base(abs), filepath.Ext(abs))
+	switch strings.ToLower(filepath.Ext(abs)) {
+	case ".pls":
+		return name, ParsePLS(toUTF8(b)), nil
+	case ".xspf":
+		var x Xspf
+		if err := xml.Unmarshal(b, &x); err != nil {
+			return "", nil, err
+		}
+		if x.Title != "" {
+			name = x.Title
+		}
+		var entries []Entry
+		for _, t := range x.TrackList {
+			entries = append(entries, Entry{Location: strings.TrimSpace(t.Location), Title: t.Title})
+		}
+		return name, entries, nil
+	default:
+		return name, ParseM3U(toUTF8(b)), nil
+	}
+}
+
+func ParseM3U(content string) []Entry {
+	var entries []Entry
+	title := ""
+	s := bufio.NewScanner(strings.NewReader(content))
+	for s.Scan() {
+		line := strings.TrimSpace(strings.TrimPrefix(s.Text(), "\uFEFF"))
+		if line == "" {
+			continue
+		}
+		if strings.HasPrefix(line, "#EXTINF:") {
+			if i := strings.Index(line, ","); i >= 0 {
+				title = strings.TrimSpace(line[i+1:])
+			}
+			continue
+		}
+		if strings.HasPrefix(line, "#") {
+			continue
+		}
+		entries = append(entries, Entry{Location: line, Title: title})
+		title = ""
+	}
+	return entries
+}
+
+func ParsePLS(content string) []Entry {
+	files := map[int]string{}
+	titles := map[int]string{}
+	max := 0
+	s := bufio.NewScanner(strings.NewReader(content))
+	for s.Scan() {
+		kv := strings.SplitN(strings.TrimSpace(s.Text()), "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		key := strings.ToLower(kv[0])
+		var target map[int]string
+		switch {
+		case strings.HasPrefix(key, "file"):
+			target = files
+			key = key[4:]
+		case strings.HasPrefix(key, "title"):
+			target = titles
+			key = key[5:]
+		default:
+			continue
+		}
+		n, err := strconv.Atoi(key)
+		if err != nil {
+			continue
+		}
+		target[n] = strings.TrimSpace(kv[1])
+		if n > max {
+			max = n
+		}
+	}
+	var entries []Entry
+	for i := 0; i <= max; i++ {
+		if f, ok := files[i]; ok {
+			entries = append(entries, Entry{Location: f, Title: titles[i]})
+		}
+	}
+	return entries
+}
+
+// Old M3U files are often encoded in Latin-1
+func toUTF8(b []byte) string {
+	if utf8.Valid(b) {
+		return string(b)
+	}
+	r := make([]rune, len(b))
+	for i, c := range b {
+		r[i] = rune(c)
+	}
+	return string(r)
+}
+
+func GetDisplayTitle(item Item) string {
+	title := item.Title
+	if title == "" {
+		title = strings.TrimSuffix(filepath.Base(item.Path), filepath.Ext(item.Path))
+	}
+	if item.Artist != "" {
+		title = item.Artist + " - " + title
+	}
+	return title
+}
+
+// The stream function returns the URL used to play an item.
+func RenderM3U8(p Playlist, stream func(item Item) string) []byte {
+	var b bytes.Buffer
+	b.WriteString("#EXTM3U\n")
+	b.WriteString(fmt.Sprintf("#PLAYLIST:%s\n", p.Name))
+	for _, item := range p.Items {
+		if item.Missing {
+			continue
+		}
+		b.WriteString(fmt.Sprintf("#EXTINF:%d,%s\n", item.Duration/1000, GetDisplayTitle(item)))
+		b.WriteString(stream(item) + "\n")
+	}
+	return b.Bytes()
+}
+
+func RenderPLS(p Playlist, stream func(item Item) string) []byte {
+	var b bytes.Buffer
+	b.WriteString("[playlist]\n")
+	n := 0
+	for _, item := range p.Items {
+		if item.Missing {
+			continue
+		}
+		n++
+		b.WriteString(fmt.Sprintf("File%d=%s\n", n, stream(item)))
+		b.WriteString(fmt.Sprintf("Title%d=%s\n", n, GetDisplayTitle(item)))
+		b.WriteString(fmt.Sprintf("Length%d=%d\n", n, item.Duration/1000))
+	}
+	b.WriteString(fmt.Sprintf("NumberOfEntries=%d\nVersion=2\n", n))
+	return b.Bytes()
+}
+
+func RenderXSPF(p Playlist, stream func(item Item) string) ([]byte, error) {
+	x := Xspf{
+		Version: "1",
+		Title:   p.Name,
+		Creator: p.Owner,
+	}
+	for _, item := range p.Items {
+		if item.Missing {
+			continue
+		}
+		x.TrackList = append(x.TrackList, XspfTrack{
+			Location: stream(item),
+			Title:    item.Title,
+			Creator:  item.Artist,
+			Album:    item.Album,
+			Duration: item.Duration,
+		})
+	}
+	b, err := xml.MarshalIndent(x, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append([]byte(xml.Header), b...), nil
+}
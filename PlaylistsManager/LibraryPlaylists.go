@@ -0,0 +1,131 @@
+package PlaylistsManager
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"log"
+	"net/url"
+	"openify/ConfigurationManager"
+	"openify/FilesManager"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Owner of the playlists found in the DocumentRoot
+const LibraryOwner = "library"
+
+var libraryPlaylists []Playlist
+
+// ImportLibraryPlaylists reads the playlist files found by the last scan. They are
+// kept in memory only, read-only, and rebuilt after every scan.
+func ImportLibraryPlaylists() {
+	tracks := FilesManager.GetTracks()
+	lower := make(map[string]FilesManager.Track, len(tracks))
+	for _, t := range tracks {
+		lower[strings.ToLower(filepath.ToSlash(t.Path))] = t
+	}
+	var result []Playlist
+	for _, path := range FilesManager.GetPlaylistFiles() {
+		abs := FilesManager.GetAbsolutePath(path)
+		name, entries, err := ParsePlaylistFile(abs)
+		if err != nil {
+			log.Printf("[WARN] Unable to read the playlist %s\n%s", path, err)
+			continue
+		}
+		sum := sha1.Sum([]byte(filepath.ToSlash(path)))
+		p := Playlist{
+			Id:         "library-" + hex.EncodeToString(sum[:8]),
+			Name:       name,
+			Owner:      LibraryOwner,
+			Public:     true,
+			ReadOnly:   true,
+			Source:     filepath.ToSlash(path),
+			Items:      []Item{},
+			Unresolved: []string{},
+		}
+		if info, err := FilesManager.Stat(path); err == nil {
+			p.Created = info.ModTime()
+			p.Updated = info.ModTime()
+		} else {
+			p.Created = time.Now()
+			p.Updated = p.Created
+		}
+		for _, e := range entries {
+			t, ok := ResolveEntry(filepath.Dir(path), e.Location, lower)
+			if !ok {
+				p.Unresolved = append(p.Unresolved, e.Location)
+				continue
+			}
+			p.Items = append(p.Items, NewItem(t))
+		}
+		if len(p.Unresolved) > 0 {
+			log.Printf("[WARN] %d entries of the playlist %s can not be resolved\n", len(p.Unresolved), path)
+		}
+		result = append(result, p)
+	}
+	mutex.Lock()
+	libraryPlaylists = result
+	mutex.Unlock()
+	log.Printf("[INFO] %d library playlists imported\n", len(result))
+}
+
+// ResolveEntry finds the library file of a playlist entry. The entry can be relative
+// to the folder of the playlist, absolute, or a file URL. When the path does not
+// match, for example because the playlist was written on another computer,
+// the shortest unique end of the path is used.
+func ResolveEntry(dir string, location string, lower map[string]FilesManager.Track) (FilesManager.Track, bool) {
+	location = strings.TrimSpace(location)
+	if strings.HasPrefix(location, "file://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return FilesManager.Track{}, false
+		}
+		location = u.Path
+	} else if strings.Contains(location, "://") {
+		return FilesManager.Track{}, false
+	}
+	location = strings.ReplaceAll(location, "\\", "/")
+	root := filepath.ToSlash(ConfigurationManager.GetConfiguration().DocumentRoot)
+	root = strings.TrimSuffix(root, "/") + "/"
+	var candidate string
+	switch {
+	case strings.HasPrefix(location, root):
+		candidate = strings.TrimPrefix(location, root)
+	case strings.HasPrefix(location, "/") || (len(location) > 2 && location[1] == ':'):
+		candidate = strings.TrimPrefix(location, "/")
+	default:
+		candidate = filepath.ToSlash(filepath.Join(dir, location))
+	}
+	candidate = strings.ToLower(filepath.ToSlash(filepath.Clean(candidate)))
+	if t, ok := lower[candidate]; ok {
+		return t, true
+	}
+	parts := strings.Split(strings.ToLower(location), "/")
+	for i := len(parts) - 1; i >= 1; i-- {
+		suffix := "/" + strings.Join(parts[i:], "/")
+		var found []FilesManager.Track
+		for p, t := range lower {
+			if strings.HasSuffix("/"+p, suffix) {
+				found = append(found, t)
+			}
+		}
+		if len(found) == 1 {
+			return found[0], true
+		}
+		if len(found) == 0 {
+			break
+		}
+	}
+	return FilesManager.Track{}, false
+}
+
+// must be called with the mutex locked
+func findLibraryPlaylist(id string) (Playlist, bool) {
+	for _, p := range libraryPlaylists {
+		if p.Id == id {
+			return p, true
+		}
+	}
+	return Playlist{}, false
+}
@@ -0,0 +1,324 @@
+package PlaylistsManager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"openify/ConfigurationManager"
+	"openify/FilesManager"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// The item keeps the path of the file, its ID is resolved again
+// when the playlist is read because the IDs change on every scan.
+type Item struct {
+	Id       int    `json:"id"`
+	Path     string `json:"path"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Duration int    `json:"duration"`
+	Missing  bool   `json:"missing"`
+}
+
+type Playlist struct {
+	Id      string    `json:"id"`
+	Name    string    `json:"name"`
+	Owner   string    `json:"owner"`
+	Public  bool      `json:"public"`
+	Created time.Time `json:"created"`
+	Updated time.Time `json:"updated"`
+	Items   []Item    `json:"items"`
+	// Set for the playlists found in the DocumentRoot
+	ReadOnly   bool     `json:"read-only"`
+	Source     string   `json:"source,omitempty"`
+	Unresolved []string `json:"unresolved,omitempty"`
+	// Set for the smart playlists, their items are not saved but
+	// computed from the rule every time the playlist is read
+	Smart *SmartRule `json:"smart,omitempty"`
+}
+
+type PlaylistsJsonConfig struct {
+	Playlists []Playlist `json:"playlists"`
+}
+
+var playlists []Playlist
+var mutex sync.Mutex
+
+var errSmartPlaylist = errors.New("the items of a smart playlist come from its rule")
+
+func GetPlaylistsFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().PlaylistsList, "playlists.json")
+}
+
+func LoadPlaylists() {
+	path := GetPlaylistsFile()
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("[INFO] No playlists file found, it will be created ::> %s\n", path)
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read the playlists file ::> %s\n%s"+
+			"\nPlease insure that the file has the reading right", path, err)
+	}
+	var pc PlaylistsJsonConfig
+	err = json.Unmarshal(b, &pc)
+	if err != nil {
+		log.Fatalf("[ERROR] Playlists file incorrect ::> %s\n%s", path, err)
+	}
+	mutex.Lock()
+	playlists = pc.Playlists
+	mutex.Unlock()
+	log.Printf("[INFO] %d playlists loaded\n", len(pc.Playlists))
+}
+
+// savePlaylists must be called with the mutex locked
+func savePlaylists() error {
+	b, err := json.Marshal(PlaylistsJsonConfig{Playlists: playlists})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetPlaylistsFile(), b, 0644)
+}
+
+func CanRead(p Playlist, username string, manager bool) bool {
+	return p.Public || p.Owner == username || manager
+}
+
+func CanEdit(p Playlist, username string, manager bool) bool {
+	return p.Owner == username || manager
+}
+
+// GetPlaylists returns the playlists visible by a user, sorted by name. They are resolved
+// once the mutex is unlocked, the smart playlists go through the whole library.
+func GetPlaylists(username string, manager bool) []Playlist {
+	mutex.Lock()
+	result := []Playlist{}
+	for _, p := range playlists {
+		if CanRead(p, username, manager) {
+			result = append(result, p)
+		}
+	}
+	result = append(result, libraryPlaylists...)
+	mutex.Unlock()
+	for i, p := range result {
+		result[i] = resolve(p)
+	}
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func GetPlaylist(id string, username string, manager bool) (Playlist, error) {
+	p, err := getPlaylist(id, username, manager)
+	if err != nil {
+		return Playlist{}, err
+	}
+	return resolve(p), nil
+}
+
+func getPlaylist(id string, username string, manager bool) (Playlist, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if p, ok := findLibraryPlaylist(id); ok {
+		return p, nil
+	}
+	index := indexOf(id)
+	if index == -1 || !CanRead(playlists[index], username, manager) {
+		return Playlist{}, errors.New("playlist not found")
+	}
+	return playlists[index], nil
+}
+
+// CreatePlaylist creates an empty playlist, or a smart playlist when smart is not nil.
+func CreatePlaylist(name string, owner string, public bool, smart *SmartRule) (Playlist, error) {
+	if name == "" {
+		return Playlist{}, errors.New("playlist name missing")
+	}
+	if smart != nil {
+		if err := ValidateSmartRule(*smart); err != nil {
+			return Playlist{}, err
+		}
+	}
+	id, err := NewId()
+	if err != nil {
+		return Playlist{}, err
+	}
+	now := time.Now()
+	p := Playlist{
+		Id:      id,
+		Name:    name,
+		Owner:   owner,
+		Public:  public,
+		Created: now,
+		Updated: now,
+		Items:   []Item{},
+		Smart:   smart,
+	}
+	mutex.Lock()
+	playlists = append(playlists, p)
+	err = savePlaylists()
+	mutex.Unlock()
+	return resolve(p), err
+}
+
+// EditPlaylist applies edit on a playlist the user is allowed to modify and saves the playlists.
+func EditPlaylist(id string, username string, manager bool, edit func(p *Playlist) error) (Playlist, error) {
+	p, err := editPlaylist(id, username, manager, edit)
+	if err != nil {
+		return Playlist{}, err
+	}
+	return resolve(p), nil
+}
+
+func editPlaylist(id string, username string, manager bool, edit func(p *Playlist) error) (Playlist, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := findLibraryPlaylist(id); ok {
+		return Playlist{}, errors.New("the playlists of the library are read-only")
+	}
+	index := indexOf(id)
+	if index == -1 || !CanRead(playlists[index], username, manager) {
+		return Playlist{}, errors.New("playlist not found")
+	}
+	if !CanEdit(playlists[index], username, manager) {
+		return Playlist{}, errors.New("you are not allowed to do that")
+	}
+	p := playlists[index]
+	p.Items = append([]Item{}, p.Items...)
+	if err := edit(&p); err != nil {
+		return Playlist{}, err
+	}
+	p.Updated = time.Now()
+	playlists[index] = p
+	return p, savePlaylists()
+}
+
+func RemovePlaylist(id string, username string, manager bool) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if _, ok := findLibraryPlaylist(id); ok {
+		return errors.New("the playlists of the library are read-only")
+	}
+	index := indexOf(id)
+	if index == -1 || !CanRead(playlists[index], username, manager) {
+		return errors.New("playlist not found")
+	}
+	if !CanEdit(playlists[index], username, manager) {
+		return errors.New("you are not allowed to do that")
+	}
+	playlists = append(playlists[:index], playlists[index+1:]...)
+	return savePlaylists()
+}
+
+// AddFiles inserts files at a position of the playlist, -1 appends them. The files that access refuses are not found.
+func AddFiles(p *Playlist, access func(path string) bool, ids []int, position int) error {
+	if p.Smart != nil {
+		return errSmartPlaylist
+	}
+	var items []Item
+	for _, id := range ids {
+		t, err := FilesManager.GetTrack(id)
+		if err != nil || !access(t.Path) {
+			return errors.New("file ID is not found")
+		}
+		items = append(items, NewItem(t))
+	}
+	if position < 0 || position > len(p.Items) {
+		position = len(p.Items)
+	}
+	p.Items = append(p.Items[:position], append(items, p.Items[position:]...)...)
+	return nil
+}
+
+// RemoveItems removes the items at the given positions.
+func RemoveItems(p *Playlist, positions []int) error {
+	if p.Smart != nil {
+		return errSmartPlaylist
+	}
+	remove := map[int]bool{}
+	for _, i := range positions {
+		if i < 0 || i >= len(p.Items) {
+			return errors.New("position out of range")
+		}
+		remove[i] = true
+	}
+	items := []Item{}
+	for i, item := range p.Items {
+		if !remove[i] {
+			items = append(items, item)
+		}
+	}
+	p.Items = items
+	return nil
+}
+
+// MoveItem moves the item at from so it ends up at the position to.
+func MoveItem(p *Playlist, from int, to int) error {
+	if p.Smart != nil {
+		return errSmartPlaylist
+	}
+	if from < 0 || from >= len(p.Items) || to < 0 || to >= len(p.Items) {
+		return errors.New("position out of range")
+	}
+	item := p.Items[from]
+	items := append(p.Items[:from], p.Items[from+1:]...)
+	p.Items = append(items[:to], append([]Item{item}, items[to:]...)...)
+	return nil
+}
+
+func NewItem(t FilesManager.Track) Item {
+	return Item{
+		Id:       t.Id,
+		Path:     t.Path,
+		Title:    t.Title,
+		Artist:   t.Artist,
+		Album:    t.Album,
+		Duration: t.Duration,
+	}
+}
+
+// resolve updates the IDs of the items from the library, it is called with the mutex unlocked.
+func resolve(p Playlist) Playlist {
+	if p.Smart != nil {
+		p.Items = EvaluateSmartRule(*p.Smart, p.Owner)
+		return p
+	}
+	items := make([]Item, len(p.Items))
+	for i, item := range p.Items {
+		t, err := FilesManager.GetTrackByPath(item.Path)
+		if err != nil {
+			item.Id = -1
+			item.Missing = true
+		} else {
+			item.Id = t.Id
+			item.Missing = false
+		}
+		items[i] = item
+	}
+	p.Items = items
+	return p
+}
+
+func indexOf(id string) int {
+	for i, p := range playlists {
+		if p.Id == id {
+			return i
+		}
+	}
+	return -1
+}
+
+func NewId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
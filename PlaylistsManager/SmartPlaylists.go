@@ -0,0 +1,326 @@
+package PlaylistsManager
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"openify/AnnotationsManager"
+	"openify/FilesManager"
+	"openify/HistoryManager"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// SmartRule is either a condition on a field, or a group of rules when Rules is set.
+// Example: {"match": "all", "rules": [{"field": "genre", "operator": "is", "value": "Jazz"},
+// {"field": "year", "operator": "lt", "value": 1970}], "sort": "date-added", "order": "desc", "limit": 100}
+type SmartRule struct {
+	Match    string      `json:"match,omitempty"`
+	Rules    []SmartRule `json:"rules,omitempty"`
+	Field    string      `json:"field,omitempty"`
+	Operator string      `json:"operator,omitempty"`
+	Value    interface{} `json:"value,omitempty"`
+	Sort     string      `json:"sort,omitempty"`
+	Order    string      `json:"order,omitempty"`
+	Limit    int         `json:"limit,omitempty"`
+}
+
+const (
+	stringField = iota
+	numberField
+	dateField
+	boolField
+)
+
+var smartFields = map[string]int{
+	"title":        stringField,
+	"album":        stringField,
+	"artist":       stringField,
+	"album-artist": stringField,
+	"composer":     stringField,
+	"genre":        stringField,
+	"codec":        stringField,
+	"path":         stringField,
+	"year":         numberField,
+	"track":        numberField,
+	"disc":         numberField,
+	"duration":     numberField,
+	"play-count":   numberField,
+	"rating":       numberField,
+	"date-added":   dateField,
+	"last-played":  dateField,
+	"lyrics":       boolField,
+	"starred":      boolField,
+}
+
+var smartOperators = map[int][]string{
+	stringField: {"is", "is-not", "contains", "not-contains", "starts-with", "ends-with"},
+	numberField: {"is", "is-not", "lt", "gt", "lte", "gte"},
+	dateField:   {"before", "after", "in-the-last", "not-in-the-last"},
+	boolField:   {"is"},
+}
+
+// ValidateSmartRule checks the fields and the operators of a rule and its sub rules.
+func ValidateSmartRule(rule SmartRule) error {
+	if len(rule.Rules) > 0 {
+		if rule.Match != "" && rule.Match != "all" && rule.Match != "any" {
+			return fmt.Errorf("unknown match %q, expected all or any", rule.Match)
+		}
+		for _, r := range rule.Rules {
+			if err := ValidateSmartRule(r); err != nil {
+				return err
+			}
+		}
+	} else if rule.Field != "" {
+		kind, ok := smartFields[rule.Field]
+		if !ok {
+			return fmt.Errorf("unknown field %q", rule.Field)
+		}
+		valid := false
+		for _, op := range smartOperators[kind] {
+			if op == rule.Operator {
+				valid = true
+			}
+		}
+		if !valid {
+			return fmt.Errorf("operator %q can not be used on %q", rule.Operator, rule.Field)
+		}
+	}
+	if rule.Sort != "" && rule.Sort != "random" {
+		if _, ok := smartFields[rule.Sort]; !ok {
+			return fmt.Errorf("unknown sort field %q", rule.Sort)
+		}
+	}
+	if rule.Limit < 0 {
+		return errors.New("limit must be positive")
+	}
+	return nil
+}
+
+// EvaluateSmartRule returns the items of the library matching the rule,
+// the values depending on a user (plays, ratings) are the ones of username.
+func EvaluateSmartRule(rule SmartRule, username string) []Item {
+	var tracks []FilesManager.Track
+	for _, t := range FilesManager.GetTracks() {
+		if matchRule(rule, t, username) {
+			tracks = append(tracks, t)
+		}
+	}
+	switch rule.Sort {
+	case "":
+	case "random":
+		rand.Shuffle(len(tracks), func(i, j int) { tracks[i], tracks[j] = tracks[j], tracks[i] })
+	default:
+		// The plays and the ratings are looked up once per track, not on every comparison
+		sorted := make([]sortedTrack, len(tracks))
+		for i, t := range tracks {
+			sorted[i] = sortedTrack{track: t, key: sortKey(rule.Sort, t, username)}
+		}
+		desc := rule.Order == "desc"
+		sort.SliceStable(sorted, func(i, j int) bool {
+			c := compareValues(sorted[i].key, sorted[j].key)
+			if desc {
+				return c > 0
+			}
+			return c < 0
+		})
+		for i := range sorted {
+			tracks[i] = sorted[i].track
+		}
+	}
+	if rule.Limit > 0 && len(tracks) > rule.Limit {
+		tracks = tracks[:rule.Limit]
+	}
+	items := []Item{}
+	for _, t := range tracks {
+		items = append(items, NewItem(t))
+	}
+	return items
+}
+
+func matchRule(rule SmartRule, t FilesManager.Track, username string) bool {
+	if len(rule.Rules) > 0 {
+		any := rule.Match == "any"
+		for _, r := range rule.Rules {
+			if matchRule(r, t, username) == any {
+				return any
+			}
+		}
+		return !any
+	}
+	if rule.Field == "" {
+		return true
+	}
+	value := fieldValue(rule.Field, t, username)
+	switch v := value.(type) {
+	case string:
+		return matchString(rule.Operator, strings.ToLower(v), strings.ToLower(fmt.Sprint(rule.Value)))
+	case float64:
+		expected, ok := toNumber(rule.Value)
+		return ok && matchNumber(rule.Operator, v, expected)
+	case time.Time:
+		return matchDate(rule.Operator, v, rule.Value)
+	case bool:
+		expected, ok := rule.Value.(bool)
+		return ok && v == expected
+	}
+	return false
+}
+
+func fieldValue(field string, t FilesManager.Track, username string) interface{} {
+	switch field {
+	case "title":
+		return t.Title
+	case "album":
+		return t.Album
+	case "artist":
+		return t.Artist
+	case "album-artist":
+		return t.AlbumArtist
+	case "composer":
+		return t.Composer
+	case "genre":
+		return t.Genre
+	case "codec":
+		return t.Codec
+	case "path":
+		return filepath.ToSlash(t.Path)
+	case "year":
+		return float64(t.Year)
+	case "track":
+		return float64(t.TrackNumber)
+	case "disc":
+		return float64(t.DiscNumber)
+	case "duration":
+		return float64(t.Duration) / 1000
+	case "play-count":
+		return float64(HistoryManager.GetPlayCount(username, t.Path).Count)
+	case "date-added":
+		return t.Modified
+	case "last-played":
+		return HistoryManager.GetPlayCount(username, t.Path).LastPlayed
+	case "lyrics":
+		return t.HasLyrics
+	case "rating":
+		return float64(AnnotationsManager.GetTrackAnnotation(username, t).Rating)
+	case "starred":
+		return AnnotationsManager.GetTrackAnnotation(username, t).Starred
+	}
+	return nil
+}
+
+type sortedTrack struct {
+	track FilesManager.Track
+	key   interface{}
+}
+
+// sortKey returns the value of the field the tracks are sorted by, the strings lowered.
+func sortKey(field string, t FilesManager.Track, username string) interface{} {
+	v := fieldValue(field, t, username)
+	if s, ok := v.(string); ok {
+		return strings.ToLower(s)
+	}
+	return v
+}
+
+func compareValues(a interface{}, b interface{}) int {
+	switch va := a.(type) {
+	case string:
+		return strings.Compare(va, b.(string))
+	case float64:
+		vb := b.(float64)
+		if va < vb {
+			return -1
+		} else if va > vb {
+			return 1
+		}
+	case time.Time:
+		vb := b.(time.Time)
+		if va.Before(vb) {
+			return -1
+		} else if va.After(vb) {
+			return 1
+		}
+	case bool:
+		vb := b.(bool)
+		if !va && vb {
+			return -1
+		} else if va && !vb {
+			return 1
+		}
+	}
+	return 0
+}
+
+func matchString(op string, v string, expected string) bool {
+	switch op {
+	case "is":
+		return v == expected
+	case "is-not":
+		return v != expected
+	case "contains":
+		return strings.Contains(v, expected)
+	case "not-contains":
+		return !strings.Contains(v, expected)
+	case "starts-with":
+		return strings.HasPrefix(v, expected)
+	case "ends-with":
+		return strings.HasSuffix(v, expected)
+	}
+	return false
+}
+
+func matchNumber(op string, v float64, expected float64) bool {
+	switch op {
+	case "is":
+		return v == expected
+	case "is-not":
+		return v != expected
+	case "lt":
+		return v < expected
+	case "gt":
+		return v > expected
+	case "lte":
+		return v <= expected
+	case "gte":
+		return v >= expected
+	}
+	return false
+}
+
+// The dates are compared to a YYYY-MM-DD value, or to a number of days for in-the-last.
+func matchDate(op string, v time.Time, value interface{}) bool {
+	switch op {
+	case "in-the-last", "not-in-the-last":
+		days, ok := toNumber(value)
+		if !ok {
+			return false
+		}
+		in := v.After(time.Now().Add(-time.Duration(days * float64(24*time.Hour))))
+		return in == (op == "in-the-last")
+	case "before", "after":
+		d, err := time.ParseInLocation("2006-01-02", fmt.Sprint(value), time.Local)
+		if err != nil {
+			return false
+		}
+		if op == "before" {
+			return v.Before(d)
+		}
+		return v.After(d)
+	}
+	return false
+}
+
+func toNumber(value interface{}) (float64, bool) {
+	switch v := value.(type) {
+	case float64:
+		return v, true
+	case string:
+		f, err := strconv.ParseFloat(v, 64)
+		return f, err == nil
+	}
+	return 0, false
+}
@@ -0,0 +1,237 @@
+package QueueManager
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"openify/ConfigurationManager"
+	"openify/FilesManager"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Queue is the play queue of a user, shared by all its devices. Version is incremented
+// on every change, a change made from an older version is refused.
+type Queue struct {
+	Files    []int     `json:"files"`
+	Paths    []string  `json:"paths"`
+	Current  int       `json:"current"`
+	Position int       `json:"position"` // milliseconds
+	Device   string    `json:"device"`
+	Changed  time.Time `json:"changed"`
+	Version  int       `json:"version"`
+}
+
+// Bookmark is the position reached in a file, mostly for the audiobooks.
+type Bookmark struct {
+	Id       int       `json:"id"`
+	Path     string    `json:"path"`
+	Position int       `json:"position"` // milliseconds
+	Comment  string    `json:"comment"`
+	Device   string    `json:"device"`
+	Created  time.Time `json:"created"`
+	Changed  time.Time `json:"changed"`
+	Missing  bool      `json:"missing"`
+}
+
+type QueuesJsonConfig struct {
+	Queues    map[string]Queue      `json:"queues"`
+	Bookmarks map[string][]Bookmark `json:"bookmarks"`
+}
+
+// ErrVersionConflict is returned when the queue was changed by another device in the meantime
+var ErrVersionConflict = errors.New("the play queue was changed by another device")
+
+var mutex sync.Mutex
+var queues = map[string]Queue{}
+var bookmarks = map[string][]Bookmark{}
+
+func GetQueuesFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().QueuesList, "queues.json")
+}
+
+func LoadQueues() {
+	path := GetQueuesFile()
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("[INFO] No play queues file found, it will be created ::> %s\n", path)
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read the play queues file ::> %s\n%s"+
+			"\nPlease insure that the file has the reading right", path, err)
+	}
+	var qc QueuesJsonConfig
+	err = json.Unmarshal(b, &qc)
+	if err != nil {
+		log.Fatalf("[ERROR] Play queues file incorrect ::> %s\n%s", path, err)
+	}
+	mutex.Lock()
+	if qc.Queues != nil {
+		queues = qc.Queues
+	}
+	if qc.Bookmarks != nil {
+		bookmarks = qc.Bookmarks
+	}
+	mutex.Unlock()
+	log.Printf("[INFO] %d play queues loaded\n", len(qc.Queues))
+}
+
+// saveQueues must be called with the mutex locked
+func saveQueues() error {
+	b, err := json.Marshal(QueuesJsonConfig{Queues: queues, Bookmarks: bookmarks})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetQueuesFile(), b, 0644)
+}
+
+// GetQueue returns the play queue of a user, the files which are not in the library anymore
+// or that access refuses are removed.
+func GetQueue(username string, access func(path string) bool) Queue {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return resolveQueue(queues[username], access)
+}
+
+// SetQueue replaces the play queue of a user if version is its current version.
+// The queue is returned with its new version, or the current one on a conflict.
+func SetQueue(username string, access func(path string) bool, files []int, current int, position int, device string, version int) (Queue, error) {
+	q := Queue{
+		Files:    []int{},
+		Paths:    []string{},
+		Current:  current,
+		Position: position,
+		Device:   device,
+		Changed:  time.Now(),
+	}
+	for _, id := range files {
+		t, err := FilesManager.GetTrack(id)
+		if err != nil || !access(t.Path) {
+			return Queue{}, errors.New("file ID is not found")
+		}
+		q.Paths = append(q.Paths, t.Path)
+	}
+	if (len(files) > 0 && (current < 0 || current >= len(files))) || (len(files) == 0 && current != 0) {
+		return Queue{}, errors.New("the current index is out of the queue")
+	}
+	if position < 0 {
+		return Queue{}, errors.New("the position must be positive")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	existing := queues[username]
+	if version != existing.Version {
+		return resolveQueue(existing, access), ErrVersionConflict
+	}
+	q.Version = existing.Version + 1
+	queues[username] = q
+	return resolveQueue(q, access), saveQueues()
+}
+
+// resolveQueue updates the IDs of the files from the library and keeps the current file selected.
+func resolveQueue(q Queue, access func(path string) bool) Queue {
+	resolved := q
+	resolved.Files = []int{}
+	resolved.Paths = []string{}
+	for i, path := range q.Paths {
+		t, err := FilesManager.GetTrackByPath(path)
+		if err != nil || !access(path) {
+			if i < q.Current {
+				resolved.Current--
+			} else if i == q.Current {
+				resolved.Position = 0
+			}
+			continue
+		}
+		resolved.Files = append(resolved.Files, t.Id)
+		resolved.Paths = append(resolved.Paths, path)
+	}
+	if resolved.Current >= len(resolved.Files) {
+		resolved.Current = 0
+		resolved.Position = 0
+	}
+	return resolved
+}
+
+// GetBookmarks returns the bookmarks of a user, except the ones on the files that access refuses.
+func GetBookmarks(username string, access func(path string) bool) []Bookmark {
+	mutex.Lock()
+	result := []Bookmark{}
+	for _, b := range bookmarks[username] {
+		if !access(b.Path) {
+			continue
+		}
+		result = append(result, resolveBookmark(b))
+	}
+	mutex.Unlock()
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Changed.After(result[j].Changed) })
+	return result
+}
+
+// SetBookmark creates or moves the bookmark of a user on a file.
+func SetBookmark(username string, access func(path string) bool, id int, position int, comment string, device string) (Bookmark, error) {
+	t, err := FilesManager.GetTrack(id)
+	if err != nil || !access(t.Path) {
+		return Bookmark{}, errors.New("file ID is not found")
+	}
+	if position < 0 {
+		return Bookmark{}, errors.New("the position must be positive")
+	}
+	now := time.Now()
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := bookmarks[username]
+	b := Bookmark{Path: t.Path, Created: now}
+	index := indexOfBookmark(list, t.Path)
+	if index != -1 {
+		b = list[index]
+	}
+	b.Position = position
+	b.Comment = comment
+	b.Device = device
+	b.Changed = now
+	if index != -1 {
+		list[index] = b
+	} else {
+		list = append(list, b)
+	}
+	bookmarks[username] = list
+	return resolveBookmark(b), saveQueues()
+}
+
+// RemoveBookmark removes a bookmark by the path of its file, so the bookmarks of missing files can be removed.
+func RemoveBookmark(username string, path string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	list := bookmarks[username]
+	index := indexOfBookmark(list, path)
+	if index == -1 {
+		return errors.New("bookmark not found")
+	}
+	bookmarks[username] = append(list[:index], list[index+1:]...)
+	return saveQueues()
+}
+
+func indexOfBookmark(list []Bookmark, path string) int {
+	for i, b := range list {
+		if b.Path == path {
+			return i
+		}
+	}
+	return -1
+}
+
+func resolveBookmark(b Bookmark) Bookmark {
+	if t, err := FilesManager.GetTrackByPath(b.Path); err == nil {
+		b.Id = t.Id
+		b.Missing = false
+	} else {
+		b.Id = -1
+		b.Missing = true
+	}
+	return b
+}
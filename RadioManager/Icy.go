@@ -0,0 +1,67 @@
+package RadioManager
+
+import (
+	"io"
+	"strings"
+)
+
+// Number of audio bytes between two metadata blocks
+const MetaInt = 16000
+
+// IcyWriter interleaves the ICY metadata blocks with the audio data,
+// as expected by the clients sending the "Icy-MetaData: 1" header.
+type IcyWriter struct {
+	w         io.Writer
+	channel   *Channel
+	count     int
+	lastTitle string
+}
+
+func NewIcyWriter(w io.Writer, c *Channel) *IcyWriter {
+	return &IcyWriter{
+		w:       w,
+		channel: c,
+	}
+}
+
+func (iw *IcyWriter) Write(data []byte) (int, error) {
+	written := 0
+	for len(data) > 0 {
+		n := MetaInt - iw.count
+		if n > len(data) {
+			n = len(data)
+		}
+		m, err := iw.w.Write(data[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		iw.count += n
+		data = data[n:]
+		if iw.count == MetaInt {
+			iw.count = 0
+			if _, err := iw.w.Write(iw.metadataBlock()); err != nil {
+				return written, err
+			}
+		}
+	}
+	return written, nil
+}
+
+// The title is only sent when it changed, otherwise an empty block is written.
+func (iw *IcyWriter) metadataBlock() []byte {
+	title := iw.channel.GetTitle()
+	if title == iw.lastTitle {
+		return []byte{0}
+	}
+	iw.lastTitle = title
+	meta := "StreamTitle='" + strings.ReplaceAll(title, "'", "’") + "';"
+	if len(meta) > 255*16 {
+		meta = meta[:255*16]
+	}
+	blocks := (len(meta) + 15) / 16
+	b := make([]byte, 1+blocks*16)
+	b[0] = byte(blocks)
+	copy(b[1:], meta)
+	return b
+}
@@ -0,0 +1,285 @@
+package RadioManager
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"openify/ConfigurationManager"
+	"openify/FilesManager"
+	"openify/PlaylistsManager"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Amount of audio kept in memory and sent at once to a new listener,
+// so the players can fill their buffer without waiting.
+const burstDuration = 2 * time.Second
+
+// Number of pending chunks a listener can have before being dropped.
+const listenerBuffer = 256
+
+type Channel struct {
+	Name        string
+	Description string
+	Format      string
+	mutex       sync.Mutex
+	config      ConfigurationManager.ChannelConfig
+	title       string
+	listeners   map[*Listener]bool
+	burst       []burstFrame
+	burstLength time.Duration
+}
+
+type burstFrame struct {
+	data     []byte
+	duration time.Duration
+}
+
+type Listener struct {
+	C chan []byte
+}
+
+type ChannelInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Format      string `json:"format"`
+	Title       string `json:"title"`
+	Listeners   int    `json:"listeners"`
+}
+
+var channels = map[string]*Channel{}
+
+// StartChannels starts a broadcaster for every channel of the configuration.
+// The channels keep playing even without listeners so everyone hears the same position.
+// Only the MP3 files can be cut into frames and joined, so it is the only format.
+func StartChannels() {
+	for _, cc := range ConfigurationManager.GetConfiguration().Channels {
+		if cc.Name == "" {
+			log.Printf("[WARN] Radio channel without name ignored\n")
+			continue
+		}
+		c := &Channel{
+			Name:        cc.Name,
+			Description: cc.Description,
+			Format:      strings.ToLower(cc.Format),
+			config:      cc,
+			listeners:   map[*Listener]bool{},
+		}
+		if c.Format == "" {
+			c.Format = "mp3"
+		}
+		if c.Format != "mp3" {
+			log.Printf("[WARN] Radio channel %s ignored, the format %s is not supported\n", c.Name, c.Format)
+			continue
+		}
+		channels[c.Name] = c
+		go c.run()
+		log.Printf("[INFO] Radio channel %s started\n", c.Name)
+	}
+}
+
+func GetChannel(name string) (*Channel, error) {
+	c, ok := channels[name]
+	if !ok {
+		return nil, errors.New("channel not found")
+	}
+	return c, nil
+}
+
+// GetChannels returns the channels sorted by name.
+func GetChannels() []*Channel {
+	result := []*Channel{}
+	for _, c := range channels {
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Name < result[j].Name })
+	return result
+}
+
+func (c *Channel) Info() ChannelInfo {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return ChannelInfo{
+		Name:        c.Name,
+		Description: c.Description,
+		Format:      c.Format,
+		Title:       c.title,
+		Listeners:   len(c.listeners),
+	}
+}
+
+// GetFolder returns the folder played by the channel, relative to the DocumentRoot.
+func (c *Channel) GetFolder() string {
+	return strings.Trim(filepath.ToSlash(c.config.Folder), "/")
+}
+
+// GetPlaylist returns the ID of the playlist played by the channel, empty when it plays a folder.
+func (c *Channel) GetPlaylist() string {
+	return c.config.Playlist
+}
+
+func (c *Channel) GetTitle() string {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.title
+}
+
+func (c *Channel) GetContentType() string {
+	return "audio/mpeg"
+}
+
+// Subscribe registers a new listener, its channel starts with the burst buffer.
+func (c *Channel) Subscribe() *Listener {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	l := &Listener{C: make(chan []byte, listenerBuffer+len(c.burst))}
+	for _, b := range c.burst {
+		l.C <- b.data
+	}
+	c.listeners[l] = true
+	return l
+}
+
+func (c *Channel) Unsubscribe(l *Listener) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.listeners[l] {
+		delete(c.listeners, l)
+		close(l.C)
+	}
+}
+
+func (c *Channel) broadcast(f FilesManager.Frame, d time.Duration) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.burst = append(c.burst, burstFrame{data: f.Data, duration: d})
+	c.burstLength += d
+	for c.burstLength > burstDuration && len(c.burst) > 1 {
+		c.burstLength -= c.burst[0].duration
+		c.burst = c.burst[1:]
+	}
+	for l := range c.listeners {
+		select {
+		case l.C <- f.Data:
+		default:
+			// The listener does not follow, drop it instead of blocking the channel.
+			delete(c.listeners, l)
+			close(l.C)
+		}
+	}
+}
+
+// GetTracks returns the tracks of the channel in the order they will be played.
+func (c *Channel) GetTracks() []FilesManager.Track {
+	var result []FilesManager.Track
+	for _, t := range c.getSource() {
+		if strings.TrimPrefix(strings.ToLower(filepath.Ext(t.Path)), ".") != c.Format {
+			continue
+		}
+		result = append(result, t)
+	}
+	if c.config.Shuffle {
+		rand.Shuffle(len(result), func(i, j int) { result[i], result[j] = result[j], result[i] })
+	}
+	return result
+}
+
+// getSource returns the items of the playlist of the channel, or the tracks of its folder.
+// A removed playlist gives no track, like an empty folder.
+func (c *Channel) getSource() []FilesManager.Track {
+	var result []FilesManager.Track
+	if id := c.GetPlaylist(); id != "" {
+		p, err := PlaylistsManager.GetPlaylist(id, "", true)
+		if err != nil {
+			return result
+		}
+		for _, item := range p.Items {
+			if t, err := FilesManager.GetTrackByPath(item.Path); err == nil {
+				result = append(result, t)
+			}
+		}
+		return result
+	}
+	folder := c.GetFolder()
+	for _, t := range FilesManager.GetTracks() {
+		if folder == "" || strings.HasPrefix(filepath.ToSlash(t.Path), folder+"/") {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func (c *Channel) run() {
+	start := time.Now()
+	var played time.Duration
+	for {
+		tracks := c.GetTracks()
+		if len(tracks) == 0 {
+			log.Printf("[WARN] Radio channel %s has no %s track to play\n", c.Name, c.Format)
+			time.Sleep(time.Minute)
+			start = time.Now()
+			played = 0
+			continue
+		}
+		before := played
+		for _, t := range tracks {
+			c.mutex.Lock()
+			c.title = GetTrackTitle(t)
+			c.mutex.Unlock()
+			played = c.play(t, start, played)
+		}
+		if played == before {
+			log.Printf("[WARN] Radio channel %s has no readable %s frame\n", c.Name, c.Format)
+			time.Sleep(time.Minute)
+			start = time.Now()
+			played = 0
+		}
+	}
+}
+
+// play sends the frames of a track at the speed they are played.
+func (c *Channel) play(t FilesManager.Track, start time.Time, played time.Duration) time.Duration {
+	f, err := os.Open(FilesManager.GetAbsolutePath(t.Path))
+	if err != nil {
+		log.Printf("[ERROR] Radio channel %s: %s\n", c.Name, err)
+		time.Sleep(time.Second)
+		return played
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	first := true
+	for {
+		frame, err := FilesManager.ReadFrame(r)
+		if err != nil {
+			return played
+		}
+		if first {
+			first = false
+			if FilesManager.IsInfoFrame(frame) {
+				continue
+			}
+		}
+		d := time.Duration(frame.Samples) * time.Second / time.Duration(frame.SampleRate)
+		c.broadcast(frame, d)
+		played += d
+		if ahead := played - time.Since(start); ahead > 100*time.Millisecond {
+			time.Sleep(ahead)
+		}
+	}
+}
+
+func GetTrackTitle(t FilesManager.Track) string {
+	if t.Title == "" {
+		return strings.TrimSuffix(filepath.Base(t.Path), filepath.Ext(t.Path))
+	}
+	if t.Artist == "" {
+		return t.Title
+	}
+	return fmt.Sprintf("%s - %s", t.Artist, t.Title)
+}
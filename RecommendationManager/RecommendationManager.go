@@ -0,0 +1,321 @@
+package RecommendationManager
+
+import (
+	"math"
+	"math/rand"
+	"openify/FilesManager"
+	"openify/HistoryManager"
+	"sort"
+	"strings"
+	"time"
+)
+
+const DefaultLimit = 50
+const MaxLimit = 500
+
+// Two files played by the same user within this delay are considered as played together.
+const coPlayWindow = 30 * time.Minute
+
+// A file played within this delay is less likely to be picked again, the more recently it was played.
+const recentWindow = 7 * 24 * time.Hour
+
+// The weight of a file played right now, so it is picked only when nothing else is left.
+const minimumRecencyFactor = 0.01
+
+// Empty fields are not filtered, the strings are compared without case.
+// Folder is relative to the DocumentRoot, Unplayed keeps the files never played by the user.
+type Filter struct {
+	Genre       string
+	Artist      string
+	AlbumArtist string
+	Folder      string
+	FromYear    int
+	ToYear      int
+	Unplayed    bool
+}
+
+// A radio is seeded by a Track, or by an Artist or a Genre name.
+type Seed struct {
+	Track  *FilesManager.Track
+	Artist string
+	Genre  string
+}
+
+type candidate struct {
+	track  FilesManager.Track
+	weight float64
+}
+
+// Random returns tracks matching the filter in a random order avoiding the ones played recently.
+// Like the other recommendations, it only picks the files accepted by access.
+func Random(username string, access func(path string) bool, f Filter, limit int) []FilesManager.Track {
+	lastPlayed := HistoryManager.GetLastPlayed(username)
+	folder := strings.Trim(f.Folder, "/")
+	var candidates []candidate
+	for _, t := range getLibrary(access) {
+		if f.Genre != "" && !hasGenre(t, strings.ToLower(f.Genre)) ||
+			f.Artist != "" && !strings.EqualFold(t.Artist, f.Artist) ||
+			f.AlbumArtist != "" && !strings.EqualFold(albumArtist(t), f.AlbumArtist) ||
+			folder != "" && !strings.HasPrefix(t.Path, folder+"/") ||
+			f.FromYear > 0 && t.Year < f.FromYear ||
+			f.ToYear > 0 && (t.Year == 0 || t.Year > f.ToYear) {
+			continue
+		}
+		if _, played := lastPlayed[t.Path]; f.Unplayed && played {
+			continue
+		}
+		candidates = append(candidates, candidate{track: t, weight: 1})
+	}
+	return pick(candidates, lastPlayed, limit, 0)
+}
+
+// Radio returns tracks similar to the seed: sharing its artists, genres, era or composer,
+// and played together with it in the history of every user. The seed track comes first.
+func Radio(username string, access func(path string) bool, seed Seed, limit int) []FilesManager.Track {
+	library := getLibrary(access)
+	var seeds []FilesManager.Track
+	switch {
+	case seed.Track != nil:
+		seeds = []FilesManager.Track{*seed.Track}
+	case seed.Artist != "":
+		for _, t := range library {
+			if strings.EqualFold(t.Artist, seed.Artist) || strings.EqualFold(t.AlbumArtist, seed.Artist) {
+				seeds = append(seeds, t)
+			}
+		}
+	case seed.Genre != "":
+		for _, t := range library {
+			if hasGenre(t, strings.ToLower(seed.Genre)) {
+				seeds = append(seeds, t)
+			}
+		}
+	}
+	if len(seeds) == 0 {
+		return []FilesManager.Track{}
+	}
+	p := newProfile(seeds)
+	if seed.Genre != "" {
+		// The genre radio does not favor the artists which happen to be tagged with it
+		p.artists = map[string]float64{}
+		p.genres = map[string]float64{strings.ToLower(seed.Genre): 1}
+	}
+	paths := map[string]bool{}
+	for _, t := range seeds {
+		paths[t.Path] = true
+	}
+	coPlays := HistoryManager.GetCoPlays(paths, coPlayWindow)
+	maxCoPlays := 0
+	for _, n := range coPlays {
+		if n > maxCoPlays {
+			maxCoPlays = n
+		}
+	}
+	var candidates []candidate
+	for _, t := range library {
+		if seed.Track != nil && t.Path == seed.Track.Path {
+			continue
+		}
+		score := p.similarity(t)
+		// The genre radio keeps to its genre, the co-plays only order its tracks
+		if seed.Genre != "" && score == 0 {
+			continue
+		}
+		if n := coPlays[t.Path]; n > 0 {
+			score += 3 * math.Log1p(float64(n)) / math.Log1p(float64(maxCoPlays))
+		}
+		if score > 0 {
+			candidates = append(candidates, candidate{track: t, weight: score * score})
+		}
+	}
+	// A single artist should not fill the radio, except for its own radio
+	perArtist := limit / 4
+	if perArtist < 2 {
+		perArtist = 2
+	}
+	if seed.Artist != "" {
+		perArtist = 0
+	}
+	lastPlayed := HistoryManager.GetLastPlayed(username)
+	if seed.Track == nil {
+		return pick(candidates, lastPlayed, limit, perArtist)
+	}
+	return append([]FilesManager.Track{*seed.Track}, pick(candidates, lastPlayed, limit-1, perArtist)...)
+}
+
+// MoreFromAlbumArtist returns the tracks of the other albums of the album artist of t,
+// the most recent album first, or the rest of its album when there is no other one.
+func MoreFromAlbumArtist(t FilesManager.Track, access func(path string) bool, limit int) []FilesManager.Track {
+	artist := strings.ToLower(albumArtist(t))
+	album := FilesManager.AlbumKey(t)
+	var others, same []FilesManager.Track
+	for _, c := range getLibrary(access) {
+		if c.Path == t.Path || artist == "" || strings.ToLower(albumArtist(c)) != artist {
+			continue
+		}
+		if t.Album != "" && c.Album != "" && FilesManager.AlbumKey(c) == album {
+			same = append(same, c)
+		} else {
+			others = append(others, c)
+		}
+	}
+	result := others
+	if len(result) == 0 {
+		result = same
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		a, b := result[i], result[j]
+		switch {
+		case a.Year != b.Year:
+			return a.Year > b.Year
+		case a.Album != b.Album:
+			return a.Album < b.Album
+		case a.DiscNumber != b.DiscNumber:
+			return a.DiscNumber < b.DiscNumber
+		case a.TrackNumber != b.TrackNumber:
+			return a.TrackNumber < b.TrackNumber
+		}
+		return a.Path < b.Path
+	})
+	if len(result) > limit {
+		result = result[:limit]
+	}
+	if result == nil {
+		return []FilesManager.Track{}
+	}
+	return result
+}
+
+// profile holds the share of the seed tracks having each artist, genre and composer.
+type profile struct {
+	artists   map[string]float64
+	genres    map[string]float64
+	composers map[string]float64
+	year      float64
+}
+
+func newProfile(seeds []FilesManager.Track) profile {
+	p := profile{artists: map[string]float64{}, genres: map[string]float64{}, composers: map[string]float64{}}
+	share := 1 / float64(len(seeds))
+	years := 0
+	for _, t := range seeds {
+		for _, a := range artistsOf(t) {
+			p.artists[a] += share
+		}
+		for _, g := range genresOf(t) {
+			p.genres[g] += share
+		}
+		if t.Composer != "" {
+			p.composers[strings.ToLower(t.Composer)] += share
+		}
+		if t.Year > 0 {
+			p.year += float64(t.Year)
+			years++
+		}
+	}
+	if years > 0 {
+		p.year /= float64(years)
+	}
+	return p
+}
+
+func (p profile) similarity(t FilesManager.Track) float64 {
+	score := 0.0
+	for _, a := range artistsOf(t) {
+		score += 3 * p.artists[a]
+	}
+	for _, g := range genresOf(t) {
+		score += 2 * p.genres[g]
+	}
+	if t.Composer != "" {
+		score += p.composers[strings.ToLower(t.Composer)]
+	}
+	// The era only counts for files already related to the seed
+	if score > 0 && p.year > 0 && t.Year > 0 {
+		score += math.Max(0, 1-math.Abs(float64(t.Year)-p.year)/10)
+	}
+	return score
+}
+
+// pick draws up to limit candidates, each with a chance proportional to its weight
+// lowered for the files played recently. perArtist limits the tracks of an artist, 0 for no limit.
+func pick(candidates []candidate, lastPlayed map[string]time.Time, limit int, perArtist int) []FilesManager.Track {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	now := time.Now()
+	keys := make([]float64, len(candidates))
+	for i, c := range candidates {
+		w := c.weight
+		if last, ok := lastPlayed[c.track.Path]; ok && now.Sub(last) < recentWindow {
+			w *= math.Max(minimumRecencyFactor, math.Pow(float64(now.Sub(last))/float64(recentWindow), 2))
+		}
+		// Weighted sampling without replacement: the largest u^(1/w) are drawn
+		keys[i] = math.Pow(rng.Float64(), 1/w)
+	}
+	order := make([]int, len(candidates))
+	for i := range order {
+		order[i] = i
+	}
+	sort.Slice(order, func(i, j int) bool { return keys[order[i]] > keys[order[j]] })
+	result := []FilesManager.Track{}
+	artists := map[string]int{}
+	for _, i := range order {
+		if len(result) >= limit {
+			break
+		}
+		t := candidates[i].track
+		artist := strings.ToLower(t.Artist)
+		if perArtist > 0 && artists[artist] >= perArtist {
+			continue
+		}
+		artists[artist]++
+		result = append(result, t)
+	}
+	return result
+}
+
+func getLibrary(access func(path string) bool) []FilesManager.Track {
+	var result []FilesManager.Track
+	for _, t := range FilesManager.GetTracks() {
+		if access(t.Path) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+func albumArtist(t FilesManager.Track) string {
+	if t.AlbumArtist != "" {
+		return t.AlbumArtist
+	}
+	return t.Artist
+}
+
+func artistsOf(t FilesManager.Track) []string {
+	var result []string
+	if t.Artist != "" {
+		result = append(result, strings.ToLower(t.Artist))
+	}
+	if t.AlbumArtist != "" && !strings.EqualFold(t.AlbumArtist, t.Artist) {
+		result = append(result, strings.ToLower(t.AlbumArtist))
+	}
+	return result
+}
+
+// genresOf splits the genre tag, which often holds several genres.
+func genresOf(t FilesManager.Track) []string {
+	var result []string
+	for _, g := range strings.FieldsFunc(strings.ToLower(t.Genre), func(r rune) bool { return r == ',' || r == ';' || r == '/' }) {
+		if g = strings.TrimSpace(g); g != "" {
+			result = append(result, g)
+		}
+	}
+	return result
+}
+
+func hasGenre(t FilesManager.Track, genre string) bool {
+	for _, g := range genresOf(t) {
+		if g == genre {
+			return true
+		}
+	}
+	return false
+}
@@ -1,14 +1,22 @@
 package Response
 
 import (
-	"fmt"
 	"log"
 	"net/http"
 )
 
 func SendJson(w http.ResponseWriter, r *http.Request, b []byte) {
 	w.Header().Add("Content-Type", "application/json")
-	_, err := fmt.Fprintf(w, string(b))
+	_, err := w.Write(b)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+	}
+}
+
+func SendJsonWithStatus(w http.ResponseWriter, r *http.Request, status int, b []byte) {
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err := w.Write(b)
 	if err != nil {
 		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
 	}
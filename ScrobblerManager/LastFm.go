@@ -0,0 +1,131 @@
+package ScrobblerManager
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"openify/ConfigurationManager"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+type LastFm struct{}
+
+type lastFmResponse struct {
+	Error   int    `json:"error"`
+	Message string `json:"message"`
+	Session struct {
+		Name string `json:"name"`
+		Key  string `json:"key"`
+	} `json:"session"`
+}
+
+// The error codes of the Last.fm API which are worth a retry:
+// invalid session key, service offline, temporarily unavailable and rate limit.
+var lastFmRetryErrors = map[int]bool{9: true, 11: true, 16: true, 29: true}
+
+func (LastFm) Scrobble(i Integration, l Listen) error {
+	params := lastFmTrackParams(l)
+	params.Set("method", "track.scrobble")
+	params.Set("timestamp", strconv.FormatInt(l.Time.Unix(), 10))
+	params.Set("sk", i.Token)
+	_, err := callLastFm(GetServiceURL(i), params)
+	return err
+}
+
+func (LastFm) NowPlaying(i Integration, l Listen) error {
+	params := lastFmTrackParams(l)
+	params.Set("method", "track.updateNowPlaying")
+	params.Set("sk", i.Token)
+	_, err := callLastFm(GetServiceURL(i), params)
+	return err
+}
+
+// GetLastFmSession exchanges the token given by the Last.fm authorization page for a session key.
+func GetLastFmSession(token string) (string, error) {
+	params := url.Values{}
+	params.Set("method", "auth.getSession")
+	params.Set("token", token)
+	r, err := callLastFm(GetServiceURL(Integration{Service: LastFmService}), params)
+	if err != nil {
+		return "", err
+	}
+	if r.Session.Key == "" {
+		return "", errors.New("Last.fm did not return a session key")
+	}
+	return r.Session.Key, nil
+}
+
+func lastFmTrackParams(l Listen) url.Values {
+	params := url.Values{}
+	params.Set("artist", l.Artist)
+	params.Set("track", l.Title)
+	if l.Album != "" {
+		params.Set("album", l.Album)
+	}
+	if l.Duration > 0 {
+		params.Set("duration", strconv.Itoa(l.Duration/1000))
+	}
+	if l.Track > 0 {
+		params.Set("trackNumber", strconv.Itoa(l.Track))
+	}
+	return params
+}
+
+func callLastFm(serviceURL string, params url.Values) (lastFmResponse, error) {
+	var r lastFmResponse
+	config := ConfigurationManager.GetConfiguration().Scrobbling
+	if config.LastFmApiKey == "" || config.LastFmSecret == "" {
+		// Retrying cannot help before the configuration is fixed
+		return r, &SubmitError{Message: "the Last.fm API key is missing from the configuration", Permanent: true}
+	}
+	params.Set("api_key", config.LastFmApiKey)
+	params.Set("api_sig", signLastFm(params, config.LastFmSecret))
+	params.Set("format", "json")
+	res, err := client.PostForm(serviceURL, params)
+	if err != nil {
+		return r, err
+	}
+	defer res.Body.Close()
+	if err := json.NewDecoder(res.Body).Decode(&r); err != nil {
+		return r, &SubmitError{Status: res.StatusCode, Message: fmt.Sprintf("Last.fm answered %d", res.StatusCode)}
+	}
+	if r.Error != 0 {
+		// The message of the service stays in the log, the users only see the code
+		log.Printf("[WARN] Last.fm error %d: %q\n", r.Error, r.Message)
+		return r, &SubmitError{
+			Status:    res.StatusCode,
+			Message:   fmt.Sprintf("Last.fm error %d", r.Error),
+			Permanent: !lastFmRetryErrors[r.Error],
+		}
+	}
+	if res.StatusCode != http.StatusOK {
+		return r, &SubmitError{Status: res.StatusCode, Message: fmt.Sprintf("Last.fm answered %d", res.StatusCode)}
+	}
+	return r, nil
+}
+
+// signLastFm computes the md5 of the parameters sorted by name followed by the secret.
+func signLastFm(params url.Values, secret string) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		if k != "format" && k != "callback" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	for _, k := range keys {
+		b.WriteString(k)
+		b.WriteString(params.Get(k))
+	}
+	b.WriteString(secret)
+	sum := md5.Sum([]byte(b.String()))
+	return hex.EncodeToString(sum[:])
+}
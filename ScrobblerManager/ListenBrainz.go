@@ -0,0 +1,89 @@
+package ScrobblerManager
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"openify/ConfigurationManager"
+	"strings"
+)
+
+type ListenBrainz struct{}
+
+type listenBrainzSubmission struct {
+	ListenType string               `json:"listen_type"`
+	Payload    []listenBrainzListen `json:"payload"`
+}
+
+type listenBrainzListen struct {
+	ListenedAt    int64             `json:"listened_at,omitempty"`
+	TrackMetadata listenBrainzTrack `json:"track_metadata"`
+}
+
+type listenBrainzTrack struct {
+	ArtistName     string                 `json:"artist_name"`
+	TrackName      string                 `json:"track_name"`
+	ReleaseName    string                 `json:"release_name,omitempty"`
+	AdditionalInfo map[string]interface{} `json:"additional_info"`
+}
+
+func (ListenBrainz) Scrobble(i Integration, l Listen) error {
+	return submitListenBrainz(i, "single", l)
+}
+
+func (ListenBrainz) NowPlaying(i Integration, l Listen) error {
+	return submitListenBrainz(i, "playing_now", l)
+}
+
+func submitListenBrainz(i Integration, listenType string, l Listen) error {
+	info := map[string]interface{}{
+		"submission_client":         "Openify Server",
+		"submission_client_version": ConfigurationManager.GetVersion(),
+	}
+	if l.Duration > 0 {
+		info["duration_ms"] = l.Duration
+	}
+	if l.Track > 0 {
+		info["tracknumber"] = l.Track
+	}
+	listen := listenBrainzListen{
+		TrackMetadata: listenBrainzTrack{
+			ArtistName:     l.Artist,
+			TrackName:      l.Title,
+			ReleaseName:    l.Album,
+			AdditionalInfo: info,
+		},
+	}
+	if listenType != "playing_now" {
+		listen.ListenedAt = l.Time.Unix()
+	}
+	b, err := json.Marshal(listenBrainzSubmission{
+		ListenType: listenType,
+		Payload:    []listenBrainzListen{listen},
+	})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest("POST", strings.TrimSuffix(GetServiceURL(i), "/")+"/1/submit-listens", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Token "+i.Token)
+	req.Header.Set("Content-Type", "application/json")
+	res, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode == http.StatusOK {
+		return nil
+	}
+	return &SubmitError{
+		Status:  res.StatusCode,
+		Message: fmt.Sprintf("ListenBrainz answered %d", res.StatusCode),
+		// A wrong token can be fixed by the user, so the listen is kept
+		Permanent: res.StatusCode >= 400 && res.StatusCode < 500 &&
+			res.StatusCode != http.StatusUnauthorized && res.StatusCode != http.StatusTooManyRequests,
+	}
+}
@@ -0,0 +1,431 @@
+package ScrobblerManager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"openify/ConfigurationManager"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	ListenBrainzService = "listenbrainz"
+	LastFmService       = "lastfm"
+)
+
+const defaultListenBrainzURL = "https://api.listenbrainz.org"
+const defaultLastFmURL = "https://ws.audioscrobbler.com/2.0/"
+
+// The services refuse the listens older than two weeks
+const maxListenAge = 14 * 24 * time.Hour
+
+const firstRetryDelay = 30 * time.Second
+const maxRetryDelay = 6 * time.Hour
+const workerInterval = 10 * time.Second
+
+var client = &http.Client{Timeout: 15 * time.Second}
+
+// Token is the user token for ListenBrainz and the session key for Last.fm. The URLs of the
+// services come from the configuration only, so the users cannot make the server call any URL.
+// LastError is a short message, never the answer of the service.
+type Integration struct {
+	Username  string    `json:"username"`
+	Service   string    `json:"service"`
+	Token     string    `json:"token"`
+	Enabled   bool      `json:"enabled"`
+	LastError string    `json:"last-error"`
+	LastSent  time.Time `json:"last-sent"`
+}
+
+// Time is zero for a now playing notification
+type Listen struct {
+	Username string    `json:"username"`
+	Title    string    `json:"title"`
+	Artist   string    `json:"artist"`
+	Album    string    `json:"album"`
+	Duration int       `json:"duration"`
+	Track    int       `json:"track"`
+	Time     time.Time `json:"time"`
+}
+
+type QueuedListen struct {
+	Id          string    `json:"id"`
+	Service     string    `json:"service"`
+	Listen      Listen    `json:"listen"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"next-attempt"`
+}
+
+type Service interface {
+	Scrobble(i Integration, l Listen) error
+	NowPlaying(i Integration, l Listen) error
+}
+
+// SubmitError is returned by the services, a permanent error
+// means that sending the listen again will not help.
+type SubmitError struct {
+	Status    int
+	Message   string
+	Permanent bool
+}
+
+func (e *SubmitError) Error() string {
+	return e.Message
+}
+
+type ScrobblersJsonConfig struct {
+	Integrations []Integration `json:"integrations"`
+}
+
+type QueueJsonConfig struct {
+	Queue []QueuedListen `json:"queue"`
+}
+
+var services = map[string]Service{
+	ListenBrainzService: ListenBrainz{},
+	LastFmService:       LastFm{},
+}
+
+var mutex sync.Mutex
+var integrations []Integration
+var queue []QueuedListen
+var wake = make(chan struct{}, 1)
+
+func GetScrobblersFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().ScrobblersList, "scrobblers.json")
+}
+
+func GetQueueFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().ScrobbleQueue, "scrobble-queue.json")
+}
+
+// StartScrobblers loads the integrations and the listens not sent yet, and starts the worker sending them.
+func StartScrobblers() {
+	var sc ScrobblersJsonConfig
+	readJsonFile(GetScrobblersFile(), "scrobblers", &sc)
+	var qc QueueJsonConfig
+	readJsonFile(GetQueueFile(), "scrobble queue", &qc)
+	mutex.Lock()
+	integrations = sc.Integrations
+	queue = qc.Queue
+	mutex.Unlock()
+	log.Printf("[INFO] %d scrobblers loaded, %d listens waiting to be sent\n", len(sc.Integrations), len(qc.Queue))
+	go worker()
+}
+
+func readJsonFile(path string, name string, v interface{}) {
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("[INFO] No %s file found, it will be created ::> %s\n", name, path)
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read the %s file ::> %s\n%s"+
+			"\nPlease insure that the file has the reading right", name, path, err)
+	}
+	if err := json.Unmarshal(b, v); err != nil {
+		log.Fatalf("[ERROR] The %s file is incorrect ::> %s\n%s", name, path, err)
+	}
+}
+
+// saveIntegrations must be called with the mutex locked, the file contains the tokens of the users.
+func saveIntegrations() error {
+	b, err := json.Marshal(ScrobblersJsonConfig{Integrations: integrations})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetScrobblersFile(), b, 0600)
+}
+
+// saveQueue must be called with the mutex locked
+func saveQueue() error {
+	b, err := json.Marshal(QueueJsonConfig{Queue: queue})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetQueueFile(), b, 0644)
+}
+
+func GetServiceURL(i Integration) string {
+	config := ConfigurationManager.GetConfiguration().Scrobbling
+	if i.Service == LastFmService {
+		if config.LastFmURL != "" {
+			return config.LastFmURL
+		}
+		return defaultLastFmURL
+	}
+	if config.ListenBrainzURL != "" {
+		return config.ListenBrainzURL
+	}
+	return defaultListenBrainzURL
+}
+
+func GetIntegration(username string, service string) (Integration, bool) {
+	return findIntegration(username, service)
+}
+
+func GetIntegrations(username string) []Integration {
+	mutex.Lock()
+	defer mutex.Unlock()
+	result := []Integration{}
+	for _, i := range integrations {
+		if i.Username == username {
+			result = append(result, i)
+		}
+	}
+	sort.Slice(result, func(a, b int) bool { return result[a].Service < result[b].Service })
+	return result
+}
+
+// SetIntegration adds or replaces the integration of a user with a service.
+func SetIntegration(i Integration) error {
+	if _, ok := services[i.Service]; !ok {
+		return errors.New("unknown scrobbling service, expected listenbrainz or lastfm")
+	}
+	if i.Token == "" {
+		return errors.New("token missing")
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	for index, existing := range integrations {
+		if existing.Username == i.Username && existing.Service == i.Service {
+			i.LastSent = existing.LastSent
+			integrations[index] = i
+			return saveIntegrations()
+		}
+	}
+	integrations = append(integrations, i)
+	return saveIntegrations()
+}
+
+// RemoveIntegration removes the integration and the listens waiting to be sent to it.
+func RemoveIntegration(username string, service string) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for index, i := range integrations {
+		if i.Username == username && i.Service == service {
+			integrations = append(integrations[:index], integrations[index+1:]...)
+			removeFromQueue(func(q QueuedListen) bool {
+				return q.Listen.Username == username && q.Service == service
+			})
+			if err := saveQueue(); err != nil {
+				return err
+			}
+			return saveIntegrations()
+		}
+	}
+	return errors.New("scrobbler not found")
+}
+
+// GetPendingCount returns the number of listens of a user waiting to be sent to a service.
+func GetPendingCount(username string, service string) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	n := 0
+	for _, q := range queue {
+		if q.Listen.Username == username && q.Service == service {
+			n++
+		}
+	}
+	return n
+}
+
+// Submit queues a listen for every enabled integration of its user.
+// The listens without artist or title are refused by the services, so they are not sent.
+func Submit(l Listen) {
+	if time.Since(l.Time) > maxListenAge || l.Artist == "" || l.Title == "" {
+		return
+	}
+	mutex.Lock()
+	queued := false
+	for _, i := range integrations {
+		if i.Username != l.Username || !i.Enabled {
+			continue
+		}
+		id, err := newId()
+		if err != nil {
+			log.Printf("[ERROR] %s\n", err)
+			continue
+		}
+		queue = append(queue, QueuedListen{
+			Id:          id,
+			Service:     i.Service,
+			Listen:      l,
+			NextAttempt: time.Now(),
+		})
+		queued = true
+	}
+	if queued {
+		if err := saveQueue(); err != nil {
+			log.Printf("[ERROR] Unable to save the scrobble queue ::> %s\n", err)
+		}
+	}
+	mutex.Unlock()
+	if queued {
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// NowPlaying sends a now playing notification to the enabled integrations
+// of the user, it is not retried when it fails.
+func NowPlaying(l Listen) {
+	if l.Artist == "" || l.Title == "" {
+		return
+	}
+	for _, i := range GetIntegrations(l.Username) {
+		if !i.Enabled {
+			continue
+		}
+		go func(i Integration) {
+			if err := services[i.Service].NowPlaying(i, l); err != nil {
+				log.Printf("[WARN] Now playing of %s not sent to %s ::> %s\n", l.Username, i.Service, err)
+			}
+		}(i)
+	}
+}
+
+func worker() {
+	ticker := time.NewTicker(workerInterval)
+	for {
+		select {
+		case <-ticker.C:
+		case <-wake:
+		}
+		sendQueue()
+	}
+}
+
+// sendQueue sends the listens which are due, one after the other so they arrive in order.
+func sendQueue() {
+	now := time.Now()
+	mutex.Lock()
+	var due []QueuedListen
+	for _, q := range queue {
+		if !q.NextAttempt.After(now) {
+			due = append(due, q)
+		}
+	}
+	mutex.Unlock()
+	for _, q := range due {
+		i, ok := findIntegration(q.Listen.Username, q.Service)
+		if !ok || (!i.Enabled && time.Since(q.Listen.Time) > maxListenAge) {
+			dropQueued(q.Id)
+			continue
+		}
+		// Kept until the integration is enabled again
+		if !i.Enabled {
+			continue
+		}
+		err := services[q.Service].Scrobble(i, q.Listen)
+		mutex.Lock()
+		index := findQueued(q.Id)
+		if index == -1 {
+			mutex.Unlock()
+			continue
+		}
+		var permanent *SubmitError
+		if err == nil || (errors.As(err, &permanent) && permanent.Permanent) || time.Since(q.Listen.Time) > maxListenAge {
+			queue = append(queue[:index], queue[index+1:]...)
+		} else {
+			queue[index].Attempts++
+			queue[index].NextAttempt = time.Now().Add(retryDelay(queue[index].Attempts))
+		}
+		updateIntegration(i.Username, i.Service, err)
+		if err := saveQueue(); err != nil {
+			log.Printf("[ERROR] Unable to save the scrobble queue ::> %s\n", err)
+		}
+		mutex.Unlock()
+		if err != nil {
+			log.Printf("[WARN] Listen of %s not sent to %s ::> %s\n", i.Username, i.Service, err)
+		}
+	}
+}
+
+// retryDelay doubles the delay after every failed attempt
+func retryDelay(attempts int) time.Duration {
+	delay := firstRetryDelay
+	for n := 1; n < attempts && delay < maxRetryDelay; n++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	return delay
+}
+
+func findIntegration(username string, service string) (Integration, bool) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	for _, i := range integrations {
+		if i.Username == username && i.Service == service {
+			return i, true
+		}
+	}
+	return Integration{}, false
+}
+
+// updateIntegration must be called with the mutex locked
+func updateIntegration(username string, service string, err error) {
+	for index, i := range integrations {
+		if i.Username == username && i.Service == service {
+			if err != nil {
+				integrations[index].LastError = err.Error()
+			} else {
+				integrations[index].LastError = ""
+				integrations[index].LastSent = time.Now()
+			}
+			if err := saveIntegrations(); err != nil {
+				log.Printf("[ERROR] Unable to save the scrobblers ::> %s\n", err)
+			}
+			return
+		}
+	}
+}
+
+// findQueued must be called with the mutex locked
+func findQueued(id string) int {
+	for index, q := range queue {
+		if q.Id == id {
+			return index
+		}
+	}
+	return -1
+}
+
+func dropQueued(id string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	removeFromQueue(func(q QueuedListen) bool { return q.Id == id })
+	if err := saveQueue(); err != nil {
+		log.Printf("[ERROR] Unable to save the scrobble queue ::> %s\n", err)
+	}
+}
+
+// removeFromQueue must be called with the mutex locked
+func removeFromQueue(remove func(q QueuedListen) bool) {
+	kept := []QueuedListen{}
+	for _, q := range queue {
+		if !remove(q) {
+			kept = append(kept, q)
+		}
+	}
+	queue = kept
+}
+
+func newId() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
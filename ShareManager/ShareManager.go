@@ -0,0 +1,221 @@
+package ShareManager
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"openify/ConfigurationManager"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	FileShare     = "file"
+	AlbumShare    = "album"
+	FolderShare   = "folder"
+	PlaylistShare = "playlist"
+)
+
+const maxExpiration = 365 * 24 * time.Hour
+
+// A new play is counted when the same client starts a shared file again after this delay
+const replayDelay = time.Minute
+
+// Target is the path of the file, the key of the album, the folder or the ID of the playlist.
+// Password is the bcrypt hash of the optional password, MaxPlays 0 means no limit.
+type Share struct {
+	Id          string    `json:"id"`
+	Owner       string    `json:"owner"`
+	Type        string    `json:"type"`
+	Target      string    `json:"target"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Password    string    `json:"password,omitempty"`
+	Expires     time.Time `json:"expires"`
+	MaxPlays    int       `json:"max-plays"`
+	Plays       int       `json:"plays"`
+	Created     time.Time `json:"created"`
+}
+
+type SharesJsonConfig struct {
+	Shares []Share `json:"shares"`
+}
+
+var mutex sync.Mutex
+var shares []Share
+var lastStarts = map[string]time.Time{}
+
+func GetSharesFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().SharesList, "shares.json")
+}
+
+func LoadShares() {
+	path := GetSharesFile()
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("[INFO] No shares file found, it will be created ::> %s\n", path)
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read the shares file ::> %s\n%s"+
+			"\nPlease insure that the file has the reading right", path, err)
+	}
+	var sc SharesJsonConfig
+	err = json.Unmarshal(b, &sc)
+	if err != nil {
+		log.Fatalf("[ERROR] Shares file incorrect ::> %s\n%s", path, err)
+	}
+	mutex.Lock()
+	shares = sc.Shares
+	mutex.Unlock()
+	log.Printf("[INFO] %d shares loaded\n", len(sc.Shares))
+}
+
+// saveShares must be called with the mutex locked, the expired shares are removed.
+func saveShares() error {
+	now := time.Now()
+	kept := []Share{}
+	for _, s := range shares {
+		if s.Expires.After(now) {
+			kept = append(kept, s)
+		}
+	}
+	shares = kept
+	b, err := json.Marshal(SharesJsonConfig{Shares: shares})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetSharesFile(), b, 0644)
+}
+
+// CreateShare saves a new share, its ID is the secret part of the link.
+func CreateShare(s Share, password string, expiresIn time.Duration) (Share, error) {
+	if expiresIn <= 0 || expiresIn > maxExpiration {
+		return Share{}, errors.New("a share must expire within a year")
+	}
+	if s.MaxPlays < 0 {
+		return Share{}, errors.New("the maximum number of plays must be positive")
+	}
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return Share{}, err
+	}
+	s.Id = hex.EncodeToString(b)
+	s.Created = time.Now()
+	s.Expires = s.Created.Add(expiresIn)
+	s.Plays = 0
+	s.Password = ""
+	if password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+		if err != nil {
+			return Share{}, err
+		}
+		s.Password = string(hash)
+	}
+	mutex.Lock()
+	defer mutex.Unlock()
+	shares = append(shares, s)
+	return s, saveShares()
+}
+
+// GetShare returns a share which has not expired.
+func GetShare(id string) (Share, error) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	index := indexOf(id)
+	if index == -1 || !shares[index].Expires.After(time.Now()) {
+		return Share{}, errors.New("share not found or expired")
+	}
+	return shares[index], nil
+}
+
+// GetShares returns the shares of a user which have not expired, or of every user when owner is empty.
+func GetShares(owner string) []Share {
+	now := time.Now()
+	mutex.Lock()
+	result := []Share{}
+	for _, s := range shares {
+		if (owner == "" || s.Owner == owner) && s.Expires.After(now) {
+			result = append(result, s)
+		}
+	}
+	mutex.Unlock()
+	sort.SliceStable(result, func(i, j int) bool { return result[i].Created.After(result[j].Created) })
+	return result
+}
+
+// RemoveShare revokes a share, only its owner and the managers of the shares can do it.
+func RemoveShare(id string, username string, manager bool) error {
+	mutex.Lock()
+	defer mutex.Unlock()
+	index := indexOf(id)
+	if index == -1 {
+		return errors.New("share not found")
+	}
+	if shares[index].Owner != username && !manager {
+		return errors.New("you are not allowed to do that")
+	}
+	shares = append(shares[:index], shares[index+1:]...)
+	return saveShares()
+}
+
+func IsProtected(s Share) bool {
+	return s.Password != ""
+}
+
+func CheckPassword(s Share, password string) bool {
+	if !IsProtected(s) {
+		return true
+	}
+	return bcrypt.CompareHashAndPassword([]byte(s.Password), []byte(password)) == nil
+}
+
+// StartPlay counts a play of a shared file by a client, the starts of the same file
+// by the same client within a minute are counted once. It returns false when
+// the share reached its maximum number of plays.
+func StartPlay(id string, path string, client string) (bool, error) {
+	now := time.Now()
+	mutex.Lock()
+	defer mutex.Unlock()
+	index := indexOf(id)
+	if index == -1 {
+		return false, errors.New("share not found")
+	}
+	for k, t := range lastStarts {
+		if now.Sub(t) > replayDelay {
+			delete(lastStarts, k)
+		}
+	}
+	key := id + "\x00" + path + "\x00" + client
+	if _, ok := lastStarts[key]; ok {
+		return true, nil
+	}
+	s := &shares[index]
+	if s.MaxPlays > 0 && s.Plays >= s.MaxPlays {
+		return false, nil
+	}
+	lastStarts[key] = now
+	s.Plays++
+	return true, saveShares()
+}
+
+// CanPlay tells if a share did not reach its maximum number of plays.
+func CanPlay(s Share) bool {
+	return s.MaxPlays == 0 || s.Plays < s.MaxPlays
+}
+
+func indexOf(id string) int {
+	for i, s := range shares {
+		if s.Id == id {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,132 @@
+package StreamManager
+
+import (
+	"net/http"
+	"openify/ConfigurationManager"
+	"sync"
+)
+
+// Size of the chunks handed to the limiters, so a single large write from
+// http.ServeFile does not consume a whole second of budget at once.
+const chunkSize = 16 * 1024
+
+const defaultRetryAfter = 10
+
+var mutex sync.Mutex
+var streams = map[string]int{}
+var userLimiters = map[string]*Limiter{}
+var globalLimiter *Limiter
+var globalOnce sync.Once
+
+type ThrottledWriter struct {
+	http.ResponseWriter
+	user    *Limiter
+	global  *Limiter
+	written int64
+}
+
+func (tw *ThrottledWriter) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		end := written + chunkSize
+		if end > len(b) {
+			end = len(b)
+		}
+		tw.user.Wait(end - written)
+		tw.global.Wait(end - written)
+		n, err := tw.ResponseWriter.Write(b[written:end])
+		written += n
+		tw.written += int64(n)
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// NewThrottledWriter wraps w so that everything written through it respects
+// both the bandwidth cap of the user and the global one.
+func NewThrottledWriter(w http.ResponseWriter, username string) *ThrottledWriter {
+	return &ThrottledWriter{
+		ResponseWriter: w,
+		user:           GetUserLimiter(username),
+		global:         GetGlobalLimiter(),
+	}
+}
+
+// Written returns the number of bytes sent to the client
+func (tw *ThrottledWriter) Written() int64 {
+	return tw.written
+}
+
+func GetUserLimiter(username string) *Limiter {
+	mutex.Lock()
+	defer mutex.Unlock()
+	l, ok := userLimiters[username]
+	if !ok {
+		l = NewLimiter(kbpsToBytes(ConfigurationManager.GetConfiguration().Streaming.UserBandwidthKbps))
+		userLimiters[username] = l
+	}
+	return l
+}
+
+func GetGlobalLimiter() *Limiter {
+	globalOnce.Do(func() {
+		globalLimiter = NewLimiter(kbpsToBytes(ConfigurationManager.GetConfiguration().Streaming.GlobalBandwidthKbps))
+	})
+	return globalLimiter
+}
+
+// Acquire reserves a stream slot for the user, it returns false if the user
+// already reached MaxStreamsPerUser. Every successful call must be followed by Release.
+func Acquire(username string) bool {
+	max := ConfigurationManager.GetConfiguration().Streaming.MaxStreamsPerUser
+	mutex.Lock()
+	defer mutex.Unlock()
+	if max > 0 && streams[username] >= max {
+		return false
+	}
+	streams[username]++
+	return true
+}
+
+func Release(username string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+	if streams[username] <= 1 {
+		delete(streams, username)
+	} else {
+		streams[username]--
+	}
+}
+
+func GetActiveStreams(username string) int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	return streams[username]
+}
+
+// GetTotalStreams returns the number of streams running for all the users.
+func GetTotalStreams() int {
+	mutex.Lock()
+	defer mutex.Unlock()
+	total := 0
+	for _, n := range streams {
+		total += n
+	}
+	return total
+}
+
+// GetRetryAfter returns the number of seconds sent in the Retry-After header
+// when a user exceeds its stream limit.
+func GetRetryAfter() int {
+	r := ConfigurationManager.GetConfiguration().Streaming.RetryAfter
+	if r <= 0 {
+		return defaultRetryAfter
+	}
+	return r
+}
+
+func kbpsToBytes(kbps int64) int64 {
+	return kbps * 1000 / 8
+}
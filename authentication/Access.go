@@ -0,0 +1,93 @@
+package authentication
+
+import (
+	"openify/ConfigurationManager"
+	"path/filepath"
+	"strings"
+)
+
+func normalizeFolders(folders []string) []string {
+	var result []string
+	for _, f := range folders {
+		if f = strings.Trim(filepath.ToSlash(f), "/"); f != "" {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// GetAllowedFolders returns the folders the user can see, the ones of the user replace
+// the ones of its role. An empty list means the whole library.
+func GetAllowedFolders(user User) []string {
+	if len(user.AllowedFolders) > 0 {
+		return normalizeFolders(user.AllowedFolders)
+	}
+	allowed := normalizeFolders(ConfigurationManager.GetConfiguration().LibraryAccess[user.Role].AllowedFolders)
+	if allowed == nil {
+		return []string{}
+	}
+	return allowed
+}
+
+// GetDeniedFolders returns the folders hidden to the user by its role and by its own rules.
+func GetDeniedFolders(user User) []string {
+	denied := normalizeFolders(ConfigurationManager.GetConfiguration().LibraryAccess[user.Role].DeniedFolders)
+	denied = append(denied, normalizeFolders(user.DeniedFolders)...)
+	if denied == nil {
+		return []string{}
+	}
+	return denied
+}
+
+// IsRestricted tells if the user cannot see the whole library.
+func IsRestricted(user User) bool {
+	return len(GetAllowedFolders(user)) > 0 || len(GetDeniedFolders(user)) > 0
+}
+
+// CanAccess tells if the user can see a file, its path is relative to the DocumentRoot.
+func CanAccess(user User, path string) bool {
+	return NewAccessChecker(user)(path)
+}
+
+// NewAccessChecker returns CanAccess for the user with its rules read once, to check many files.
+func NewAccessChecker(user User) func(path string) bool {
+	allowed, denied := GetAllowedFolders(user), GetDeniedFolders(user)
+	return func(path string) bool {
+		path = filepath.ToSlash(path)
+		for _, f := range denied {
+			if isInFolder(path, f) {
+				return false
+			}
+		}
+		if len(allowed) == 0 {
+			return true
+		}
+		for _, f := range allowed {
+			if isInFolder(path, f) {
+				return true
+			}
+		}
+		return false
+	}
+}
+
+// CanAccessFolder tells if the user can see every file of a folder, "" being the whole library.
+func CanAccessFolder(user User, folder string) bool {
+	folder = strings.Trim(filepath.ToSlash(folder), "/")
+	if folder == "" {
+		return !IsRestricted(user)
+	}
+	if !CanAccess(user, folder) {
+		return false
+	}
+	for _, f := range GetDeniedFolders(user) {
+		if isInFolder(f, folder) {
+			return false
+		}
+	}
+	return true
+}
+
+func isInFolder(path string, folder string) bool {
+	return path == folder || strings.HasPrefix(path, folder+"/")
+}
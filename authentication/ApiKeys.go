@@ -0,0 +1,371 @@
+package authentication
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"openify/ConfigurationManager"
+	"openify/Response"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The keys start with this prefix, so they are told apart from the access tokens.
+const apiKeyPrefix = "opk_"
+
+// An API key lets a script or a headless player call the API without a login. It has the
+// permissions of its user, restricted to its scopes when there are some. Hash is the SHA-256
+// of the key, which is shown only once. A zero Expires means that the key does not expire.
+type ApiKey struct {
+	Id       string    `json:"id"`
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Hash     string    `json:"hash"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"last-used"`
+}
+
+type ApiKeyInfo struct {
+	Id       string    `json:"id"`
+	Username string    `json:"username"`
+	Name     string    `json:"name"`
+	Scopes   []string  `json:"scopes"`
+	Created  time.Time `json:"created"`
+	Expires  time.Time `json:"expires"`
+	LastUsed time.Time `json:"last-used"`
+}
+
+type ApiKeysList struct {
+	ApiKeys []ApiKeyInfo `json:"api-keys"`
+	Success bool         `json:"success"`
+}
+
+type ApiKeysJsonConfig struct {
+	ApiKeys []ApiKey `json:"api-keys"`
+}
+
+type NewApiKey struct {
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	ExpiresInDays int      `json:"expires-in-days"`
+}
+
+type CreatedApiKey struct {
+	ApiKeyInfo
+	Key     string `json:"key"`
+	Success bool   `json:"success"`
+}
+
+var apiKeysMutex sync.Mutex
+var apiKeys = map[string]ApiKey{}
+
+func GetApiKeysFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().ApiKeysList, "api-keys.json")
+}
+
+func loadApiKeys() {
+	path := GetApiKeysFile()
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("[INFO] No API keys file found, it will be created ::> %s\n", path)
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read the API keys file ::> %s\n%s"+
+			"\nPlease insure that the file has the reading right", path, err)
+	}
+	var kc ApiKeysJsonConfig
+	err = json.Unmarshal(b, &kc)
+	if err != nil {
+		log.Fatalf("[ERROR] API keys file incorrect ::> %s\n%s", path, err)
+	}
+	apiKeysMutex.Lock()
+	for _, k := range kc.ApiKeys {
+		apiKeys[k.Id] = k
+	}
+	apiKeysMutex.Unlock()
+	log.Printf("[INFO] %d API keys loaded\n", len(kc.ApiKeys))
+}
+
+// saveApiKeys must be called with the API keys mutex locked, it forgets the expired keys.
+func saveApiKeys() error {
+	list := []ApiKey{}
+	for id, k := range apiKeys {
+		if isExpired(k) {
+			delete(apiKeys, id)
+			continue
+		}
+		list = append(list, k)
+	}
+	b, err := json.Marshal(ApiKeysJsonConfig{ApiKeys: list})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetApiKeysFile(), b, 0600)
+}
+
+func isExpired(k ApiKey) bool {
+	return !k.Expires.IsZero() && time.Now().After(k.Expires)
+}
+
+func isApiKey(t string) bool {
+	return strings.HasPrefix(t, apiKeyPrefix)
+}
+
+// getAccountToken returns the token of a request changing an account: its password, its sessions,
+// its two-factor authentication, its API keys or the other users. An API key cannot do that.
+func getAccountToken(r *http.Request) (string, error) {
+	t, err := GetToken(r)
+	if err != nil {
+		return "", err
+	}
+	if isApiKey(t) {
+		return "", errors.New("the accounts cannot be managed with an API key")
+	}
+	return t, nil
+}
+
+func getAccountUser(r *http.Request) (User, error) {
+	t, err := getAccountToken(r)
+	if err != nil {
+		return User{}, err
+	}
+	return GetLoggedUser(t)
+}
+
+func getApiKeyInfo(k ApiKey) ApiKeyInfo {
+	return ApiKeyInfo{
+		Id:       k.Id,
+		Username: k.Username,
+		Name:     k.Name,
+		Scopes:   k.Scopes,
+		Created:  k.Created,
+		Expires:  k.Expires,
+		LastUsed: k.LastUsed,
+	}
+}
+
+// CreateApiKey returns a new key of the user. The scopes must be permissions the user has,
+// and expiresInDays is 0 for a key which does not expire.
+func CreateApiKey(user User, name string, scopes []string, expiresInDays int) (CreatedApiKey, error) {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return CreatedApiKey{}, errors.New("API key name missing")
+	}
+	if expiresInDays < 0 {
+		return CreatedApiKey{}, errors.New("invalid expiration")
+	}
+	for _, s := range scopes {
+		if !HasPermission(user, s) {
+			return CreatedApiKey{}, errors.New("unknown scope or missing permission: " + s)
+		}
+	}
+	id, err := newSecret()
+	if err != nil {
+		return CreatedApiKey{}, err
+	}
+	secret, err := newSecret()
+	if err != nil {
+		return CreatedApiKey{}, err
+	}
+	key := apiKeyPrefix + id[:16] + "." + secret
+	now := time.Now()
+	k := ApiKey{
+		Id:       id[:16],
+		Username: user.Username,
+		Name:     name,
+		Hash:     hashToken(key),
+		Scopes:   scopes,
+		Created:  now,
+	}
+	if k.Scopes == nil {
+		k.Scopes = []string{}
+	}
+	if expiresInDays > 0 {
+		k.Expires = now.Add(time.Duration(expiresInDays) * 24 * time.Hour)
+	}
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	for _, other := range apiKeys {
+		if other.Username == user.Username && other.Name == name && !isExpired(other) {
+			return CreatedApiKey{}, errors.New("an API key with this name already exists")
+		}
+	}
+	apiKeys[k.Id] = k
+	if err := saveApiKeys(); err != nil {
+		return CreatedApiKey{}, err
+	}
+	return CreatedApiKey{ApiKeyInfo: getApiKeyInfo(k), Key: key, Success: true}, nil
+}
+
+// useApiKey returns the key while it is valid and remembers that it was used.
+func useApiKey(key string) (ApiKey, bool) {
+	id := strings.SplitN(strings.TrimPrefix(key, apiKeyPrefix), ".", 2)[0]
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	k, ok := apiKeys[id]
+	if !ok || k.Hash != hashToken(key) || isExpired(k) {
+		return ApiKey{}, false
+	}
+	if time.Since(k.LastUsed) > lastSeenDelay {
+		k.LastUsed = time.Now()
+		apiKeys[id] = k
+		if err := saveApiKeys(); err != nil {
+			log.Printf("[ERROR] %s\n", err)
+		}
+	}
+	return k, true
+}
+
+// parseApiKey returns the claims of a valid API key, as parseToken does for an access token.
+func parseApiKey(key string) (*Claims, error) {
+	k, ok := useApiKey(key)
+	if !ok {
+		return nil, errors.New("invalid API key")
+	}
+	return &Claims{Username: k.Username, ApiKeyId: k.Id, Scopes: k.Scopes}, nil
+}
+
+// GetApiKeyName returns the name and the user of the API key given as token, to tell the scripts apart in the logs.
+func GetApiKeyName(t string) (string, string, bool) {
+	if !isApiKey(t) {
+		return "", "", false
+	}
+	id := strings.SplitN(strings.TrimPrefix(t, apiKeyPrefix), ".", 2)[0]
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	k, ok := apiKeys[id]
+	return k.Name, k.Username, ok
+}
+
+func GetApiKeys(username string) []ApiKey {
+	apiKeysMutex.Lock()
+	result := []ApiKey{}
+	for _, k := range apiKeys {
+		if k.Username == username && !isExpired(k) {
+			result = append(result, k)
+		}
+	}
+	apiKeysMutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Created.After(result[j].Created) })
+	return result
+}
+
+func RevokeApiKey(username string, id string) error {
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	if k, ok := apiKeys[id]; !ok || k.Username != username {
+		return errors.New("API key not found")
+	}
+	delete(apiKeys, id)
+	return saveApiKeys()
+}
+
+func RevokeUserApiKeys(username string) error {
+	apiKeysMutex.Lock()
+	defer apiKeysMutex.Unlock()
+	for id, k := range apiKeys {
+		if k.Username == username {
+			delete(apiKeys, id)
+		}
+	}
+	return saveApiKeys()
+}
+
+// getApiKeysRequest returns the logged user and the user whose keys are managed: the u parameter
+// is allowed for the users managers only. The keys cannot be managed with an API key.
+func getApiKeysRequest(r *http.Request) (User, string, error) {
+	user, err := getAccountUser(r)
+	if err != nil {
+		return User{}, "", err
+	}
+	username := r.URL.Query().Get("u")
+	if username == "" || username == user.Username {
+		return user, user.Username, nil
+	}
+	if !HasPermission(user, PermManageUsers) {
+		return user, "", errors.New("You are not allowed to do that")
+	}
+	return user, username, nil
+}
+
+func CreateApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user, _, err := getApiKeysRequest(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	var nk NewApiKey
+	err = json.NewDecoder(r.Body).Decode(&nk)
+	if err != nil {
+		SendError(w, r, "API key information missing (name)")
+		return
+	}
+	k, err := CreateApiKey(user, nk.Name, nk.Scopes, nk.ExpiresInDays)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	b, err := json.Marshal(k)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] API key %s created by %s\n", k.Name, user.Username)
+	Response.SendJson(w, r, b)
+}
+
+func GetApiKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user, username, err := getApiKeysRequest(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	list := ApiKeysList{
+		ApiKeys: []ApiKeyInfo{},
+		Success: true,
+	}
+	for _, k := range GetApiKeys(username) {
+		list.ApiKeys = append(list.ApiKeys, getApiKeyInfo(k))
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  API keys of %s for %s\n", r.RemoteAddr, username, user.Username)
+	Response.SendJson(w, r, b)
+}
+
+func RevokeApiKeyHandler(w http.ResponseWriter, r *http.Request) {
+	user, username, err := getApiKeysRequest(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if id == "" {
+		SendError(w, r, "API key ID missing")
+		return
+	}
+	if err := RevokeApiKey(username, id); err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] API key %s of %s revoked by %s\n", id, username, user.Username)
+	SendSuccess(w, r, "API key revoked!")
+}
@@ -1,6 +1,9 @@
 package authentication
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -8,15 +11,17 @@ import (
 	"golang.org/x/crypto/bcrypt"
 	"io/ioutil"
 	"log"
+	"math"
 	"net/http"
 	"openify/ConfigurationManager"
 	"openify/Response"
 	"os"
-	"time"
+	"strconv"
+	"sync"
 )
 
-var jwtKey = []byte("")
 var cost = 12
+var usersMutex sync.Mutex
 var users []User
 
 type UsersJsonConfig struct {
@@ -31,27 +36,53 @@ type UsersList struct {
 type Credentials struct {
 	Password string `json:"password"`
 	Username string `json:"username"`
+	Device string `json:"device"`
 }
 
 type User struct {
 	Password string `json:"password"`
 	Username string `json:"username"`
 	Administrator bool `json:"administrator"`
+	Share bool `json:"share"`
+	Role string `json:"role"`
+	AllowedFolders []string `json:"allowed-folders,omitempty"`
+	DeniedFolders []string `json:"denied-folders,omitempty"`
+	Provider string `json:"provider,omitempty"`
+	// The issuer and the subject of the OpenID account the user is bound to
+	Issuer string `json:"issuer,omitempty"`
+	Subject string `json:"subject,omitempty"`
+	// Part of the signature of the links of the user, a new one revokes them
+	LinkNonce string `json:"link-nonce,omitempty"`
+	// The scopes of the API key the user is logged with, which restrict its permissions
+	scopes []string
 }
 
 type UserInfo struct {
 	Username string `json:"username"`
 	Administrator bool `json:"administrator"`
+	Share bool `json:"share"`
+	Role string `json:"role"`
+	Permissions []string `json:"permissions"`
+	AllowedFolders []string `json:"allowed-folders"`
+	DeniedFolders []string `json:"denied-folders"`
+	TwoFactor bool `json:"two-factor"`
+	Provider string `json:"provider"`
 	Success bool `json:"success"`
 }
 
 type Claims struct {
 	Username string `json:"username"`
+	SessionId string `json:"sid"`
+	ApiKeyId string `json:"-"`
+	Scopes []string `json:"-"`
 	jwt.StandardClaims
 }
 
 type Token struct {
 	Token string `json:"token"`
+	RefreshToken string `json:"refresh-token"`
+	ExpiresIn int `json:"expires-in"`
+	RecoveryCodes []string `json:"recovery-codes,omitempty"`
 	Success bool `json:"success"`
 }
 
@@ -64,8 +95,15 @@ type EditedUser struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Administrator bool `json:"administrator"`
+	Share bool `json:"share"`
+	Role string `json:"role"`
+	AllowedFolders []string `json:"allowed-folders"`
+	DeniedFolders []string `json:"denied-folders"`
 	PasswordEdited bool `json:"password-edited"`
 	AdministratorEdited bool `json:"administrator-edited"`
+	ShareEdited bool `json:"share-edited"`
+	RoleEdited bool `json:"role-edited"`
+	AccessEdited bool `json:"access-edited"`
 }
 
 func LoadUsers() {
@@ -84,8 +122,15 @@ func LoadUsers() {
 		log.Fatalf("[ERROR] Users file incorrect ::> users.json\n%s", err)
 	}
 	users = uc.Users
+	for i := range users {
+		normalizeRole(&users[i])
+	}
 	log.Printf("[INFO] %d users loaded\n", len(users))
-	jwtKey = []byte(ConfigurationManager.LoadJWTKey().Key)
+	loadProviders()
+	loadKeys()
+	loadSessions()
+	loadTwoFactors()
+	loadApiKeys()
 }
 
 func Login(w http.ResponseWriter, r *http.Request) {
@@ -95,39 +140,41 @@ func Login(w http.ResponseWriter, r *http.Request) {
 		SendError(w, r, "User information missing (username and/or password)")
 		return
 	}
-	user, err:= GetUserInfo(credential.Username)
-	if err != nil {
-		log.Printf("[INFO][%s] Login failed for user %s\n", r.RemoteAddr, credential.Username)
+	// The failed logins are logged as "[WARN][AUTH] Login failed for user \"<username>\" from <ip>"
+	// and the refused ones as "[WARN][AUTH] Login blocked ...", for fail2ban with the filter
+	// failregex = \[WARN\]\[AUTH\] Login (failed|blocked) for user ".*" from <HOST>$
+	ip := GetClientIp(r)
+	if wait := beginLogin(ip, credential.Username); wait > 0 {
+		retryAfter := int(math.Ceil(wait.Seconds()))
+		log.Printf("[WARN][AUTH] Login blocked for user %q from %s\n", credential.Username, ip)
+		SendTooManyRequests(w, r, "Too many failed logins, try again later", retryAfter)
+		return
+	}
+	user, err:= authenticate(credential.Username, credential.Password)
+	if err == ErrUnknownUser || err == ErrInvalidPassword || err == ErrNotAllowed {
+		loginFailed(ip, credential.Username)
+		log.Printf("[WARN][AUTH] Login failed for user %q from %s\n", credential.Username, ip)
 		SendUnauthorized(w, r)
 		return
 	}
-
-	err = bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(credential.Password))
 	if err != nil {
-		log.Printf("[INFO][%s] Login failed for user %s\n", r.RemoteAddr, credential.Username)
-		SendUnauthorized(w, r)
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, "Authentication provider unavailable")
 		return
 	}
-
-	expirationTime := time.Now().Add(24 * time.Hour)
-	claims := &Claims{
-		Username: credential.Username,
-		StandardClaims: jwt.StandardClaims{
-			ExpiresAt: expirationTime.Unix(),
-		},
+	// The token is given by LoginTwoFactor once the code is checked
+	if IsTwoFactorEnabled(user.Username) || IsTwoFactorRequired(user) {
+		sendChallenge(w, r, user, credential.Device)
+		return
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	tokenString, err := token.SignedString(jwtKey)
+	loginSucceeded(ip, credential.Username)
+
+	res, err := OpenSession(user.Username, credential.Device, r)
 	if err != nil {
 		log.Printf("[INFO][%s] %s\n", r.RemoteAddr, err)
 		SendError(w, r, err.Error())
 		return
 	}
-
-	res:= Token{
-		Token: tokenString,
-		Success: true,
-	}
 	b, err := json.Marshal(res)
 	if err != nil {
 		log.Printf("[ERROR] %s\n", err)
@@ -144,7 +191,7 @@ func Login(w http.ResponseWriter, r *http.Request) {
 }
 
 func Register(w http.ResponseWriter, r *http.Request) {
-	t, err := GetToken(r)
+	t, err := getAccountToken(r)
 	if err != nil {
 		log.Printf("[ERROR] %s\n", err)
 		SendError(w, r, err.Error())
@@ -156,7 +203,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 		SendError(w, r, err.Error())
 		return
 	}
-	if loggedUser.Administrator {
+	if HasPermission(loggedUser, PermManageUsers) {
 		var credential User
 		err = json.NewDecoder(r.Body).Decode(&credential)
 		if err != nil {
@@ -177,9 +224,30 @@ func Register(w http.ResponseWriter, r *http.Request) {
 			Username: credential.Username,
 			Password: string(pass),
 			Administrator: credential.Administrator,
+			Share: credential.Share,
+			Role: credential.Role,
+			AllowedFolders: normalizeFolders(credential.AllowedFolders),
+			DeniedFolders: normalizeFolders(credential.DeniedFolders),
+		}
+		normalizeRole(&user)
+		if !IsRole(user.Role) {
+			SendError(w, r, "Unknown role")
+			return
+		}
+		if !canGrant(loggedUser, user) {
+			log.Printf("[ERROR] Missing right for %s to grant the role %s\n", loggedUser.Username, user.Role)
+			SendError(w, r, "You are not allowed to do that")
+			return
+		}
+		usersMutex.Lock()
+		if SliceIndex(len(users), func(i int) bool { return users[i].Username == user.Username }) != -1 {
+			usersMutex.Unlock()
+			SendError(w, r, "User already exist")
+			return
 		}
 		users = append(users, user)
 		err = SaveUsersJsonFile()
+		usersMutex.Unlock()
 		if err != nil {
 			log.Printf("[ERROR] %s\n", err)
 			SendError(w, r, err.Error())
@@ -194,7 +262,7 @@ func Register(w http.ResponseWriter, r *http.Request) {
 }
 
 func UpdateUser(w http.ResponseWriter, r *http.Request) {
-	t, err := GetToken(r)
+	t, err := getAccountToken(r)
 	if err != nil {
 		log.Printf("[ERROR] %s\n", err)
 		SendError(w, r, err.Error())
@@ -212,25 +280,103 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 		SendError(w, r, "User information missing (username and/or password)")
 		return
 	}
-	if editedUser.Username == loggedUser.Username || loggedUser.Administrator {
-		index:= SliceIndex(len(users), func(i int) bool { return users[i].Username == editedUser.Username })
+	manager := HasPermission(loggedUser, PermManageUsers)
+	if editedUser.Username == loggedUser.Username || manager {
+		if (editedUser.ShareEdited || editedUser.AdministratorEdited || editedUser.RoleEdited || editedUser.AccessEdited) && !manager {
+			log.Printf("[ERROR] Missing right for %s to change the permissions\n", loggedUser.Username)
+			SendError(w, r, "You are not allowed to do that")
+			return
+		}
+		if editedUser.RoleEdited && !IsRole(editedUser.Role) {
+			SendError(w, r, "Unknown role")
+			return
+		}
+		// The sessions and the links made with the old password or with permissions the user lost are closed
+		revoke, except := editedUser.PasswordEdited, ""
+		var pass []byte
+		var nonce string
 		if editedUser.PasswordEdited {
-			pass, err:= bcrypt.GenerateFromPassword([]byte(editedUser.Password), cost)
+			pass, err = bcrypt.GenerateFromPassword([]byte(editedUser.Password), cost)
+			if err != nil {
+				SendError(w, r, err.Error())
+				return
+			}
+			nonce, err = newSecret()
 			if err != nil {
 				SendError(w, r, err.Error())
 				return
 			}
+			if c, err := parseToken(t); err == nil && c.Username == editedUser.Username {
+				except = c.SessionId
+			}
+		}
+		usersMutex.Lock()
+		index:= SliceIndex(len(users), func(i int) bool { return users[i].Username == editedUser.Username })
+		if index == -1 {
+			usersMutex.Unlock()
+			SendError(w, r, "User does not exist")
+			return
+		}
+		// The directory gives the password and the role of its users
+		directory := GetUserProvider(users[index]) != LocalProvider
+		if directory && (editedUser.PasswordEdited || editedUser.AdministratorEdited || editedUser.RoleEdited) {
+			provider := users[index].Provider
+			usersMutex.Unlock()
+			SendError(w, r, "The password and the role of this user are managed by " + provider)
+			return
+		}
+		previous := users[index]
+		if editedUser.PasswordEdited {
 			users[index].Password = string(pass)
+			users[index].LinkNonce = nonce
 		}
 		if editedUser.AdministratorEdited {
 			users[index].Administrator = editedUser.Administrator
+			if !editedUser.Administrator && previous.Administrator {
+				users[index].Role = UserRole
+			}
+		}
+		if editedUser.RoleEdited {
+			users[index].Role = editedUser.Role
+			users[index].Administrator = editedUser.Role == AdminRole
+		}
+		if editedUser.ShareEdited {
+			users[index].Share = editedUser.Share
+		}
+		if editedUser.AccessEdited {
+			users[index].AllowedFolders = normalizeFolders(editedUser.AllowedFolders)
+			users[index].DeniedFolders = normalizeFolders(editedUser.DeniedFolders)
+		}
+		normalizeRole(&users[index])
+		// A manager cannot raise a user, nor take over one with more permissions, above its own
+		if !canGrant(loggedUser, previous) || !canGrant(loggedUser, users[index]) {
+			users[index] = previous
+			usersMutex.Unlock()
+			log.Printf("[ERROR] Missing right for %s to change the permissions of %s\n", loggedUser.Username, editedUser.Username)
+			SendError(w, r, "You are not allowed to do that")
+			return
+		}
+		if losesPermissions(previous, users[index]) {
+			revoke, except = true, ""
 		}
 		err = SaveUsersJsonFile()
+		usersMutex.Unlock()
 		if err != nil {
 			log.Printf("[ERROR] %s\n", err)
 			SendError(w, r, err.Error())
 			return
 		}
+		if revoke {
+			if err := RevokeUserSessions(editedUser.Username, except); err != nil {
+				log.Printf("[ERROR] %s\n", err)
+			}
+		}
+		// A key leaked with the old password must not outlive it
+		if editedUser.PasswordEdited {
+			if err := RevokeUserApiKeys(editedUser.Username); err != nil {
+				log.Printf("[ERROR] %s\n", err)
+			}
+		}
 		log.Printf("[INFO] User %s updated\n", editedUser.Username)
 		SendSuccess(w, r, "User updated!")
 	} else {
@@ -241,9 +387,11 @@ func UpdateUser(w http.ResponseWriter, r *http.Request) {
 
 func GetListUsers(w http.ResponseWriter, r *http.Request) {
 	var result []string
+	usersMutex.Lock()
 	for _, user := range users {
 		result = append(result, user.Username)
 	}
+	usersMutex.Unlock()
 	ul:= UsersList{
 		Users: result,
 		Success: true,
@@ -257,69 +405,127 @@ func GetListUsers(w http.ResponseWriter, r *http.Request) {
 	Response.SendJson(w, r, b)
 }
 
+func GetUsernames() []string {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+	result := []string{}
+	for _, user := range users {
+		result = append(result, user.Username)
+	}
+	return result
+}
+
 func IsLogged(token string) bool {
-	t, err := jwt.Parse(token, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	_, err := parseToken(token)
+	return err == nil
+}
+
+// SignValue returns a signature of the value made with the link key of jwt.json. It is used
+// for the links which have to work without a token, like the podcast feeds.
+func SignValue(value string) string {
+	mac := hmac.New(sha256.New, linkKey)
+	mac.Write([]byte(value))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func IsValidSignature(value string, signature string) bool {
+	return hmac.Equal([]byte(SignValue(value)), []byte(signature))
+}
+
+// SignUserValue signs a value of a link made for the user, the link stops working when
+// its password changes or when RotateLinkNonce is called.
+func SignUserValue(user User, value string) string {
+	if user.LinkNonce != "" {
+		value = user.LinkNonce + ":" + value
+	}
+	return SignValue(value)
+}
+
+func IsValidUserSignature(user User, value string, signature string) bool {
+	return hmac.Equal([]byte(SignUserValue(user, value)), []byte(signature))
+}
+
+// RotateLinkNonce revokes the signed links of the user.
+func RotateLinkNonce(username string) error {
+	nonce, err := newSecret()
 	if err != nil {
-		return false
+		return err
 	}
-	return t.Valid
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+	index := SliceIndex(len(users), func(i int) bool { return users[i].Username == username })
+	if index == -1 {
+		return errors.New("User does not exist")
+	}
+	users[index].LinkNonce = nonce
+	return SaveUsersJsonFile()
 }
 
 func GetLoggedUser(t string) (User, error) {
-	var c Claims
-	token, err := jwt.ParseWithClaims(t, &c, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
+	claims, err := parseToken(t)
 	if err != nil {
 		return User{}, err
 	}
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
-		u, err := GetUserInfo(claims.Username)
-		if err != nil {
-			return User{}, err
-		}
-		return u, nil
+	user, err := GetUserInfo(claims.Username)
+	if err != nil {
+		return User{}, err
+	}
+	user.scopes = claims.Scopes
+	return user, nil
+}
+
+// CanShare tells if a user is allowed to create share links.
+func CanShare(user User) bool {
+	return HasPermission(user, PermShare)
+}
+
+// GetRequestUser returns the user logged with the token of the authorization header.
+func GetRequestUser(r *http.Request) (User, error) {
+	t, err := GetToken(r)
+	if err != nil {
+		return User{}, err
 	}
-	return User{}, errors.New("failed to get logged user")
+	return GetLoggedUser(t)
 }
 
+// GetToken returns the token of the authorization header, or the API key of the X-API-Key header.
 func GetToken(r *http.Request) (string, error) {
 	header:= r.Header.Get("authorization")
 	if len(header) > 7 {
 		t:= header[7:]
 		return t, nil
 	}
+	if key := r.Header.Get("X-API-Key"); key != "" {
+		return key, nil
+	}
 	return "", errors.New("no token found")
 }
 
 func GetLoggedUserHandler(w http.ResponseWriter, r *http.Request) {
-	var c Claims
 	t, err := GetToken(r)
 	if err != nil {
 		log.Printf("[ERROR] %s\n", err)
 		SendError(w, r, err.Error())
 		return
 	}
-	token, err := jwt.ParseWithClaims(t, &c, func(token *jwt.Token) (interface{}, error) {
-		return jwtKey, nil
-	})
-	if err != nil {
-		log.Printf("[ERROR] %s\n", err)
-		SendError(w, r, err.Error())
-		return
-	}
-	if claims, ok := token.Claims.(*Claims); ok && token.Valid {
+	if claims, err := parseToken(t); err == nil {
 		u, err := GetUserInfo(claims.Username)
 		if err != nil {
 			log.Printf("[ERROR] %s\n", err)
 			SendError(w, r, err.Error())
 			return
 		}
+		u.scopes = claims.Scopes
 		userInfo:= UserInfo{
 			Username: u.Username,
 			Administrator: u.Administrator,
+			Share: u.Share,
+			Role: u.Role,
+			Permissions: GetPermissions(u),
+			AllowedFolders: GetAllowedFolders(u),
+			DeniedFolders: GetDeniedFolders(u),
+			TwoFactor: IsTwoFactorEnabled(u.Username),
+			Provider: GetUserProvider(u),
 			Success: true,
 		}
 		b, err := json.Marshal(userInfo)
@@ -337,17 +543,14 @@ func GetLoggedUserHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func GetUserInfo(username string) (User, error) {
-	var result User
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
 	for _, user := range users {
 		if user.Username == username {
-			result = user
+			return user, nil
 		}
 	}
-	if result == (User{}) {
-		return User{}, errors.New("user not found")
-	}
-
-	return result, nil
+	return User{}, errors.New("user not found")
 }
 
 func GetUserInfoHandler(w http.ResponseWriter, r *http.Request) {
@@ -364,6 +567,13 @@ func GetUserInfoHandler(w http.ResponseWriter, r *http.Request) {
 	userInfo:= UserInfo{
 		Username: user.Username,
 		Administrator: user.Administrator,
+		Share: user.Share,
+		Role: user.Role,
+		Permissions: GetPermissions(user),
+		AllowedFolders: GetAllowedFolders(user),
+		DeniedFolders: GetDeniedFolders(user),
+		TwoFactor: IsTwoFactorEnabled(user.Username),
+		Provider: GetUserProvider(user),
 		Success: true,
 	}
 	b, err := json.Marshal(userInfo)
@@ -376,7 +586,7 @@ func GetUserInfoHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func RemoveUser(w http.ResponseWriter, r *http.Request) {
-	t, err := GetToken(r)
+	t, err := getAccountToken(r)
 	if err != nil {
 		log.Printf("[ERROR] %s\n", err)
 		SendError(w, r, err.Error())
@@ -388,24 +598,36 @@ func RemoveUser(w http.ResponseWriter, r *http.Request) {
 		SendError(w, r, err.Error())
 		return
 	}
-	if loggedUser.Administrator {
+	if HasPermission(loggedUser, PermManageUsers) {
 		us, ok := r.URL.Query()["u"]
 		if !ok || len(us[0]) < 1 {
 			SendError(w, r, "Username missing")
 			return
 		}
+		usersMutex.Lock()
 		index:= SliceIndex(len(users), func(i int) bool { return users[i].Username == us[0] })
 		if index == -1 {
+			usersMutex.Unlock()
 			SendError(w, r, "User does not exist")
 			return
 		}
 		users = RemoveIndex(users, index)
 		err := SaveUsersJsonFile()
+		usersMutex.Unlock()
 		if err != nil {
 			log.Printf("[ERROR] %s\n", err)
 			SendError(w, r, err.Error())
 			return
 		}
+		if err := RevokeUserSessions(us[0], ""); err != nil {
+			log.Printf("[ERROR] %s\n", err)
+		}
+		if err := DisableTwoFactor(us[0]); err != nil {
+			log.Printf("[ERROR] %s\n", err)
+		}
+		if err := RevokeUserApiKeys(us[0]); err != nil {
+			log.Printf("[ERROR] %s\n", err)
+		}
 		log.Printf("[INFO] User %s removed\n", us[0])
 		SendSuccess(w, r, "User removed!")
 	} else {
@@ -480,6 +702,26 @@ func SendUnauthorized(w http.ResponseWriter, r *http.Request) {
 	}
 }
 
+func SendTooManyRequests(w http.ResponseWriter, r *http.Request, msg string, retryAfter int) {
+	res:= LoginFailed{
+		Message: msg,
+		Success: false,
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		return
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	w.WriteHeader(http.StatusTooManyRequests)
+	_, err = fmt.Fprintf(w, string(b))
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+	}
+}
+
+// SaveUsersJsonFile must be called with the users mutex locked.
 func SaveUsersJsonFile() error {
 	usersDb:= UsersJsonConfig{
 		Users: users,
@@ -0,0 +1,356 @@
+package authentication
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"log"
+	"math/big"
+	"net/http"
+	"openify/ConfigurationManager"
+	"openify/Response"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// The key of the files written before the keysets. The tokens without key ID were signed with it.
+const LegacyKeyId = "legacy"
+
+const defaultSigningAlgorithm = "ES256"
+const defaultKeyGraceHours = 24
+const rsaKeyBits = 2048
+
+var signingMethods = map[string]jwt.SigningMethod{
+	"HS256": jwt.SigningMethodHS256,
+	"RS256": jwt.SigningMethodRS256,
+	"PS256": jwt.SigningMethodPS256,
+	"ES256": jwt.SigningMethodES256,
+}
+
+type signingKey struct {
+	config  ConfigurationManager.JWTKey
+	method  jwt.SigningMethod
+	private interface{}
+	public  interface{}
+}
+
+type JsonWebKeySet struct {
+	Keys []JsonWebKey `json:"keys"`
+}
+
+type JsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+	Y   string `json:"y,omitempty"`
+}
+
+var keysMutex sync.Mutex
+
+// The oldest key first, the last one signs the new tokens.
+var signingKeys []signingKey
+var linkKey []byte
+
+func getSigningAlgorithm() string {
+	if a := ConfigurationManager.GetConfiguration().Tokens.Algorithm; a != "" {
+		return a
+	}
+	return defaultSigningAlgorithm
+}
+
+// getKeyGracePeriod returns how long a retired key verifies, at least the lifetime of an access token.
+func getKeyGracePeriod() time.Duration {
+	grace := defaultKeyGraceHours * time.Hour
+	if h := ConfigurationManager.GetConfiguration().Tokens.KeyGraceHours; h > 0 {
+		grace = time.Duration(h) * time.Hour
+	}
+	if lifetime := getAccessTokenLifetime(); grace < lifetime {
+		return lifetime
+	}
+	return grace
+}
+
+// loadKeys reads jwt.json, or creates it with a new key. The secret of a file written before the
+// keysets becomes the legacy key, retired at once so that its tokens only verify during the grace
+// period. It never signs the links, which get a new random key.
+func loadKeys() {
+	kc, found := ConfigurationManager.LoadJWTKey()
+	changed := !found
+	if kc.Key != "" {
+		now := time.Now()
+		kc.Keys = append([]ConfigurationManager.JWTKey{{
+			Kid:       LegacyKeyId,
+			Algorithm: "HS256",
+			Secret:    base64.StdEncoding.EncodeToString([]byte(kc.Key)),
+			Created:   now,
+			Retired:   &now,
+		}}, kc.Keys...)
+		kc.Key = ""
+		changed = true
+	}
+	if kc.LinkKey == "" {
+		secret, err := newSecret()
+		if err != nil {
+			log.Fatalf("[ERROR] Unable to generate the link key\n%s", err)
+		}
+		kc.LinkKey = secret
+	}
+	if _, ok := signingMethods[getSigningAlgorithm()]; !ok {
+		log.Fatalf("[ERROR] Unsupported token signing algorithm ::> %s\n", getSigningAlgorithm())
+	}
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	linkKey = []byte(kc.LinkKey)
+	signingKeys = nil
+	for _, c := range kc.Keys {
+		k, err := parseSigningKey(c)
+		if err != nil {
+			log.Fatalf("[ERROR] JWT Key file incorrect ::> jwt.json\nkey %s: %s", c.Kid, err)
+		}
+		signingKeys = append(signingKeys, k)
+	}
+	if len(signingKeys) == 0 || getActiveKey().config.Retired != nil ||
+		getActiveKey().config.Algorithm != getSigningAlgorithm() {
+		if err := rotateKeys(); err != nil {
+			log.Fatalf("[ERROR] Unable to create the JWT Key file ::> jwt.json\n%s", err)
+		}
+		changed = false
+	}
+	if changed {
+		if err := saveKeys(); err != nil {
+			log.Fatalf("[ERROR] Unable to write the JWT Key file ::> jwt.json\n%s", err)
+		}
+	}
+	log.Printf("[INFO] %d token signing keys loaded, %s signs\n", len(signingKeys), getActiveKey().config.Kid)
+}
+
+// saveKeys must be called with the keys mutex locked, it forgets the keys out of their grace period.
+func saveKeys() error {
+	kc := ConfigurationManager.JWTConfig{LinkKey: string(linkKey)}
+	var kept []signingKey
+	for _, k := range signingKeys {
+		if isUsableKey(k, time.Now()) {
+			kept = append(kept, k)
+			kc.Keys = append(kc.Keys, k.config)
+		}
+	}
+	signingKeys = kept
+	return ConfigurationManager.SaveJWTKey(kc)
+}
+
+func parseSigningKey(c ConfigurationManager.JWTKey) (signingKey, error) {
+	method, ok := signingMethods[c.Algorithm]
+	if !ok {
+		return signingKey{}, errors.New("unsupported algorithm " + c.Algorithm)
+	}
+	k := signingKey{config: c, method: method}
+	if c.Algorithm == "HS256" {
+		secret, err := base64.StdEncoding.DecodeString(c.Secret)
+		if err != nil || len(secret) == 0 {
+			return signingKey{}, errors.New("invalid secret")
+		}
+		k.private, k.public = secret, secret
+		return k, nil
+	}
+	block, _ := pem.Decode([]byte(c.PrivateKey))
+	if block == nil {
+		return signingKey{}, errors.New("invalid private key")
+	}
+	private, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return signingKey{}, err
+	}
+	switch key := private.(type) {
+	case *rsa.PrivateKey:
+		if c.Algorithm != "RS256" && c.Algorithm != "PS256" {
+			return signingKey{}, errors.New("RSA key for " + c.Algorithm)
+		}
+		k.private, k.public = key, &key.PublicKey
+	case *ecdsa.PrivateKey:
+		if c.Algorithm != "ES256" || key.Curve != elliptic.P256() {
+			return signingKey{}, errors.New("EC key for " + c.Algorithm)
+		}
+		k.private, k.public = key, &key.PublicKey
+	default:
+		return signingKey{}, errors.New("unsupported private key")
+	}
+	return k, nil
+}
+
+func generateKey(algorithm string) (signingKey, error) {
+	id := make([]byte, 8)
+	if _, err := rand.Read(id); err != nil {
+		return signingKey{}, err
+	}
+	c := ConfigurationManager.JWTKey{
+		Kid:       hex.EncodeToString(id),
+		Algorithm: algorithm,
+		Created:   time.Now(),
+	}
+	var private interface{}
+	var err error
+	switch algorithm {
+	case "HS256":
+		secret := make([]byte, 64)
+		if _, err := rand.Read(secret); err != nil {
+			return signingKey{}, err
+		}
+		c.Secret = base64.StdEncoding.EncodeToString(secret)
+		return parseSigningKey(c)
+	case "RS256", "PS256":
+		private, err = rsa.GenerateKey(rand.Reader, rsaKeyBits)
+	case "ES256":
+		private, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	default:
+		return signingKey{}, errors.New("unsupported algorithm " + algorithm)
+	}
+	if err != nil {
+		return signingKey{}, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return signingKey{}, err
+	}
+	c.PrivateKey = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	return parseSigningKey(c)
+}
+
+// getActiveKey must be called with the keys mutex locked.
+func getActiveKey() signingKey {
+	return signingKeys[len(signingKeys)-1]
+}
+
+func isUsableKey(k signingKey, now time.Time) bool {
+	return k.config.Retired == nil || now.Before(k.config.Retired.Add(getKeyGracePeriod()))
+}
+
+// rotateKeys must be called with the keys mutex locked. It makes a new key with the configured
+// algorithm, which signs from now on, while the previous one verifies until its grace period ends.
+func rotateKeys() error {
+	k, err := generateKey(getSigningAlgorithm())
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for i := range signingKeys {
+		if signingKeys[i].config.Retired == nil {
+			signingKeys[i].config.Retired = &now
+		}
+	}
+	signingKeys = append(signingKeys, k)
+	log.Printf("[INFO] New token signing key %s (%s)\n", k.config.Kid, k.config.Algorithm)
+	return saveKeys()
+}
+
+// RotateKeys makes a new signing key, the tokens signed with the previous one stay valid.
+func RotateKeys() error {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	return rotateKeys()
+}
+
+// signToken signs the claims with the active key, which is first rotated when it is too old.
+func signToken(claims jwt.Claims) (string, error) {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	if days := ConfigurationManager.GetConfiguration().Tokens.KeyRotationDays; days > 0 &&
+		time.Since(getActiveKey().config.Created) > time.Duration(days)*24*time.Hour {
+		if err := rotateKeys(); err != nil {
+			log.Printf("[ERROR] %s\n", err)
+		}
+	}
+	k := getActiveKey()
+	token := jwt.NewWithClaims(k.method, claims)
+	token.Header["kid"] = k.config.Kid
+	return token.SignedString(k.private)
+}
+
+// getVerificationKey returns the key of the ID of the token while it is in use, when the token
+// is signed with the algorithm of the key.
+func getVerificationKey(token *jwt.Token) (interface{}, error) {
+	kid, _ := token.Header["kid"].(string)
+	if kid == "" {
+		kid = LegacyKeyId
+	}
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	for _, k := range signingKeys {
+		if k.config.Kid != kid || !isUsableKey(k, time.Now()) {
+			continue
+		}
+		if token.Method.Alg() != k.method.Alg() {
+			return nil, errors.New("unexpected signing algorithm " + token.Method.Alg())
+		}
+		return k.public, nil
+	}
+	return nil, errors.New("unknown signing key " + kid)
+}
+
+// GetJsonWebKeys returns the public keys verifying the tokens, the HMAC keys are not published.
+func GetJsonWebKeys() JsonWebKeySet {
+	keysMutex.Lock()
+	defer keysMutex.Unlock()
+	set := JsonWebKeySet{Keys: []JsonWebKey{}}
+	encode := func(b []byte) string { return base64.RawURLEncoding.EncodeToString(b) }
+	for _, k := range signingKeys {
+		if !isUsableKey(k, time.Now()) {
+			continue
+		}
+		jwk := JsonWebKey{Kid: k.config.Kid, Use: "sig", Alg: k.config.Algorithm}
+		switch key := k.public.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = encode(key.N.Bytes())
+			jwk.E = encode(big.NewInt(int64(key.E)).Bytes())
+		case *ecdsa.PublicKey:
+			size := (key.Curve.Params().BitSize + 7) / 8
+			jwk.Kty, jwk.Crv = "EC", key.Curve.Params().Name
+			jwk.X = encode(append(make([]byte, size-len(key.X.Bytes())), key.X.Bytes()...))
+			jwk.Y = encode(append(make([]byte, size-len(key.Y.Bytes())), key.Y.Bytes()...))
+		default:
+			continue
+		}
+		set.Keys = append(set.Keys, jwk)
+	}
+	return set
+}
+
+func GetJwksHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(GetJsonWebKeys())
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
+
+func RotateKeysHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	if err := RotateKeys(); err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Signing key rotated by %s\n", user.Username)
+	SendSuccess(w, r, "Signing key rotated!")
+}
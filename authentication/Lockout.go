@@ -0,0 +1,254 @@
+package authentication
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"openify/ConfigurationManager"
+	"openify/Response"
+	"sort"
+	"sync"
+	"time"
+)
+
+const defaultMaxFailures = 5
+const defaultLockoutMinutes = 15
+const defaultBackoffSeconds = 1
+
+const (
+	IpLockout    = "ip"
+	UserLockout  = "user"
+	ShareLockout = "share"
+)
+
+// The failed logins are counted by client address and by username, the wrong passwords of the
+// shares by client address and by share. After n failures the next
+// attempt waits the backoff doubled n-1 times, and MaxFailures locks the login for the lockout
+// duration. The failures are forgotten once the lockout duration passed without a new one.
+type Lockout struct {
+	Type     string    `json:"type"`
+	Value    string    `json:"value"`
+	Failures int       `json:"failures"`
+	Last     time.Time `json:"last"`
+	Until    time.Time `json:"until"`
+	Locked   bool      `json:"locked"`
+}
+
+type LockoutsList struct {
+	Lockouts []Lockout `json:"lockouts"`
+	Success  bool      `json:"success"`
+}
+
+var lockoutsMutex sync.Mutex
+var lockouts = map[string]*Lockout{}
+
+func getLoginProtection() (int, time.Duration, time.Duration) {
+	c := ConfigurationManager.GetConfiguration().LoginProtection
+	maxFailures, lockout, backoff := defaultMaxFailures, defaultLockoutMinutes*time.Minute, defaultBackoffSeconds*time.Second
+	if c.MaxFailures > 0 {
+		maxFailures = c.MaxFailures
+	}
+	if c.LockoutMinutes > 0 {
+		lockout = time.Duration(c.LockoutMinutes) * time.Minute
+	}
+	if c.BackoffSeconds > 0 {
+		backoff = time.Duration(c.BackoffSeconds) * time.Second
+	}
+	return maxFailures, lockout, backoff
+}
+
+// getBackoff returns the delay before the attempt following the nth failure.
+func getBackoff(failures int) time.Duration {
+	maxFailures, lockout, backoff := getLoginProtection()
+	if failures >= maxFailures {
+		return lockout
+	}
+	for i := 1; i < failures && backoff < lockout; i++ {
+		backoff *= 2
+	}
+	if backoff > lockout {
+		return lockout
+	}
+	return backoff
+}
+
+// getLockout must be called with the lockouts mutex locked.
+func getLockout(kind string, value string, now time.Time) *Lockout {
+	_, duration, _ := getLoginProtection()
+	l, ok := lockouts[kind+":"+value]
+	if !ok || now.Sub(l.Last) > duration && now.After(l.Until) {
+		l = &Lockout{Type: kind, Value: value}
+		lockouts[kind+":"+value] = l
+	}
+	return l
+}
+
+// beginLogin returns how long the client has to wait before trying to log in. When it can try
+// now, the backoff of a failure is reserved so the parallel attempts are refused too.
+func beginLogin(ip string, username string) time.Duration {
+	return beginAttempt(ip, UserLockout, username)
+}
+
+func beginAttempt(ip string, kind string, value string) time.Duration {
+	now := time.Now()
+	lockoutsMutex.Lock()
+	defer lockoutsMutex.Unlock()
+	pruneLockouts(now)
+	byIp, byValue := getLockout(IpLockout, ip, now), getLockout(kind, value, now)
+	wait := byIp.Until.Sub(now)
+	if w := byValue.Until.Sub(now); w > wait {
+		wait = w
+	}
+	if wait > 0 {
+		return wait
+	}
+	for _, l := range []*Lockout{byIp, byValue} {
+		if l.Failures > 0 {
+			l.Until = now.Add(getBackoff(l.Failures + 1))
+		}
+	}
+	return 0
+}
+
+func loginFailed(ip string, username string) {
+	attemptFailed(ip, UserLockout, username)
+}
+
+func attemptFailed(ip string, kind string, value string) {
+	now := time.Now()
+	maxFailures, _, _ := getLoginProtection()
+	lockoutsMutex.Lock()
+	defer lockoutsMutex.Unlock()
+	for _, l := range []*Lockout{getLockout(IpLockout, ip, now), getLockout(kind, value, now)} {
+		l.Failures++
+		l.Last = now
+		l.Until = now.Add(getBackoff(l.Failures))
+		if l.Failures == maxFailures {
+			log.Printf("[WARN][AUTH] Login locked for %s %q until %s\n", l.Type, l.Value, l.Until.Format(time.RFC3339))
+		}
+	}
+}
+
+// loginSucceeded forgets the failures of the username only, the failures of the client address
+// keep counting so logging in to one account does not clear the guesses made on the others.
+func loginSucceeded(ip string, username string) {
+	lockoutsMutex.Lock()
+	defer lockoutsMutex.Unlock()
+	delete(lockouts, UserLockout+":"+username)
+	releaseAttempt(ip)
+}
+
+// releaseAttempt gives back the backoff reserved for the client address by beginAttempt,
+// it must be called with the lockouts mutex locked.
+func releaseAttempt(ip string) {
+	if l, ok := lockouts[IpLockout+":"+ip]; ok && l.Failures > 0 {
+		l.Until = l.Last.Add(getBackoff(l.Failures))
+	}
+}
+
+// pruneLockouts must be called with the lockouts mutex locked.
+func pruneLockouts(now time.Time) {
+	_, duration, _ := getLoginProtection()
+	for key, l := range lockouts {
+		if now.Sub(l.Last) > duration && now.After(l.Until) {
+			delete(lockouts, key)
+		}
+	}
+}
+
+// BeginSharePassword returns how long the client has to wait before trying the password of a share.
+func BeginSharePassword(r *http.Request, id string) time.Duration {
+	ip := GetClientIp(r)
+	wait := beginAttempt(ip, ShareLockout, id)
+	if wait > 0 {
+		log.Printf("[WARN][AUTH] Share password blocked for share %q from %s\n", id, ip)
+	}
+	return wait
+}
+
+func SharePasswordFailed(r *http.Request, id string) {
+	ip := GetClientIp(r)
+	attemptFailed(ip, ShareLockout, id)
+	log.Printf("[WARN][AUTH] Share password failed for share %q from %s\n", id, ip)
+}
+
+// SharePasswordSucceeded forgets the wrong passwords of the share only, knowing the password
+// of a share does not clear the failed logins of the client.
+func SharePasswordSucceeded(r *http.Request, id string) {
+	lockoutsMutex.Lock()
+	defer lockoutsMutex.Unlock()
+	delete(lockouts, ShareLockout+":"+id)
+	releaseAttempt(GetClientIp(r))
+}
+
+// GetLockouts returns the clients, the usernames and the shares with failures, the last failure first.
+func GetLockouts() []Lockout {
+	now := time.Now()
+	maxFailures, _, _ := getLoginProtection()
+	lockoutsMutex.Lock()
+	pruneLockouts(now)
+	result := []Lockout{}
+	for _, l := range lockouts {
+		if l.Failures > 0 {
+			c := *l
+			c.Locked = c.Failures >= maxFailures && now.Before(c.Until)
+			result = append(result, c)
+		}
+	}
+	lockoutsMutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].Last.After(result[j].Last) })
+	return result
+}
+
+// ClearLockout forgets the failed logins of a client or a username, or all of them when kind is empty.
+func ClearLockout(kind string, value string) {
+	lockoutsMutex.Lock()
+	defer lockoutsMutex.Unlock()
+	if kind == "" {
+		lockouts = map[string]*Lockout{}
+		return
+	}
+	delete(lockouts, kind+":"+value)
+}
+
+func GetLockoutsHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(LockoutsList{
+		Lockouts: GetLockouts(),
+		Success:  true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
+
+// ClearLockoutHandler clears the lockout of the ip, the user or the share parameter, or every lockout with all=true.
+func ClearLockoutHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	switch {
+	case q.Get("all") == "true":
+		ClearLockout("", "")
+		log.Printf("[INFO] Every lockout cleared by %s\n", user.Username)
+	case q.Get("ip") != "":
+		ClearLockout(IpLockout, q.Get("ip"))
+		log.Printf("[INFO] Lockout of ip %s cleared by %s\n", q.Get("ip"), user.Username)
+	case q.Get("user") != "":
+		ClearLockout(UserLockout, q.Get("user"))
+		log.Printf("[INFO] Lockout of user %s cleared by %s\n", q.Get("user"), user.Username)
+	case q.Get("share") != "":
+		ClearLockout(ShareLockout, q.Get("share"))
+		log.Printf("[INFO] Lockout of share %s cleared by %s\n", q.Get("share"), user.Username)
+	default:
+		SendError(w, r, "Lockout missing (ip, user, share or all)")
+		return
+	}
+	SendSuccess(w, r, "Lockout cleared!")
+}
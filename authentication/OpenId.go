@@ -0,0 +1,555 @@
+package authentication
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"openify/ConfigurationManager"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const OpenIdProviderType = "oidc"
+
+const defaultUsernameClaim = "preferred_username"
+const defaultGroupsClaim = "groups"
+const defaultOpenIdTimeout = 10 * time.Second
+
+var defaultOpenIdScopes = []string{"openid", "profile", "email"}
+
+// The login has to come back from the identity provider within this delay.
+const openIdLoginLifetime = 10 * time.Minute
+
+// The browser starting a login keeps a hash of its state in this cookie, so a login started by
+// someone else cannot be finished in it.
+const openIdStateCookie = "openify-oidc-state"
+
+// The keys of the provider are fetched again for an unknown key ID, at most once in this delay.
+const jwksRefreshDelay = time.Minute
+
+// OpenIdProvider logs the users in with the authorization code flow of OpenID Connect, with PKCE.
+// Its users have no password: Authenticate refuses them, they log in with BeginOpenIdLogin.
+type OpenIdProvider struct {
+	Config      ConfigurationManager.AuthProviderConfig
+	Client      *http.Client
+	mutex       sync.Mutex
+	discovery   *openIdDiscovery
+	keys        map[string]interface{}
+	keysFetched time.Time
+}
+
+type openIdDiscovery struct {
+	Issuer                string `json:"issuer"`
+	AuthorizationEndpoint string `json:"authorization_endpoint"`
+	TokenEndpoint         string `json:"token_endpoint"`
+	JwksUri               string `json:"jwks_uri"`
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+type openIdTokenResponse struct {
+	IdToken          string `json:"id_token"`
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+}
+
+// openIdLogin is a login sent to the identity provider, found back with its state.
+type openIdLogin struct {
+	provider    string
+	verifier    string
+	nonce       string
+	redirectUri string
+	redirect    string
+	device      string
+	expires     time.Time
+}
+
+var openIdLoginsMutex sync.Mutex
+var openIdLogins = map[string]openIdLogin{}
+
+func NewOpenIdProvider(c ConfigurationManager.AuthProviderConfig) *OpenIdProvider {
+	timeout := defaultOpenIdTimeout
+	if c.TimeoutSeconds > 0 {
+		timeout = time.Duration(c.TimeoutSeconds) * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	if c.InsecureSkipVerify {
+		client.Transport = &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}}
+	}
+	return &OpenIdProvider{Config: c, Client: client}
+}
+
+func (p *OpenIdProvider) Name() string {
+	return p.Config.Name
+}
+
+func (p *OpenIdProvider) Authenticate(username string, password string) (User, error) {
+	if user, err := GetUserInfo(username); err == nil && GetUserProvider(user) == p.Name() {
+		return User{}, ErrInvalidPassword
+	}
+	return User{}, ErrUnknownUser
+}
+
+func (p *OpenIdProvider) getJson(u string, v interface{}) error {
+	res, err := p.Client.Get(u)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s answered %s", u, res.Status)
+	}
+	return json.NewDecoder(res.Body).Decode(v)
+}
+
+// getDiscovery returns the endpoints of the provider, read once from its discovery document.
+func (p *OpenIdProvider) getDiscovery() (openIdDiscovery, error) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.discovery != nil {
+		return *p.discovery, nil
+	}
+	issuer := strings.TrimSuffix(p.Config.IssuerUrl, "/")
+	var d openIdDiscovery
+	if err := p.getJson(issuer+"/.well-known/openid-configuration", &d); err != nil {
+		return openIdDiscovery{}, err
+	}
+	if strings.TrimSuffix(d.Issuer, "/") != issuer {
+		return openIdDiscovery{}, fmt.Errorf("the discovery document of %s is for the issuer %s", issuer, d.Issuer)
+	}
+	if d.AuthorizationEndpoint == "" || d.TokenEndpoint == "" || d.JwksUri == "" {
+		return openIdDiscovery{}, errors.New("incomplete discovery document for " + issuer)
+	}
+	p.discovery = &d
+	return d, nil
+}
+
+// getKey returns the public key of an ID, fetching the keys again when the provider rotated them.
+// Without an ID, the key is the only one of the provider.
+func (p *OpenIdProvider) getKey(kid string) (interface{}, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if _, ok := p.keys[kid]; !ok && time.Since(p.keysFetched) > jwksRefreshDelay {
+		var set jsonWebKeySet
+		if err := p.getJson(d.JwksUri, &set); err != nil {
+			return nil, err
+		}
+		keys := map[string]interface{}{}
+		for _, k := range set.Keys {
+			if k.Use != "" && k.Use != "sig" {
+				continue
+			}
+			key, err := parseJsonWebKey(k)
+			if err != nil {
+				continue
+			}
+			keys[k.Kid] = key
+		}
+		p.keys = keys
+		p.keysFetched = time.Now()
+	}
+	if key, ok := p.keys[kid]; ok {
+		return key, nil
+	}
+	if kid == "" && len(p.keys) == 1 {
+		for _, key := range p.keys {
+			return key, nil
+		}
+	}
+	return nil, errors.New("unknown signing key " + kid)
+}
+
+func parseJsonWebKey(k jsonWebKey) (interface{}, error) {
+	decode := func(s string) (*big.Int, error) {
+		b, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(s, "="))
+		if err != nil {
+			return nil, err
+		}
+		return new(big.Int).SetBytes(b), nil
+	}
+	switch k.Kty {
+	case "RSA":
+		n, err := decode(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decode(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		curves := map[string]elliptic.Curve{"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521()}
+		curve, ok := curves[k.Crv]
+		if !ok {
+			return nil, errors.New("unsupported curve " + k.Crv)
+		}
+		x, err := decode(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decode(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, errors.New("unsupported key type " + k.Kty)
+}
+
+// isAllowedRedirect tells if the browser can be sent to the URL with the tokens: a path of the
+// server, or a URL with the scheme, the host and the port of one of the allowed redirects of the
+// provider, within its path.
+func (p *OpenIdProvider) isAllowedRedirect(redirect string) bool {
+	u, err := url.Parse(redirect)
+	if err != nil || u.Fragment != "" || u.User != nil || u.Opaque != "" {
+		return false
+	}
+	if u.Scheme == "" && u.Host == "" {
+		return strings.HasPrefix(redirect, "/") && !strings.HasPrefix(redirect, "//") && !strings.HasPrefix(redirect, "/\\")
+	}
+	for _, allowed := range p.Config.AllowedRedirects {
+		a, err := url.Parse(allowed)
+		if err != nil || a.Scheme == "" {
+			continue
+		}
+		if !strings.EqualFold(a.Scheme, u.Scheme) || !strings.EqualFold(a.Host, u.Host) {
+			continue
+		}
+		if a.Path == "" || strings.HasSuffix(a.Path, "/") && strings.HasPrefix(u.Path, a.Path) ||
+			u.Path == a.Path || strings.HasPrefix(u.Path, a.Path+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func getOpenIdProvider(name string) (*OpenIdProvider, error) {
+	for _, p := range providers {
+		if o, ok := p.(*OpenIdProvider); ok && (name == "" || o.Name() == name) {
+			return o, nil
+		}
+	}
+	return nil, errors.New("unknown OpenID provider " + name)
+}
+
+// BeginOpenIdLogin returns the URL of the identity provider where the browser logs in, to come back
+// to the callback URL, and the state of the login. The first OpenID provider is used when name is
+// empty. After the login, the browser is sent to redirect with the tokens, and the session is
+// opened for the device.
+func BeginOpenIdLogin(name string, callbackUrl string, redirect string, device string) (string, string, error) {
+	p, err := getOpenIdProvider(name)
+	if err != nil {
+		return "", "", err
+	}
+	if redirect != "" && !p.isAllowedRedirect(redirect) {
+		return "", "", errors.New("redirect not allowed")
+	}
+	d, err := p.getDiscovery()
+	if err != nil {
+		return "", "", err
+	}
+	if p.Config.RedirectUrl != "" {
+		callbackUrl = p.Config.RedirectUrl
+	}
+	state, err := newSecret()
+	if err != nil {
+		return "", "", err
+	}
+	nonce, err := newSecret()
+	if err != nil {
+		return "", "", err
+	}
+	verifier, err := newSecret()
+	if err != nil {
+		return "", "", err
+	}
+	challenge := sha256.Sum256([]byte(verifier))
+	scopes := p.Config.Scopes
+	if len(scopes) == 0 {
+		scopes = defaultOpenIdScopes
+	}
+	v := url.Values{}
+	v.Set("response_type", "code")
+	v.Set("client_id", p.Config.ClientId)
+	v.Set("redirect_uri", callbackUrl)
+	v.Set("scope", strings.Join(scopes, " "))
+	v.Set("state", state)
+	v.Set("nonce", nonce)
+	v.Set("code_challenge", base64.RawURLEncoding.EncodeToString(challenge[:]))
+	v.Set("code_challenge_method", "S256")
+	now := time.Now()
+	openIdLoginsMutex.Lock()
+	for key, l := range openIdLogins {
+		if now.After(l.expires) {
+			delete(openIdLogins, key)
+		}
+	}
+	openIdLogins[state] = openIdLogin{
+		provider:    p.Name(),
+		verifier:    verifier,
+		nonce:       nonce,
+		redirectUri: callbackUrl,
+		redirect:    redirect,
+		device:      device,
+		expires:     now.Add(openIdLoginLifetime),
+	}
+	openIdLoginsMutex.Unlock()
+	separator := "?"
+	if strings.Contains(d.AuthorizationEndpoint, "?") {
+		separator = "&"
+	}
+	return d.AuthorizationEndpoint + separator + v.Encode(), state, nil
+}
+
+func hashOpenIdState(state string) string {
+	h := sha256.Sum256([]byte(state))
+	return hex.EncodeToString(h[:])
+}
+
+// SetOpenIdStateCookie binds the login of the state to the browser, until the login expires.
+func SetOpenIdStateCookie(w http.ResponseWriter, r *http.Request, state string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     openIdStateCookie,
+		Value:    hashOpenIdState(state),
+		Path:     "/",
+		MaxAge:   int(openIdLoginLifetime.Seconds()),
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// IsOpenIdStateOfBrowser tells if the login of the state was started by the browser of the request.
+func IsOpenIdStateOfBrowser(r *http.Request, state string) bool {
+	c, err := r.Cookie(openIdStateCookie)
+	if err != nil || state == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(c.Value), []byte(hashOpenIdState(state))) == 1
+}
+
+// ClearOpenIdStateCookie removes the cookie of the login once the browser came back.
+func ClearOpenIdStateCookie(w http.ResponseWriter, r *http.Request) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     openIdStateCookie,
+		Value:    "",
+		Path:     "/",
+		MaxAge:   -1,
+		Secure:   r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	})
+}
+
+// FinishOpenIdLogin exchanges the code given to the callback for the ID token, checks it and returns
+// the user, added on its first login, with the device and the redirect given to BeginOpenIdLogin.
+func FinishOpenIdLogin(state string, code string) (User, string, string, error) {
+	openIdLoginsMutex.Lock()
+	l, ok := openIdLogins[state]
+	delete(openIdLogins, state)
+	openIdLoginsMutex.Unlock()
+	if !ok || time.Now().After(l.expires) {
+		return User{}, "", "", errors.New("unknown or expired login state")
+	}
+	if code == "" {
+		return User{}, "", "", errors.New("authorization code missing")
+	}
+	p, err := getOpenIdProvider(l.provider)
+	if err != nil {
+		return User{}, "", "", err
+	}
+	claims, err := p.exchangeCode(code, l)
+	if err != nil {
+		return User{}, "", "", err
+	}
+	user, err := p.getUser(claims)
+	if err != nil {
+		return User{}, "", "", err
+	}
+	return user, l.device, l.redirect, nil
+}
+
+// exchangeCode asks the token endpoint for the ID token of the code, and returns its checked claims.
+func (p *OpenIdProvider) exchangeCode(code string, l openIdLogin) (jwt.MapClaims, error) {
+	d, err := p.getDiscovery()
+	if err != nil {
+		return nil, err
+	}
+	v := url.Values{}
+	v.Set("grant_type", "authorization_code")
+	v.Set("code", code)
+	v.Set("redirect_uri", l.redirectUri)
+	v.Set("client_id", p.Config.ClientId)
+	v.Set("code_verifier", l.verifier)
+	req, err := http.NewRequest(http.MethodPost, d.TokenEndpoint, strings.NewReader(v.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if p.Config.ClientSecret != "" {
+		req.SetBasicAuth(url.QueryEscape(p.Config.ClientId), url.QueryEscape(p.Config.ClientSecret))
+	}
+	res, err := p.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	var tr openIdTokenResponse
+	if err := json.NewDecoder(res.Body).Decode(&tr); err != nil {
+		return nil, fmt.Errorf("token endpoint answered %s", res.Status)
+	}
+	if tr.Error != "" {
+		return nil, fmt.Errorf("token endpoint refused the code: %s %s", tr.Error, tr.ErrorDescription)
+	}
+	if res.StatusCode != http.StatusOK || tr.IdToken == "" {
+		return nil, fmt.Errorf("token endpoint answered %s without ID token", res.Status)
+	}
+	return p.parseIdToken(tr.IdToken, d.Issuer, l.nonce)
+}
+
+// parseIdToken checks the signature of the ID token with the keys of the provider, and its issuer,
+// audience, expiration and nonce.
+func (p *OpenIdProvider) parseIdToken(t string, issuer string, nonce string) (jwt.MapClaims, error) {
+	claims := jwt.MapClaims{}
+	_, err := jwt.ParseWithClaims(t, claims, func(token *jwt.Token) (interface{}, error) {
+		switch token.Method.(type) {
+		case *jwt.SigningMethodRSA, *jwt.SigningMethodRSAPSS, *jwt.SigningMethodECDSA:
+		default:
+			return nil, fmt.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		kid, _ := token.Header["kid"].(string)
+		return p.getKey(kid)
+	})
+	if err != nil {
+		return nil, err
+	}
+	if iss, _ := claims["iss"].(string); iss != issuer {
+		return nil, errors.New("ID token of another issuer: " + iss)
+	}
+	if _, ok := claims["exp"]; !ok {
+		return nil, errors.New("ID token without expiration")
+	}
+	var audiences []string
+	switch aud := claims["aud"].(type) {
+	case string:
+		audiences = []string{aud}
+	case []interface{}:
+		for _, a := range aud {
+			if s, ok := a.(string); ok {
+				audiences = append(audiences, s)
+			}
+		}
+	}
+	found := false
+	for _, a := range audiences {
+		found = found || a == p.Config.ClientId
+	}
+	if !found {
+		return nil, errors.New("ID token for another client")
+	}
+	if azp, ok := claims["azp"].(string); ok && azp != p.Config.ClientId {
+		return nil, errors.New("ID token authorized for another client: " + azp)
+	}
+	if n, _ := claims["nonce"].(string); n != nonce {
+		return nil, errors.New("ID token with a wrong nonce")
+	}
+	return claims, nil
+}
+
+// getUser maps the claims of the ID token to a user, which is added or updated. The user is bound to
+// the issuer and the subject of the token on its first login, and found with them afterwards, as the
+// username claim can change. A local user, the user of another provider or a user bound to another
+// subject with the same username cannot be logged in by the identity provider.
+func (p *OpenIdProvider) getUser(claims jwt.MapClaims) (User, error) {
+	usernameClaim, groupsClaim := p.Config.UsernameClaim, p.Config.GroupsClaim
+	if usernameClaim == "" {
+		usernameClaim = defaultUsernameClaim
+	}
+	if groupsClaim == "" {
+		groupsClaim = defaultGroupsClaim
+	}
+	issuer, _ := claims["iss"].(string)
+	subject, _ := claims["sub"].(string)
+	if subject == "" {
+		return User{}, errors.New("ID token without subject")
+	}
+	username, _ := claims[usernameClaim].(string)
+	if bound, ok := p.getBoundUser(issuer, subject); ok {
+		username = bound.Username
+	} else if username == "" {
+		return User{}, errors.New("ID token without the " + usernameClaim + " claim")
+	} else if existing, err := GetUserInfo(username); err == nil {
+		if GetUserProvider(existing) != p.Name() {
+			return User{}, fmt.Errorf("user %s is already managed by %s", username, GetUserProvider(existing))
+		}
+		return User{}, fmt.Errorf("user %s is bound to another account of %s", username, p.Name())
+	}
+	var groups []string
+	switch g := claims[groupsClaim].(type) {
+	case string:
+		groups = []string{g}
+	case []interface{}:
+		for _, v := range g {
+			if s, ok := v.(string); ok {
+				groups = append(groups, s)
+			}
+		}
+	}
+	role, ok := getGroupRole(p.Config, groups)
+	if !ok {
+		return User{}, ErrNotAllowed
+	}
+	return syncUser(User{
+		Username:      username,
+		Role:          role,
+		Administrator: role == AdminRole,
+		Provider:      p.Name(),
+		Issuer:        issuer,
+		Subject:       subject,
+	})
+}
+
+// getBoundUser returns the user of the provider bound to the issuer and the subject.
+func (p *OpenIdProvider) getBoundUser(issuer string, subject string) (User, bool) {
+	usersMutex.Lock()
+	defer usersMutex.Unlock()
+	for _, user := range users {
+		if user.Provider == p.Name() && user.Issuer == issuer && user.Subject == subject {
+			return user, true
+		}
+	}
+	return User{}, false
+}
@@ -0,0 +1,421 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"openify/ConfigurationManager"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+// The users and the sessions are saved in the working directory, a temporary one for the tests.
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "openify-authentication")
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := os.Chdir(dir); err != nil {
+		log.Fatal(err)
+	}
+	code := m.Run()
+	_ = os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+const testClientId = "openify"
+const testClientSecret = "s3cret"
+const testCallbackUrl = "http://openify.test/api/oidc/callback"
+
+// testIdp is an identity provider answering the discovery, the keys and the token requests.
+// The codes are registered by the tests, with the claims of the ID token they are exchanged for.
+type testIdp struct {
+	server      *httptest.Server
+	mutex       sync.Mutex
+	issuer      string
+	key         *rsa.PrivateKey
+	kid         string
+	signKey     *rsa.PrivateKey
+	codes       map[string]testCode
+	discoveries int
+	jwksFetches int
+}
+
+type testCode struct {
+	challenge string
+	claims    jwt.MapClaims
+}
+
+func newTestIdp(t *testing.T) *testIdp {
+	idp := &testIdp{codes: map[string]testCode{}}
+	idp.rotate(t)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", idp.discovery)
+	mux.HandleFunc("/jwks", idp.jwks)
+	mux.HandleFunc("/token", idp.token)
+	idp.server = httptest.NewServer(mux)
+	idp.issuer = idp.server.URL
+	t.Cleanup(idp.server.Close)
+	return idp
+}
+
+// rotate replaces the signing key of the provider.
+func (idp *testIdp) rotate(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	idp.key, idp.signKey = key, key
+	idp.kid = "key-" + big.NewInt(time.Now().UnixNano()).String()
+}
+
+func (idp *testIdp) discovery(w http.ResponseWriter, r *http.Request) {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	idp.discoveries++
+	_ = json.NewEncoder(w).Encode(map[string]string{
+		"issuer":                 idp.issuer,
+		"authorization_endpoint": idp.server.URL + "/authorize",
+		"token_endpoint":         idp.server.URL + "/token",
+		"jwks_uri":               idp.server.URL + "/jwks",
+	})
+}
+
+func (idp *testIdp) jwks(w http.ResponseWriter, r *http.Request) {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	idp.jwksFetches++
+	encode := base64.RawURLEncoding.EncodeToString
+	_ = json.NewEncoder(w).Encode(map[string]interface{}{"keys": []map[string]string{{
+		"kty": "RSA",
+		"kid": idp.kid,
+		"use": "sig",
+		"alg": "RS256",
+		"n":   encode(idp.key.N.Bytes()),
+		"e":   encode(big.NewInt(int64(idp.key.E)).Bytes()),
+	}}})
+}
+
+func (idp *testIdp) token(w http.ResponseWriter, r *http.Request) {
+	idp.mutex.Lock()
+	defer idp.mutex.Unlock()
+	id, secret, _ := r.BasicAuth()
+	c, ok := idp.codes[r.PostFormValue("code")]
+	delete(idp.codes, r.PostFormValue("code"))
+	verifier := sha256.Sum256([]byte(r.PostFormValue("code_verifier")))
+	if id != testClientId || secret != testClientSecret || !ok ||
+		base64.RawURLEncoding.EncodeToString(verifier[:]) != c.challenge {
+		w.WriteHeader(http.StatusBadRequest)
+		_ = json.NewEncoder(w).Encode(map[string]string{"error": "invalid_grant"})
+		return
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, c.claims)
+	token.Header["kid"] = idp.kid
+	signed, err := token.SignedString(idp.signKey)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(map[string]string{"id_token": signed, "token_type": "Bearer"})
+}
+
+// login logs in through the provider with an ID token of the claims, added to the ones of a valid
+// token of the subject. A nil claim is removed from the token.
+func (idp *testIdp) login(t *testing.T, p *OpenIdProvider, subject string, username string, claims jwt.MapClaims) (User, error) {
+	u, _, err := BeginOpenIdLogin(p.Name(), testCallbackUrl, "", "test")
+	if err != nil {
+		return User{}, err
+	}
+	auth, err := url.Parse(u)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := auth.Query()
+	if q.Get("client_id") != testClientId || q.Get("redirect_uri") != testCallbackUrl || q.Get("code_challenge_method") != "S256" {
+		t.Fatalf("unexpected authorization request %s", u)
+	}
+	now := time.Now()
+	c := jwt.MapClaims{
+		"iss":                idp.issuer,
+		"sub":                subject,
+		"aud":                testClientId,
+		"exp":                now.Add(time.Minute).Unix(),
+		"iat":                now.Unix(),
+		"nonce":              q.Get("nonce"),
+		"preferred_username": username,
+	}
+	for name, value := range claims {
+		if value == nil {
+			delete(c, name)
+		} else {
+			c[name] = value
+		}
+	}
+	code := "code-" + q.Get("state")
+	idp.mutex.Lock()
+	idp.codes[code] = testCode{challenge: q.Get("code_challenge"), claims: c}
+	idp.mutex.Unlock()
+	user, device, _, err := FinishOpenIdLogin(q.Get("state"), code)
+	if err == nil && device != "test" {
+		t.Errorf("device %q, expected test", device)
+	}
+	return user, err
+}
+
+// newTestOpenIdProvider makes the provider of the identity provider the only one besides the local users.
+func newTestOpenIdProvider(idp *testIdp) *OpenIdProvider {
+	p := NewOpenIdProvider(ConfigurationManager.AuthProviderConfig{
+		Name:             "sso",
+		Type:             OpenIdProviderType,
+		IssuerUrl:        idp.server.URL,
+		ClientId:         testClientId,
+		ClientSecret:     testClientSecret,
+		Groups:           []ConfigurationManager.GroupRoleConfig{{Group: "admins", Role: AdminRole}},
+		AllowedRedirects: []string{"https://app.example.com", "https://web.example.com/openify/", "openify://callback"},
+	})
+	p.Client = idp.server.Client()
+	users = nil
+	providers = []Provider{JsonProvider{}, p}
+	return p
+}
+
+func TestOpenIdLogin(t *testing.T) {
+	idp := newTestIdp(t)
+	p := newTestOpenIdProvider(idp)
+	user, err := idp.login(t, p, "alice-id", "alice", jwt.MapClaims{"groups": []string{"admins"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.Role != AdminRole || !user.Administrator || user.Provider != "sso" {
+		t.Errorf("unexpected user %+v", user)
+	}
+	saved, err := GetUserInfo("alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved.Issuer != idp.issuer || saved.Subject != "alice-id" {
+		t.Errorf("user bound to %q %q", saved.Issuer, saved.Subject)
+	}
+	if _, err := idp.login(t, p, "bob-id", "bob", nil); err != nil {
+		t.Fatal(err)
+	}
+	if bob, _ := GetUserInfo("bob"); bob.Role != UserRole {
+		t.Errorf("role %q without group, expected %q", bob.Role, UserRole)
+	}
+	if idp.discoveries != 1 || idp.jwksFetches != 1 {
+		t.Errorf("%d discoveries and %d key fetches, expected one of each", idp.discoveries, idp.jwksFetches)
+	}
+	if _, _, _, err := FinishOpenIdLogin("unknown", "code"); err == nil {
+		t.Error("unknown state accepted")
+	}
+	if _, err := p.Authenticate("alice", "password"); err != ErrInvalidPassword {
+		t.Errorf("password login of an OpenID user: %v", err)
+	}
+}
+
+func TestOpenIdStateIsUsedOnce(t *testing.T) {
+	idp := newTestIdp(t)
+	p := newTestOpenIdProvider(idp)
+	u, _, err := BeginOpenIdLogin(p.Name(), testCallbackUrl, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, _ := url.Parse(u)
+	state := auth.Query().Get("state")
+	if _, _, _, err := FinishOpenIdLogin(state, "wrong-code"); err == nil {
+		t.Fatal("wrong code accepted")
+	}
+	if _, _, _, err := FinishOpenIdLogin(state, "wrong-code"); err == nil || err.Error() != "unknown or expired login state" {
+		t.Errorf("state used twice: %v", err)
+	}
+}
+
+func TestOpenIdStateCookie(t *testing.T) {
+	idp := newTestIdp(t)
+	p := newTestOpenIdProvider(idp)
+	_, state, err := BeginOpenIdLogin(p.Name(), testCallbackUrl, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := httptest.NewRecorder()
+	SetOpenIdStateCookie(w, httptest.NewRequest("GET", "/api/oidc/login", nil), state)
+	cookies := w.Result().Cookies()
+	if len(cookies) != 1 || !cookies[0].HttpOnly || cookies[0].Value == state {
+		t.Fatalf("unexpected state cookie %v", cookies)
+	}
+	r := httptest.NewRequest("GET", "/api/oidc/callback", nil)
+	if IsOpenIdStateOfBrowser(r, state) {
+		t.Error("state accepted without its cookie")
+	}
+	r.AddCookie(cookies[0])
+	if !IsOpenIdStateOfBrowser(r, state) {
+		t.Error("state refused with its cookie")
+	}
+	_, other, err := BeginOpenIdLogin(p.Name(), testCallbackUrl, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if IsOpenIdStateOfBrowser(r, other) {
+		t.Error("state of another login accepted")
+	}
+}
+
+func TestOpenIdSubjectBinding(t *testing.T) {
+	idp := newTestIdp(t)
+	p := newTestOpenIdProvider(idp)
+	users = append(users, User{Username: "root", Role: AdminRole, Administrator: true})
+	if _, err := idp.login(t, p, "alice-id", "alice", jwt.MapClaims{"groups": []string{"admins"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := idp.login(t, p, "mallory-id", "alice", nil); err == nil {
+		t.Error("another subject logged in with the username of a bound user")
+	}
+	if _, err := idp.login(t, p, "mallory-id", "root", nil); err == nil {
+		t.Error("an OpenID account logged in as a local user")
+	}
+	user, err := idp.login(t, p, "alice-id", "alice.renamed", jwt.MapClaims{"groups": []string{"admins"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" {
+		t.Errorf("renamed account logged in as %s, expected alice", user.Username)
+	}
+	if _, err := idp.login(t, p, "", "nobody", jwt.MapClaims{"sub": nil}); err == nil {
+		t.Error("ID token without subject accepted")
+	}
+}
+
+func TestOpenIdTokenChecks(t *testing.T) {
+	idp := newTestIdp(t)
+	p := newTestOpenIdProvider(idp)
+	now := time.Now()
+	tests := []struct {
+		name   string
+		claims jwt.MapClaims
+	}{
+		{"wrong issuer", jwt.MapClaims{"iss": "https://evil.example.com"}},
+		{"wrong audience", jwt.MapClaims{"aud": "another-client"}},
+		{"audience list without the client", jwt.MapClaims{"aud": []string{"a", "b"}}},
+		{"wrong authorized party", jwt.MapClaims{"aud": []string{testClientId, "another-client"}, "azp": "another-client"}},
+		{"wrong nonce", jwt.MapClaims{"nonce": "replayed"}},
+		{"missing nonce", jwt.MapClaims{"nonce": nil}},
+		{"expired", jwt.MapClaims{"exp": now.Add(-time.Minute).Unix()}},
+		{"missing expiration", jwt.MapClaims{"exp": nil}},
+		{"not valid yet", jwt.MapClaims{"nbf": now.Add(time.Hour).Unix()}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := idp.login(t, p, "alice-id", "alice", tt.claims); err == nil {
+				t.Error("ID token accepted")
+			}
+		})
+	}
+	if _, err := idp.login(t, p, "alice-id", "alice", jwt.MapClaims{"aud": []string{testClientId, "another-client"}, "azp": testClientId}); err != nil {
+		t.Errorf("valid ID token with several audiences refused: %v", err)
+	}
+}
+
+func TestOpenIdSignature(t *testing.T) {
+	idp := newTestIdp(t)
+	p := newTestOpenIdProvider(idp)
+	forger, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	idp.signKey = forger
+	if _, err := idp.login(t, p, "alice-id", "alice", nil); err == nil {
+		t.Error("ID token signed with another key accepted")
+	}
+	claims := jwt.MapClaims{"iss": idp.issuer, "sub": "alice-id", "aud": testClientId, "exp": time.Now().Add(time.Minute).Unix()}
+	hmac, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(testClientSecret))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := p.parseIdToken(hmac, idp.issuer, ""); err == nil {
+		t.Error("ID token signed with HS256 accepted")
+	}
+}
+
+func TestOpenIdKeyRotation(t *testing.T) {
+	idp := newTestIdp(t)
+	p := newTestOpenIdProvider(idp)
+	if _, err := idp.login(t, p, "alice-id", "alice", nil); err != nil {
+		t.Fatal(err)
+	}
+	idp.rotate(t)
+	if _, err := idp.login(t, p, "alice-id", "alice", nil); err == nil {
+		t.Error("unknown key accepted")
+	}
+	if idp.jwksFetches != 1 {
+		t.Errorf("keys fetched %d times within the refresh delay, expected once", idp.jwksFetches)
+	}
+	p.mutex.Lock()
+	p.keysFetched = time.Now().Add(-jwksRefreshDelay - time.Second)
+	p.mutex.Unlock()
+	if _, err := idp.login(t, p, "alice-id", "alice", nil); err != nil {
+		t.Errorf("ID token of the new key refused: %v", err)
+	}
+	if idp.jwksFetches != 2 {
+		t.Errorf("keys fetched %d times, expected twice", idp.jwksFetches)
+	}
+}
+
+func TestOpenIdDiscoveryIssuer(t *testing.T) {
+	idp := newTestIdp(t)
+	p := newTestOpenIdProvider(idp)
+	idp.issuer = "https://evil.example.com"
+	if _, _, err := BeginOpenIdLogin(p.Name(), testCallbackUrl, "", ""); err == nil {
+		t.Error("discovery document of another issuer accepted")
+	}
+}
+
+func TestOpenIdRedirects(t *testing.T) {
+	idp := newTestIdp(t)
+	p := newTestOpenIdProvider(idp)
+	tests := []struct {
+		redirect string
+		allowed  bool
+	}{
+		{"/library", true},
+		{"//evil.example.com/", false},
+		{"/\\evil.example.com/", false},
+		{"https://app.example.com", true},
+		{"https://app.example.com/login/done?x=1", true},
+		{"https://APP.example.com/", true},
+		{"https://app.example.com.evil.net/", false},
+		{"https://app.example.com@evil.net/", false},
+		{"https://evil.net/https://app.example.com", false},
+		{"http://app.example.com/", false},
+		{"https://app.example.com:8443/", false},
+		{"https://app.example.com/#fragment", false},
+		{"https://web.example.com/openify/", true},
+		{"https://web.example.com/openify/home", true},
+		{"https://web.example.com/openify-evil/", false},
+		{"https://web.example.com/", false},
+		{"openify://callback", true},
+		{"openify://callback.evil.net", false},
+		{"javascript:alert(1)", false},
+	}
+	for _, tt := range tests {
+		if allowed := p.isAllowedRedirect(tt.redirect); allowed != tt.allowed {
+			t.Errorf("redirect %s allowed %v, expected %v", tt.redirect, allowed, tt.allowed)
+		}
+	}
+	if _, _, err := BeginOpenIdLogin(p.Name(), testCallbackUrl, "https://app.example.com.evil.net/", ""); err == nil {
+		t.Error("login started with a redirect which is not allowed")
+	}
+}
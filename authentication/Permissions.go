@@ -0,0 +1,162 @@
+package authentication
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"openify/ConfigurationManager"
+	"openify/Response"
+	"sort"
+)
+
+// edit-tags is given by the roles to the clients editing the tags of the files, the server
+// itself does not edit them.
+const (
+	PermStream          = "stream"
+	PermDownload        = "download"
+	PermShare           = "share"
+	PermEditTags        = "edit-tags"
+	PermScan            = "scan"
+	PermManageUsers     = "manage-users"
+	PermViewUsers       = "view-users"
+	PermViewStats       = "view-stats"
+	PermManageKeys      = "manage-keys"
+	PermManageSessions  = "manage-sessions"
+	PermManagePlaylists = "manage-playlists"
+	PermManageShares    = "manage-shares"
+)
+
+const (
+	AdminRole = "admin"
+	UserRole  = "user"
+)
+
+var Permissions = []string{PermStream, PermDownload, PermShare, PermEditTags, PermScan, PermManageUsers, PermViewUsers,
+	PermViewStats, PermManageKeys, PermManageSessions, PermManagePlaylists, PermManageShares}
+
+// The roles of the configuration are added to these ones and can replace the user role,
+// the admin role always has every permission.
+var defaultRoles = map[string][]string{
+	UserRole: {PermStream, PermDownload},
+}
+
+type Role struct {
+	Name        string   `json:"name"`
+	Permissions []string `json:"permissions"`
+}
+
+type RolesList struct {
+	Roles       []Role   `json:"roles"`
+	Permissions []string `json:"permissions"`
+	Success     bool     `json:"success"`
+}
+
+// GetRoles returns the permissions of every role.
+func GetRoles() map[string][]string {
+	roles := map[string][]string{}
+	for name, permissions := range defaultRoles {
+		roles[name] = permissions
+	}
+	for name, permissions := range ConfigurationManager.GetConfiguration().Roles {
+		roles[name] = permissions
+	}
+	roles[AdminRole] = Permissions
+	return roles
+}
+
+func IsRole(name string) bool {
+	_, ok := GetRoles()[name]
+	return ok
+}
+
+// normalizeRole keeps the role and the administrator flag of a user in sync,
+// the users saved before the roles get the admin or the user role.
+func normalizeRole(u *User) {
+	switch {
+	case u.Administrator:
+		u.Role = AdminRole
+	case u.Role == AdminRole:
+		u.Administrator = true
+	case u.Role == "":
+		u.Role = UserRole
+	}
+}
+
+// GetPermissions returns the permissions of the role of the user, and share when the share flag is set,
+// only the ones within the scopes of the API key the user is logged with.
+func GetPermissions(user User) []string {
+	role := user.Role
+	if user.Administrator {
+		role = AdminRole
+	}
+	granted := map[string]bool{}
+	for _, p := range GetRoles()[role] {
+		granted[p] = true
+	}
+	if user.Share {
+		granted[PermShare] = true
+	}
+	if len(user.scopes) > 0 {
+		scoped := map[string]bool{}
+		for _, s := range user.scopes {
+			scoped[s] = granted[s]
+		}
+		granted = scoped
+	}
+	result := []string{}
+	for _, p := range Permissions {
+		if granted[p] {
+			result = append(result, p)
+		}
+	}
+	return result
+}
+
+func HasPermission(user User, permission string) bool {
+	for _, p := range GetPermissions(user) {
+		if p == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// canGrant tells if the user holds every permission of the granted user, nobody can give
+// a role or a flag with more than its own permissions.
+func canGrant(user User, granted User) bool {
+	for _, p := range GetPermissions(granted) {
+		if !HasPermission(user, p) {
+			return false
+		}
+	}
+	return true
+}
+
+// losesPermissions tells if the user had a permission the updated user has not.
+func losesPermissions(user User, updated User) bool {
+	for _, p := range GetPermissions(user) {
+		if !HasPermission(updated, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func GetRolesHandler(w http.ResponseWriter, r *http.Request) {
+	list := RolesList{
+		Roles:       []Role{},
+		Permissions: Permissions,
+		Success:     true,
+	}
+	for name, permissions := range GetRoles() {
+		list.Roles = append(list.Roles, Role{Name: name, Permissions: permissions})
+	}
+	sort.Slice(list.Roles, func(i, j int) bool { return list.Roles[i].Name < list.Roles[j].Name })
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
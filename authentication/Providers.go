@@ -0,0 +1,272 @@
+package authentication
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"openify/ConfigurationManager"
+	"openify/LdapManager"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// The provider of the users of users.json, whose record has no provider.
+const LocalProvider = "local"
+
+const LdapProviderType = "ldap"
+
+const defaultUserFilter = "(uid=%s)"
+const defaultGroupAttribute = "memberOf"
+
+var ErrUnknownUser = errors.New("user not found")
+var ErrInvalidPassword = errors.New("invalid password")
+var ErrNotAllowed = errors.New("user not allowed by its provider")
+
+// Provider checks the password of the users it knows. Authenticate returns ErrUnknownUser for
+// the other users, and the user with the role given by the provider when the password is right.
+type Provider interface {
+	Name() string
+	Authenticate(username string, password string) (User, error)
+}
+
+var providers []Provider
+
+// JsonProvider authenticates the local users, with the bcrypt hash of users.json.
+type JsonProvider struct{}
+
+func (JsonProvider) Name() string {
+	return LocalProvider
+}
+
+func (JsonProvider) Authenticate(username string, password string) (User, error) {
+	user, err := GetUserInfo(username)
+	if err != nil || GetUserProvider(user) != LocalProvider {
+		return User{}, ErrUnknownUser
+	}
+	if err := bcrypt.CompareHashAndPassword([]byte(user.Password), []byte(password)); err != nil {
+		return User{}, ErrInvalidPassword
+	}
+	return user, nil
+}
+
+// LdapProvider finds the user in the directory with the service account, binds with its DN
+// and password, and maps its groups to a role. Dial can be set to reach a server in the process.
+type LdapProvider struct {
+	Config ConfigurationManager.AuthProviderConfig
+	Dial   LdapManager.Dialer
+}
+
+func NewLdapProvider(c ConfigurationManager.AuthProviderConfig) *LdapProvider {
+	return &LdapProvider{Config: c}
+}
+
+func (p *LdapProvider) Name() string {
+	return p.Config.Name
+}
+
+func (p *LdapProvider) Authenticate(username string, password string) (User, error) {
+	c := p.Config
+	conn, err := LdapManager.Dial(c.Url, c.InsecureSkipVerify, time.Duration(c.TimeoutSeconds)*time.Second, p.Dial)
+	if err != nil {
+		return User{}, err
+	}
+	defer conn.Close()
+	if err := p.bindService(conn); err != nil {
+		return User{}, err
+	}
+	userFilter, groupAttribute := c.UserFilter, c.GroupAttribute
+	if userFilter == "" {
+		userFilter = defaultUserFilter
+	}
+	if groupAttribute == "" {
+		groupAttribute = defaultGroupAttribute
+	}
+	filter := strings.Replace(userFilter, "%s", LdapManager.EscapeFilter(username), -1)
+	entries, err := conn.Search(c.BaseDN, LdapManager.ScopeSubtree, filter, []string{groupAttribute})
+	if err != nil {
+		return User{}, err
+	}
+	if len(entries) == 0 {
+		return User{}, ErrUnknownUser
+	}
+	if len(entries) > 1 {
+		return User{}, fmt.Errorf("%d directory entries found for user %s", len(entries), username)
+	}
+	if err := conn.Bind(entries[0].DN, password); err != nil {
+		if err == LdapManager.ErrInvalidCredentials {
+			return User{}, ErrInvalidPassword
+		}
+		return User{}, err
+	}
+	groups := entries[0].GetAttributeValues(groupAttribute)
+	if c.GroupBaseDN != "" && c.GroupFilter != "" {
+		if err := p.bindService(conn); err != nil {
+			return User{}, err
+		}
+		filter := strings.Replace(c.GroupFilter, "%s", LdapManager.EscapeFilter(entries[0].DN), -1)
+		found, err := conn.Search(c.GroupBaseDN, LdapManager.ScopeSubtree, filter, []string{"cn"})
+		if err != nil {
+			return User{}, err
+		}
+		for _, g := range found {
+			groups = append(groups, g.DN)
+		}
+	}
+	role, ok := getGroupRole(c, groups)
+	if !ok {
+		return User{}, ErrNotAllowed
+	}
+	return User{
+		Username:      username,
+		Role:          role,
+		Administrator: role == AdminRole,
+		Provider:      p.Name(),
+	}, nil
+}
+
+// bindService binds with the service account, the search is anonymous without one.
+func (p *LdapProvider) bindService(conn *LdapManager.Conn) error {
+	if p.Config.BindDN == "" {
+		return nil
+	}
+	if err := conn.Bind(p.Config.BindDN, p.Config.BindPassword); err != nil {
+		return fmt.Errorf("bind of the service account of %s: %s", p.Name(), err)
+	}
+	return nil
+}
+
+// getGroupRole returns the role of the first group of the configuration the user is member of. A group is
+// given by its DN or by the value of its first RDN, like admins for cn=admins,ou=groups, or by its name.
+func getGroupRole(c ConfigurationManager.AuthProviderConfig, groups []string) (string, bool) {
+	for _, g := range c.Groups {
+		for _, dn := range groups {
+			rdn := strings.SplitN(strings.SplitN(dn, ",", 2)[0], "=", 2)
+			if strings.EqualFold(dn, g.Group) || len(rdn) == 2 && strings.EqualFold(strings.TrimSpace(rdn[1]), g.Group) {
+				return g.Role, true
+			}
+		}
+	}
+	if c.RequireGroup {
+		return "", false
+	}
+	if c.DefaultRole != "" {
+		return c.DefaultRole, true
+	}
+	return UserRole, true
+}
+
+// loadProviders creates the providers of the configuration, after the local one.
+func loadProviders() {
+	providers = []Provider{JsonProvider{}}
+	for _, c := range ConfigurationManager.GetConfiguration().AuthProviders {
+		switch {
+		case c.Name == "" || c.Name == LocalProvider:
+			log.Fatalf("[ERROR] Authentication provider name missing or reserved ::> %s\n", c.Name)
+		case c.Type == LdapProviderType:
+			RegisterProvider(NewLdapProvider(c))
+		case c.Type == OpenIdProviderType:
+			RegisterProvider(NewOpenIdProvider(c))
+		default:
+			log.Fatalf("[ERROR] Unknown authentication provider type ::> %s\n", c.Type)
+		}
+	}
+	log.Printf("[INFO] %d authentication providers loaded\n", len(providers))
+}
+
+// RegisterProvider adds a provider, asked after the ones already registered.
+func RegisterProvider(p Provider) {
+	providers = append(providers, p)
+}
+
+func getProvider(name string) Provider {
+	for _, p := range providers {
+		if p.Name() == name {
+			return p
+		}
+	}
+	return nil
+}
+
+// GetUserProvider returns the name of the provider which authenticates the user.
+func GetUserProvider(user User) string {
+	if user.Provider == "" {
+		return LocalProvider
+	}
+	return user.Provider
+}
+
+// authenticate checks the password with the provider of the user. An unknown user is looked
+// for in the directories in their order, and added to the users on its first login.
+func authenticate(username string, password string) (User, error) {
+	if user, err := GetUserInfo(username); err == nil {
+		p := getProvider(GetUserProvider(user))
+		if p == nil {
+			return User{}, errors.New("unknown authentication provider " + user.Provider)
+		}
+		authenticated, err := p.Authenticate(username, password)
+		if err != nil {
+			return User{}, err
+		}
+		return syncUser(authenticated)
+	}
+	for _, p := range providers {
+		if p.Name() == LocalProvider {
+			continue
+		}
+		user, err := p.Authenticate(username, password)
+		if err == ErrUnknownUser {
+			continue
+		}
+		if err != nil {
+			return User{}, err
+		}
+		return syncUser(user)
+	}
+	return User{}, ErrUnknownUser
+}
+
+// syncUser saves the role given by the directory of a user, its other settings are kept.
+// The user must have been added by the same provider, for the same OpenID account.
+// The sessions of a user who lost permissions in the directory are closed.
+func syncUser(user User) (User, error) {
+	if GetUserProvider(user) == LocalProvider {
+		return user, nil
+	}
+	if !IsRole(user.Role) {
+		return User{}, errors.New("unknown role " + user.Role + " given by " + user.Provider)
+	}
+	usersMutex.Lock()
+	revoke := false
+	index := SliceIndex(len(users), func(i int) bool { return users[i].Username == user.Username })
+	if index == -1 {
+		users = append(users, user)
+		log.Printf("[INFO] User %s added from %s\n", user.Username, user.Provider)
+	} else {
+		previous := users[index]
+		if previous.Provider != user.Provider || previous.Issuer != user.Issuer || previous.Subject != user.Subject {
+			usersMutex.Unlock()
+			return User{}, fmt.Errorf("user %s is already managed by another account", user.Username)
+		}
+		if previous.Role == user.Role && previous.Administrator == user.Administrator {
+			usersMutex.Unlock()
+			return previous, nil
+		}
+		users[index].Role = user.Role
+		users[index].Administrator = user.Administrator
+		revoke = losesPermissions(previous, users[index])
+		user = users[index]
+	}
+	err := SaveUsersJsonFile()
+	usersMutex.Unlock()
+	if err != nil {
+		return User{}, err
+	}
+	if revoke {
+		if err := RevokeUserSessions(user.Username, ""); err != nil {
+			log.Printf("[ERROR] %s\n", err)
+		}
+	}
+	return user, nil
+}
@@ -0,0 +1,409 @@
+package authentication
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"openify/ConfigurationManager"
+	"openify/LdapManager"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// ber is a BER element read by the directory stub, with its children when it is constructed.
+type ber struct {
+	tag      byte
+	value    []byte
+	children []ber
+}
+
+func readBer(r io.Reader) (ber, error) {
+	head := make([]byte, 2)
+	if _, err := io.ReadFull(r, head); err != nil {
+		return ber{}, err
+	}
+	length := int(head[1])
+	if length&0x80 != 0 {
+		b := make([]byte, length&0x7f)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return ber{}, err
+		}
+		length = 0
+		for _, c := range b {
+			length = length<<8 | int(c)
+		}
+	}
+	e := ber{tag: head[0], value: make([]byte, length)}
+	if _, err := io.ReadFull(r, e.value); err != nil {
+		return ber{}, err
+	}
+	if e.tag&0x20 != 0 {
+		children := bytes.NewReader(e.value)
+		for children.Len() > 0 {
+			c, err := readBer(children)
+			if err != nil {
+				return ber{}, err
+			}
+			e.children = append(e.children, c)
+		}
+	}
+	return e, nil
+}
+
+func encodeBer(tag byte, value []byte) []byte {
+	switch {
+	case len(value) < 0x80:
+		return append([]byte{tag, byte(len(value))}, value...)
+	case len(value) < 0x100:
+		return append([]byte{tag, 0x81, byte(len(value))}, value...)
+	}
+	return append([]byte{tag, 0x82, byte(len(value) >> 8), byte(len(value))}, value...)
+}
+
+func encodeBerChildren(tag byte, children ...[]byte) []byte {
+	return encodeBer(tag, bytes.Join(children, nil))
+}
+
+func encodeBerResult(tag byte, code byte) []byte {
+	return encodeBerChildren(tag, encodeBer(0x0a, []byte{code}), encodeBer(0x04, nil), encodeBer(0x04, nil))
+}
+
+type ldapStubEntry struct {
+	dn         string
+	password   string
+	attributes map[string][]string
+}
+
+func (e ldapStubEntry) get(name string) []string {
+	for n, values := range e.attributes {
+		if strings.EqualFold(n, name) {
+			return values
+		}
+	}
+	return nil
+}
+
+// ldapStub is a directory in the process, reached through the Dial hook of the provider. It answers
+// the simple binds and the searches, and records the binds and the filters it receives.
+type ldapStub struct {
+	mutex   sync.Mutex
+	entries []ldapStubEntry
+	down    bool
+	binds   []string
+	filters []ber
+}
+
+func (s *ldapStub) dial(network string, address string, timeout time.Duration) (net.Conn, error) {
+	if s.down {
+		return nil, errors.New("connection refused")
+	}
+	client, server := net.Pipe()
+	go s.serve(server)
+	return client, nil
+}
+
+func (s *ldapStub) serve(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	bound := ""
+	for {
+		msg, err := readBer(r)
+		if err != nil || len(msg.children) < 2 {
+			return
+		}
+		id := encodeBer(0x02, msg.children[0].value)
+		reply := func(op []byte) {
+			_, _ = conn.Write(encodeBerChildren(0x30, id, op))
+		}
+		op := msg.children[1]
+		switch op.tag {
+		case 0x60:
+			dn, password := string(op.children[1].value), string(op.children[2].value)
+			s.mutex.Lock()
+			s.binds = append(s.binds, dn)
+			s.mutex.Unlock()
+			bound = ""
+			for _, e := range s.entries {
+				if e.dn == dn && e.password != "" && e.password == password {
+					bound = dn
+				}
+			}
+			if bound == "" {
+				reply(encodeBerResult(0x61, 49))
+			} else {
+				reply(encodeBerResult(0x61, 0))
+			}
+		case 0x63:
+			if bound == "" {
+				reply(encodeBerResult(0x65, 50))
+				continue
+			}
+			base, filter := strings.ToLower(string(op.children[0].value)), op.children[6]
+			s.mutex.Lock()
+			s.filters = append(s.filters, filter)
+			s.mutex.Unlock()
+			for _, e := range s.entries {
+				if !strings.HasSuffix(strings.ToLower(e.dn), ","+base) || !matchStubFilter(filter, e) {
+					continue
+				}
+				var attributes [][]byte
+				for _, a := range op.children[7].children {
+					var values [][]byte
+					for _, v := range e.get(string(a.value)) {
+						values = append(values, encodeBer(0x04, []byte(v)))
+					}
+					if len(values) > 0 {
+						attributes = append(attributes, encodeBerChildren(0x30, encodeBer(0x04, a.value), encodeBerChildren(0x31, values...)))
+					}
+				}
+				reply(encodeBerChildren(0x64, encodeBer(0x04, []byte(e.dn)), encodeBerChildren(0x30, attributes...)))
+			}
+			reply(encodeBerResult(0x65, 0))
+		case 0x42:
+			return
+		}
+	}
+}
+
+func matchStubFilter(f ber, e ldapStubEntry) bool {
+	switch f.tag {
+	case 0xa0:
+		for _, c := range f.children {
+			if !matchStubFilter(c, e) {
+				return false
+			}
+		}
+		return true
+	case 0xa1:
+		for _, c := range f.children {
+			if matchStubFilter(c, e) {
+				return true
+			}
+		}
+		return false
+	case 0xa2:
+		return !matchStubFilter(f.children[0], e)
+	case 0xa3:
+		for _, v := range e.get(string(f.children[0].value)) {
+			if strings.EqualFold(v, string(f.children[1].value)) {
+				return true
+			}
+		}
+	case 0x87:
+		return len(e.get(string(f.value))) > 0
+	case 0xa4:
+		for _, v := range e.get(string(f.children[0].value)) {
+			v, ok := strings.ToLower(v), true
+			for _, part := range f.children[1].children {
+				p := strings.ToLower(string(part.value))
+				switch part.tag {
+				case 0x80:
+					ok = ok && strings.HasPrefix(v, p)
+				case 0x81:
+					ok = ok && strings.Contains(v, p)
+				case 0x82:
+					ok = ok && strings.HasSuffix(v, p)
+				}
+			}
+			if ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+const testPeopleDN = "ou=people,dc=test"
+
+func newLdapStub() *ldapStub {
+	person := func(uid string, groups ...string) ldapStubEntry {
+		return ldapStubEntry{
+			dn:         "uid=" + uid + "," + testPeopleDN,
+			password:   uid + "-password",
+			attributes: map[string][]string{"objectClass": {"person"}, "uid": {uid}, "memberOf": groups},
+		}
+	}
+	return &ldapStub{entries: []ldapStubEntry{
+		{dn: "cn=service,dc=test", password: "service-password", attributes: map[string][]string{"cn": {"service"}}},
+		person("alice", "cn=admins,ou=groups,dc=test"),
+		person("carol"),
+		person("dave"),
+		person("bob", "cn=admins,ou=groups,dc=test"),
+		{dn: "cn=listeners,ou=groups,dc=test", attributes: map[string][]string{
+			"objectClass": {"groupOfNames"},
+			"cn":          {"listeners"},
+			"member":      {"uid=carol," + testPeopleDN},
+		}},
+	}}
+}
+
+func newTestLdapProvider(stub *ldapStub) *LdapProvider {
+	p := NewLdapProvider(ConfigurationManager.AuthProviderConfig{
+		Name:         "directory",
+		Type:         LdapProviderType,
+		Url:          "ldap://ldap.test",
+		BindDN:       "cn=service,dc=test",
+		BindPassword: "service-password",
+		BaseDN:       testPeopleDN,
+		UserFilter:   "(&(objectClass=person)(uid=%s))",
+		GroupBaseDN:  "ou=groups,dc=test",
+		GroupFilter:  "(&(objectClass=groupOfNames)(member=%s))",
+		Groups: []ConfigurationManager.GroupRoleConfig{
+			{Group: "admins", Role: AdminRole},
+			{Group: "cn=listeners,ou=groups,dc=test", Role: UserRole},
+		},
+		RequireGroup: true,
+	})
+	p.Dial = stub.dial
+	return p
+}
+
+func TestLdapAuthenticate(t *testing.T) {
+	stub := newLdapStub()
+	p := newTestLdapProvider(stub)
+	user, err := p.Authenticate("alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Username != "alice" || user.Role != AdminRole || !user.Administrator || user.Provider != "directory" {
+		t.Errorf("unexpected user %+v", user)
+	}
+	// The service account binds again to search the groups
+	if len(stub.binds) != 3 || stub.binds[0] != "cn=service,dc=test" || stub.binds[1] != "uid=alice,"+testPeopleDN {
+		t.Errorf("unexpected binds %v", stub.binds)
+	}
+	user, err = p.Authenticate("carol", "carol-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if user.Role != UserRole || user.Administrator {
+		t.Errorf("role %s from the group search, expected %s", user.Role, UserRole)
+	}
+	if _, err := p.Authenticate("dave", "dave-password"); err != ErrNotAllowed {
+		t.Errorf("user without group: %v, expected %v", err, ErrNotAllowed)
+	}
+	if _, err := p.Authenticate("alice", "wrong"); err != ErrInvalidPassword {
+		t.Errorf("wrong password: %v, expected %v", err, ErrInvalidPassword)
+	}
+	if _, err := p.Authenticate("nobody", "password"); err != ErrUnknownUser {
+		t.Errorf("unknown user: %v, expected %v", err, ErrUnknownUser)
+	}
+}
+
+func TestLdapEmptyPasswordIsNotBound(t *testing.T) {
+	stub := newLdapStub()
+	p := newTestLdapProvider(stub)
+	if _, err := p.Authenticate("alice", ""); err != ErrInvalidPassword {
+		t.Errorf("empty password: %v, expected %v", err, ErrInvalidPassword)
+	}
+	for _, dn := range stub.binds {
+		if dn != "cn=service,dc=test" {
+			t.Errorf("bind of %s with an empty password", dn)
+		}
+	}
+}
+
+func TestLdapUnavailable(t *testing.T) {
+	stub := newLdapStub()
+	p := newTestLdapProvider(stub)
+	p.Config.BindPassword = "wrong"
+	if _, err := p.Authenticate("alice", "alice-password"); err == nil || err == ErrUnknownUser || err == ErrInvalidPassword {
+		t.Errorf("wrong service password: %v", err)
+	}
+	stub.down = true
+	if _, err := p.Authenticate("alice", "alice-password"); err == nil || err == ErrUnknownUser {
+		t.Errorf("directory down: %v", err)
+	}
+}
+
+func TestLdapFilterEscaping(t *testing.T) {
+	if e := LdapManager.EscapeFilter("a*b(c)d\\e\x00"); e != `a\2ab\28c\29d\5ce\00` {
+		t.Errorf("escaped to %s", e)
+	}
+	for _, username := range []string{"*", "al*", "alice)(uid=*", "*)(|(uid=*", "alice\\"} {
+		stub := newLdapStub()
+		p := newTestLdapProvider(stub)
+		if _, err := p.Authenticate(username, "alice-password"); err != ErrUnknownUser {
+			t.Errorf("username %q: %v, expected %v", username, err, ErrUnknownUser)
+		}
+		if len(stub.filters) != 1 {
+			t.Fatalf("%d searches for %q", len(stub.filters), username)
+		}
+		f := stub.filters[0]
+		if f.tag != 0xa0 || len(f.children) != 2 || f.children[1].tag != 0xa3 || string(f.children[1].children[1].value) != username {
+			t.Errorf("username %q not searched as a value of uid", username)
+		}
+	}
+}
+
+func TestGetGroupRole(t *testing.T) {
+	c := ConfigurationManager.AuthProviderConfig{Groups: []ConfigurationManager.GroupRoleConfig{
+		{Group: "admins", Role: AdminRole},
+		{Group: "cn=curators,ou=groups,dc=test", Role: "curator"},
+	}}
+	tests := []struct {
+		groups []string
+		role   string
+		ok     bool
+	}{
+		{[]string{"cn=Admins,ou=groups,dc=test"}, AdminRole, true},
+		{[]string{"admins"}, AdminRole, true},
+		{[]string{"CN=curators,OU=groups,DC=test"}, "curator", true},
+		{[]string{"cn=curators,ou=groups,dc=test", "cn=admins,ou=groups,dc=test"}, AdminRole, true},
+		{[]string{"cn=admins-old,ou=groups,dc=test"}, UserRole, true},
+		{nil, UserRole, true},
+	}
+	for _, tt := range tests {
+		if role, ok := getGroupRole(c, tt.groups); role != tt.role || ok != tt.ok {
+			t.Errorf("groups %v: %s %v, expected %s %v", tt.groups, role, ok, tt.role, tt.ok)
+		}
+	}
+	c.DefaultRole = "listener"
+	if role, _ := getGroupRole(c, nil); role != "listener" {
+		t.Errorf("default role %s, expected listener", role)
+	}
+	c.RequireGroup = true
+	if _, ok := getGroupRole(c, []string{"cn=others,dc=test"}); ok {
+		t.Error("user without group allowed")
+	}
+}
+
+func TestAuthenticateWithProviders(t *testing.T) {
+	stub := newLdapStub()
+	password, err := bcrypt.GenerateFromPassword([]byte("local-password"), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	users = []User{{Username: "bob", Password: string(password), Role: UserRole}}
+	providers = []Provider{JsonProvider{}, newTestLdapProvider(stub)}
+	user, err := authenticate("alice", "alice-password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if saved, err := GetUserInfo("alice"); err != nil || saved.Provider != "directory" || saved.Role != AdminRole {
+		t.Errorf("directory user saved as %+v, %v", saved, err)
+	}
+	if user.Password != "" {
+		t.Error("password of a directory user saved")
+	}
+	if _, err := authenticate("bob", "bob-password"); err != ErrInvalidPassword {
+		t.Errorf("local user logged in by the directory: %v", err)
+	}
+	if _, err := authenticate("bob", "local-password"); err != nil {
+		t.Errorf("local user refused: %v", err)
+	}
+	stub.entries[1].attributes["memberOf"] = nil
+	stub.entries[len(stub.entries)-1].attributes["member"] = []string{"uid=alice," + testPeopleDN}
+	if user, err := authenticate("alice", "alice-password"); err != nil || user.Role != UserRole || user.Administrator {
+		t.Errorf("role not updated from the directory: %+v, %v", user, err)
+	}
+	if saved, _ := GetUserInfo("alice"); saved.Role != UserRole || saved.Administrator {
+		t.Errorf("updated role not saved: %+v", saved)
+	}
+}
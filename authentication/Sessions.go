@@ -0,0 +1,487 @@
+package authentication
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"openify/ConfigurationManager"
+	"openify/Response"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/dgrijalva/jwt-go"
+)
+
+const defaultAccessTokenMinutes = 15
+const defaultRefreshTokenDays = 30
+
+// The last use of a session is saved at most once in this delay.
+const lastSeenDelay = time.Minute
+
+// A session is opened by a login and holds the refresh token of the client, which changes on
+// every refresh. The access tokens carry the ID of their session and are valid only while it
+// exists, so revoking the session revokes its tokens at once.
+// RefreshToken and PreviousToken are SHA-256 hashes, the tokens themselves are never stored.
+// TokenId is the JWT ID of the last access token, Ip and UserAgent come from the last login or refresh.
+type Session struct {
+	Id            string    `json:"id"`
+	Username      string    `json:"username"`
+	TokenId       string    `json:"token-id"`
+	Device        string    `json:"device"`
+	UserAgent     string    `json:"user-agent"`
+	Ip            string    `json:"ip"`
+	RefreshToken  string    `json:"refresh-token"`
+	PreviousToken string    `json:"previous-token"`
+	Created       time.Time `json:"created"`
+	Refreshed     time.Time `json:"refreshed"`
+	LastSeen      time.Time `json:"last-seen"`
+	Expires       time.Time `json:"expires"`
+}
+
+type SessionInfo struct {
+	Id        string    `json:"id"`
+	Username  string    `json:"username"`
+	TokenId   string    `json:"token-id"`
+	Device    string    `json:"device"`
+	UserAgent string    `json:"user-agent"`
+	Ip        string    `json:"ip"`
+	Created   time.Time `json:"created"`
+	LastSeen  time.Time `json:"last-seen"`
+	Expires   time.Time `json:"expires"`
+	Current   bool      `json:"current"`
+}
+
+type SessionsList struct {
+	Sessions []SessionInfo `json:"sessions"`
+	Success  bool          `json:"success"`
+}
+
+type SessionsJsonConfig struct {
+	Sessions []Session `json:"sessions"`
+}
+
+type RefreshRequest struct {
+	RefreshToken string `json:"refresh-token"`
+}
+
+var sessionsMutex sync.Mutex
+var sessions = map[string]Session{}
+
+func GetSessionsFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().SessionsList, "sessions.json")
+}
+
+func loadSessions() {
+	path := GetSessionsFile()
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("[INFO] No sessions file found, it will be created ::> %s\n", path)
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read the sessions file ::> %s\n%s"+
+			"\nPlease insure that the file has the reading right", path, err)
+	}
+	var sc SessionsJsonConfig
+	err = json.Unmarshal(b, &sc)
+	if err != nil {
+		log.Fatalf("[ERROR] Sessions file incorrect ::> %s\n%s", path, err)
+	}
+	sessionsMutex.Lock()
+	for _, s := range sc.Sessions {
+		sessions[s.Id] = s
+	}
+	sessionsMutex.Unlock()
+	log.Printf("[INFO] %d sessions loaded\n", len(sc.Sessions))
+}
+
+// saveSessions must be called with the sessions mutex locked, it forgets the expired sessions.
+func saveSessions() error {
+	list := []Session{}
+	for id, s := range sessions {
+		if time.Now().After(s.Expires) {
+			delete(sessions, id)
+			continue
+		}
+		list = append(list, s)
+	}
+	b, err := json.Marshal(SessionsJsonConfig{Sessions: list})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetSessionsFile(), b, 0600)
+}
+
+func getAccessTokenLifetime() time.Duration {
+	if m := ConfigurationManager.GetConfiguration().Tokens.AccessTokenMinutes; m > 0 {
+		return time.Duration(m) * time.Minute
+	}
+	return defaultAccessTokenMinutes * time.Minute
+}
+
+func getRefreshTokenLifetime() time.Duration {
+	if d := ConfigurationManager.GetConfiguration().Tokens.RefreshTokenDays; d > 0 {
+		return time.Duration(d) * 24 * time.Hour
+	}
+	return defaultRefreshTokenDays * 24 * time.Hour
+}
+
+func newSecret() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	h := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(h[:])
+}
+
+// GetClientIp returns the address of the client, the last one added to X-Forwarded-For
+// when the server is configured to trust its proxy.
+func GetClientIp(r *http.Request) string {
+	if ConfigurationManager.GetConfiguration().LoginProtection.TrustForwardedFor {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if ip := strings.TrimSpace(forwarded[len(forwarded)-1]); ip != "" {
+			return ip
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// OpenSession creates a session for the user on a device and returns its first tokens.
+func OpenSession(username string, device string, r *http.Request) (Token, error) {
+	id, err := newSecret()
+	if err != nil {
+		return Token{}, err
+	}
+	now := time.Now()
+	s := Session{
+		Id:       id[:32],
+		Username: username,
+		Device:   device,
+		Created:  now,
+	}
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	return rotateSession(s, now, r)
+}
+
+// rotateSession must be called with the sessions mutex locked. It gives a new
+// refresh token to the session, saves it and signs a new access token.
+func rotateSession(s Session, now time.Time, r *http.Request) (Token, error) {
+	secret, err := newSecret()
+	if err != nil {
+		return Token{}, err
+	}
+	jti, err := newSecret()
+	if err != nil {
+		return Token{}, err
+	}
+	refreshToken := s.Id + "." + secret
+	s.PreviousToken = s.RefreshToken
+	s.RefreshToken = hashToken(refreshToken)
+	s.TokenId = jti[:32]
+	s.UserAgent = r.UserAgent()
+	s.Ip = GetClientIp(r)
+	s.Refreshed = now
+	s.LastSeen = now
+	s.Expires = now.Add(getRefreshTokenLifetime())
+	lifetime := getAccessTokenLifetime()
+	claims := &Claims{
+		Username:  s.Username,
+		SessionId: s.Id,
+		StandardClaims: jwt.StandardClaims{
+			Id:        s.TokenId,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(lifetime).Unix(),
+		},
+	}
+	accessToken, err := signToken(claims)
+	if err != nil {
+		return Token{}, err
+	}
+	sessions[s.Id] = s
+	if err := saveSessions(); err != nil {
+		return Token{}, err
+	}
+	return Token{
+		Token:        accessToken,
+		RefreshToken: refreshToken,
+		ExpiresIn:    int(lifetime.Seconds()),
+		Success:      true,
+	}, nil
+}
+
+// RefreshSession exchanges a refresh token for new tokens. A refresh token which was
+// already exchanged means it was stolen, the whole session is revoked.
+func RefreshSession(refreshToken string, r *http.Request) (Token, string, error) {
+	id := strings.SplitN(refreshToken, ".", 2)[0]
+	hash := hashToken(refreshToken)
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	s, ok := sessions[id]
+	if !ok || time.Now().After(s.Expires) {
+		return Token{}, "", errors.New("session not found or expired")
+	}
+	if s.PreviousToken != "" && hash == s.PreviousToken {
+		delete(sessions, id)
+		_ = saveSessions()
+		return Token{}, s.Username, errors.New("refresh token reused, the session is revoked")
+	}
+	if hash != s.RefreshToken {
+		return Token{}, s.Username, errors.New("invalid refresh token")
+	}
+	if _, err := GetUserInfo(s.Username); err != nil {
+		return Token{}, s.Username, err
+	}
+	t, err := rotateSession(s, time.Now(), r)
+	return t, s.Username, err
+}
+
+// RevokeSession closes a session, its tokens stop working immediately.
+func RevokeSession(id string) error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if _, ok := sessions[id]; !ok {
+		return errors.New("session not found")
+	}
+	delete(sessions, id)
+	return saveSessions()
+}
+
+// RevokeUserSessions closes every session of the user but the one given by except.
+func RevokeUserSessions(username string, except string) error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	for id, s := range sessions {
+		if s.Username == username && id != except {
+			delete(sessions, id)
+		}
+	}
+	return saveSessions()
+}
+
+// RevokeUserSession closes a session of the user.
+func RevokeUserSession(username string, id string) error {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	if s, ok := sessions[id]; !ok || s.Username != username {
+		return errors.New("session not found")
+	}
+	delete(sessions, id)
+	return saveSessions()
+}
+
+// GetSessions returns the open sessions of the user, the last used first.
+func GetSessions(username string) []Session {
+	sessionsMutex.Lock()
+	result := []Session{}
+	for _, s := range sessions {
+		if s.Username == username && time.Now().Before(s.Expires) {
+			result = append(result, s)
+		}
+	}
+	sessionsMutex.Unlock()
+	sort.Slice(result, func(i, j int) bool { return result[i].LastSeen.After(result[j].LastSeen) })
+	return result
+}
+
+// useSession tells if the session is open and remembers that it was used.
+func useSession(id string, username string) bool {
+	sessionsMutex.Lock()
+	defer sessionsMutex.Unlock()
+	s, ok := sessions[id]
+	if !ok || s.Username != username || time.Now().After(s.Expires) {
+		return false
+	}
+	if time.Since(s.LastSeen) > lastSeenDelay {
+		s.LastSeen = time.Now()
+		sessions[id] = s
+		if err := saveSessions(); err != nil {
+			log.Printf("[ERROR] %s\n", err)
+		}
+	}
+	return true
+}
+
+// parseToken checks the signature and the expiration of an access token, and that its session is still open.
+// The API keys are accepted as well.
+func parseToken(t string) (*Claims, error) {
+	if isApiKey(t) {
+		return parseApiKey(t)
+	}
+	var c Claims
+	token, err := jwt.ParseWithClaims(t, &c, getVerificationKey)
+	if err != nil {
+		return nil, err
+	}
+	if !token.Valid {
+		return nil, errors.New("invalid token")
+	}
+	if !useSession(c.SessionId, c.Username) {
+		return nil, errors.New("the session of the token is closed")
+	}
+	return &c, nil
+}
+
+func RefreshToken(w http.ResponseWriter, r *http.Request) {
+	var rr RefreshRequest
+	err := json.NewDecoder(r.Body).Decode(&rr)
+	if err != nil || rr.RefreshToken == "" {
+		SendError(w, r, "Refresh token missing")
+		return
+	}
+	t, username, err := RefreshSession(rr.RefreshToken, r)
+	if err != nil {
+		log.Printf("[WARN][%s] Refresh failed for user %s: %s\n", r.RemoteAddr, username, err)
+		SendUnauthorized(w, r)
+		return
+	}
+	b, err := json.Marshal(t)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
+
+// Logout closes the session of the access token, or of the refresh token given
+// in the body when the access token already expired.
+func Logout(w http.ResponseWriter, r *http.Request) {
+	var id, username string
+	if t, err := GetToken(r); err == nil {
+		if c, err := parseToken(t); err == nil {
+			id, username = c.SessionId, c.Username
+		}
+	}
+	if id == "" {
+		var rr RefreshRequest
+		if err := json.NewDecoder(r.Body).Decode(&rr); err == nil && rr.RefreshToken != "" {
+			id = strings.SplitN(rr.RefreshToken, ".", 2)[0]
+			sessionsMutex.Lock()
+			s, ok := sessions[id]
+			sessionsMutex.Unlock()
+			if !ok || s.RefreshToken != hashToken(rr.RefreshToken) {
+				id = ""
+			}
+			username = s.Username
+		}
+	}
+	if id == "" {
+		SendUnauthorized(w, r)
+		return
+	}
+	if err := RevokeSession(id); err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] Logout of user %s\n", r.RemoteAddr, username)
+	SendSuccess(w, r, "Logged out!")
+}
+
+// getSessionsRequest returns the logged user, the claims of its token and the user whose
+// sessions are managed: the u parameter needs manage-sessions.
+func getSessionsRequest(r *http.Request) (User, *Claims, string, error) {
+	t, err := getAccountToken(r)
+	if err != nil {
+		return User{}, nil, "", err
+	}
+	c, err := parseToken(t)
+	if err != nil {
+		return User{}, nil, "", err
+	}
+	user, err := GetLoggedUser(t)
+	if err != nil {
+		return User{}, nil, "", err
+	}
+	username := r.URL.Query().Get("u")
+	if username == "" || username == user.Username {
+		return user, c, user.Username, nil
+	}
+	if !HasPermission(user, PermManageSessions) {
+		return user, c, "", errors.New("You are not allowed to do that")
+	}
+	return user, c, username, nil
+}
+
+func GetSessionsHandler(w http.ResponseWriter, r *http.Request) {
+	user, c, username, err := getSessionsRequest(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	list := SessionsList{
+		Sessions: []SessionInfo{},
+		Success:  true,
+	}
+	for _, s := range GetSessions(username) {
+		list.Sessions = append(list.Sessions, SessionInfo{
+			Id:        s.Id,
+			Username:  s.Username,
+			TokenId:   s.TokenId,
+			Device:    s.Device,
+			UserAgent: s.UserAgent,
+			Ip:        s.Ip,
+			Created:   s.Created,
+			LastSeen:  s.LastSeen,
+			Expires:   s.Expires,
+			Current:   s.Id == c.SessionId,
+		})
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Sessions of %s for %s\n", r.RemoteAddr, username, user.Username)
+	Response.SendJson(w, r, b)
+}
+
+// RevokeSessionHandler closes the session given by id, or every other session and the signed links of the user with all=true.
+func RevokeSessionHandler(w http.ResponseWriter, r *http.Request) {
+	user, c, username, err := getSessionsRequest(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	if q.Get("all") == "true" {
+		err = RevokeUserSessions(username, c.SessionId)
+		if err == nil {
+			err = RotateLinkNonce(username)
+		}
+	} else if q.Get("id") != "" {
+		err = RevokeUserSession(username, q.Get("id"))
+	} else {
+		SendError(w, r, "Session ID missing")
+		return
+	}
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Sessions of %s revoked by %s\n", username, user.Username)
+	SendSuccess(w, r, "Session revoked!")
+}
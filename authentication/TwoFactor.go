@@ -0,0 +1,650 @@
+package authentication
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"openify/ConfigurationManager"
+	"openify/Response"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The codes are the RFC 6238 defaults understood by every authenticator application.
+const totpPeriod = 30
+const totpDigits = 6
+
+// A code of the previous or the next period is accepted, for the clocks which drift.
+const totpSkew = 1
+
+const recoveryCodesCount = 10
+const defaultIssuer = "Openify"
+
+// The second step of a login has to be done within this delay, and fails after too many wrong codes.
+const challengeLifetime = 5 * time.Minute
+const maxChallengeAttempts = 5
+
+var base32NoPadding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// The secret is kept disabled until the user confirms a first code. The recovery codes
+// are SHA-256 hashes and can be used once each. LastStep is the period of the last code
+// accepted, so a code cannot be replayed.
+type TwoFactor struct {
+	Username      string    `json:"username"`
+	Secret        string    `json:"secret"`
+	Enabled       bool      `json:"enabled"`
+	RecoveryCodes []string  `json:"recovery-codes"`
+	LastStep      int64     `json:"last-step"`
+	Enrolled      time.Time `json:"enrolled"`
+}
+
+type TwoFactorJsonConfig struct {
+	TwoFactors []TwoFactor `json:"two-factors"`
+}
+
+type TwoFactorStatus struct {
+	Enabled       bool `json:"enabled"`
+	Required      bool `json:"required"`
+	RecoveryCodes int  `json:"recovery-codes"`
+	Success       bool `json:"success"`
+}
+
+type TwoFactorEnrollment struct {
+	Secret  string `json:"secret"`
+	Uri     string `json:"uri"`
+	Success bool   `json:"success"`
+}
+
+type RecoveryCodes struct {
+	RecoveryCodes []string `json:"recovery-codes"`
+	Success       bool     `json:"success"`
+}
+
+// TwoFactorChallenge is sent by the login in place of the token when a code is needed.
+// When the user has to enroll, it holds the secret to confirm with the first code.
+type TwoFactorChallenge struct {
+	TwoFactor          bool   `json:"two-factor"`
+	Challenge          string `json:"challenge"`
+	ExpiresIn          int    `json:"expires-in"`
+	EnrollmentRequired bool   `json:"enrollment-required"`
+	Secret             string `json:"secret,omitempty"`
+	Uri                string `json:"uri,omitempty"`
+	Success            bool   `json:"success"`
+}
+
+type TwoFactorLogin struct {
+	Challenge string `json:"challenge"`
+	Code      string `json:"code"`
+}
+
+type TwoFactorCode struct {
+	Code string `json:"code"`
+}
+
+type challenge struct {
+	username string
+	device   string
+	enroll   bool
+	attempts int
+	expires  time.Time
+}
+
+var twoFactorsMutex sync.Mutex
+var twoFactors = map[string]TwoFactor{}
+
+var challengesMutex sync.Mutex
+var challenges = map[string]*challenge{}
+
+func GetTwoFactorFile() string {
+	return ConfigurationManager.GetDataFile(ConfigurationManager.GetConfiguration().TwoFactorList, "two-factor.json")
+}
+
+func loadTwoFactors() {
+	path := GetTwoFactorFile()
+	if _, err := os.Stat(path); err != nil {
+		log.Printf("[INFO] No two-factor file found, it will be created ::> %s\n", path)
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		log.Fatalf("[ERROR] Unable to read the two-factor file ::> %s\n%s"+
+			"\nPlease insure that the file has the reading right", path, err)
+	}
+	var tc TwoFactorJsonConfig
+	err = json.Unmarshal(b, &tc)
+	if err != nil {
+		log.Fatalf("[ERROR] Two-factor file incorrect ::> %s\n%s", path, err)
+	}
+	twoFactorsMutex.Lock()
+	for _, t := range tc.TwoFactors {
+		twoFactors[t.Username] = t
+	}
+	twoFactorsMutex.Unlock()
+	log.Printf("[INFO] %d two-factor secrets loaded\n", len(tc.TwoFactors))
+}
+
+// saveTwoFactors must be called with the two-factor mutex locked.
+func saveTwoFactors() error {
+	list := []TwoFactor{}
+	for _, t := range twoFactors {
+		list = append(list, t)
+	}
+	b, err := json.Marshal(TwoFactorJsonConfig{TwoFactors: list})
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(GetTwoFactorFile(), b, 0600)
+}
+
+func getIssuer() string {
+	if issuer := ConfigurationManager.GetConfiguration().TwoFactor.Issuer; issuer != "" {
+		return issuer
+	}
+	return defaultIssuer
+}
+
+// IsTwoFactorEnabled tells if the user confirmed a secret.
+func IsTwoFactorEnabled(username string) bool {
+	twoFactorsMutex.Lock()
+	defer twoFactorsMutex.Unlock()
+	return twoFactors[username].Enabled
+}
+
+// IsTwoFactorRequired tells if the user cannot log in with a password alone,
+// the administrators when the configuration requires it.
+func IsTwoFactorRequired(user User) bool {
+	return user.Administrator && ConfigurationManager.GetConfiguration().TwoFactor.RequiredForAdministrators
+}
+
+// getTotp returns the code of a base32 secret for a period, as described by RFC 4226 and RFC 6238.
+func getTotp(secret string, step int64) (string, error) {
+	key, err := base32NoPadding.DecodeString(strings.ToUpper(secret))
+	if err != nil {
+		return "", err
+	}
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint64(msg, uint64(step))
+	mac := hmac.New(sha1.New, key)
+	mac.Write(msg)
+	sum := mac.Sum(nil)
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	code := strconv.FormatUint(uint64(value%uint32(math.Pow10(totpDigits))), 10)
+	return strings.Repeat("0", totpDigits-len(code)) + code, nil
+}
+
+// checkTotp returns the period of the code when it is valid for the secret and newer than lastStep.
+func checkTotp(secret string, code string, lastStep int64) (int64, bool) {
+	code = strings.Replace(code, " ", "", -1)
+	if len(code) != totpDigits {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for step := now - totpSkew; step <= now+totpSkew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		expected, err := getTotp(secret, step)
+		if err != nil {
+			return 0, false
+		}
+		if hmac.Equal([]byte(expected), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+func normalizeRecoveryCode(code string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(code))
+}
+
+func newRecoveryCodes() ([]string, []string, error) {
+	var codes, hashes []string
+	for i := 0; i < recoveryCodesCount; i++ {
+		b := make([]byte, 7)
+		if _, err := rand.Read(b); err != nil {
+			return nil, nil, err
+		}
+		code := strings.ToLower(base32NoPadding.EncodeToString(b))[:10]
+		codes = append(codes, code[:5]+"-"+code[5:])
+		hashes = append(hashes, hashToken(code))
+	}
+	return codes, hashes, nil
+}
+
+func getOtpAuthUri(username string, secret string) string {
+	issuer := getIssuer()
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	v.Set("algorithm", "SHA1")
+	v.Set("digits", strconv.Itoa(totpDigits))
+	v.Set("period", strconv.Itoa(totpPeriod))
+	return "otpauth://totp/" + url.PathEscape(issuer+":"+username) + "?" + v.Encode()
+}
+
+// EnrollTwoFactor gives a new secret to the user, enabled once a first code is confirmed.
+func EnrollTwoFactor(username string) (TwoFactorEnrollment, error) {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+	secret := base32NoPadding.EncodeToString(b)
+	twoFactorsMutex.Lock()
+	defer twoFactorsMutex.Unlock()
+	if twoFactors[username].Enabled {
+		return TwoFactorEnrollment{}, errors.New("two-factor authentication is already enabled")
+	}
+	twoFactors[username] = TwoFactor{Username: username, Secret: secret}
+	if err := saveTwoFactors(); err != nil {
+		return TwoFactorEnrollment{}, err
+	}
+	return TwoFactorEnrollment{
+		Secret:  secret,
+		Uri:     getOtpAuthUri(username, secret),
+		Success: true,
+	}, nil
+}
+
+// ConfirmTwoFactor enables the secret of the user when the code is valid and returns its recovery codes.
+func ConfirmTwoFactor(username string, code string) ([]string, error) {
+	twoFactorsMutex.Lock()
+	defer twoFactorsMutex.Unlock()
+	t, ok := twoFactors[username]
+	if !ok || t.Enabled {
+		return nil, errors.New("no two-factor enrollment in progress")
+	}
+	step, ok := checkTotp(t.Secret, code, t.LastStep)
+	if !ok {
+		return nil, errors.New("invalid code")
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	t.Enabled = true
+	t.LastStep = step
+	t.RecoveryCodes = hashes
+	t.Enrolled = time.Now()
+	twoFactors[username] = t
+	return codes, saveTwoFactors()
+}
+
+// VerifyTwoFactor checks a code of the authenticator or a recovery code, which is then used up.
+func VerifyTwoFactor(username string, code string) bool {
+	twoFactorsMutex.Lock()
+	defer twoFactorsMutex.Unlock()
+	t, ok := twoFactors[username]
+	if !ok || !t.Enabled {
+		return false
+	}
+	if step, ok := checkTotp(t.Secret, code, t.LastStep); ok {
+		t.LastStep = step
+	} else {
+		hash := hashToken(normalizeRecoveryCode(code))
+		index := -1
+		for i, h := range t.RecoveryCodes {
+			if hmac.Equal([]byte(h), []byte(hash)) {
+				index = i
+			}
+		}
+		if index == -1 {
+			return false
+		}
+		t.RecoveryCodes = append(t.RecoveryCodes[:index:index], t.RecoveryCodes[index+1:]...)
+		log.Printf("[INFO] Recovery code used by %s, %d left\n", username, len(t.RecoveryCodes))
+	}
+	twoFactors[username] = t
+	if err := saveTwoFactors(); err != nil {
+		log.Printf("[ERROR] %s\n", err)
+	}
+	return true
+}
+
+// RegenerateRecoveryCodes replaces the recovery codes of the user.
+func RegenerateRecoveryCodes(username string) ([]string, error) {
+	twoFactorsMutex.Lock()
+	defer twoFactorsMutex.Unlock()
+	t, ok := twoFactors[username]
+	if !ok || !t.Enabled {
+		return nil, errors.New("two-factor authentication is not enabled")
+	}
+	codes, hashes, err := newRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+	t.RecoveryCodes = hashes
+	twoFactors[username] = t
+	return codes, saveTwoFactors()
+}
+
+func DisableTwoFactor(username string) error {
+	twoFactorsMutex.Lock()
+	defer twoFactorsMutex.Unlock()
+	if _, ok := twoFactors[username]; !ok {
+		return nil
+	}
+	delete(twoFactors, username)
+	return saveTwoFactors()
+}
+
+// newChallenge starts the second step of the login of a user whose password was checked.
+func newChallenge(username string, device string, enroll bool) (string, error) {
+	id, err := newSecret()
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	challengesMutex.Lock()
+	defer challengesMutex.Unlock()
+	for key, c := range challenges {
+		if now.After(c.expires) {
+			delete(challenges, key)
+		}
+	}
+	challenges[id] = &challenge{username: username, device: device, enroll: enroll, expires: now.Add(challengeLifetime)}
+	return id, nil
+}
+
+// useChallenge returns the challenge while it is valid, each call counts as an attempt.
+func useChallenge(id string) (challenge, bool) {
+	challengesMutex.Lock()
+	defer challengesMutex.Unlock()
+	c, ok := challenges[id]
+	if !ok || time.Now().After(c.expires) {
+		delete(challenges, id)
+		return challenge{}, false
+	}
+	c.attempts++
+	if c.attempts >= maxChallengeAttempts {
+		delete(challenges, id)
+	}
+	return *c, true
+}
+
+func closeChallenge(id string) {
+	challengesMutex.Lock()
+	delete(challenges, id)
+	challengesMutex.Unlock()
+}
+
+// sendChallenge answers a login with a checked password when the user has to give a code,
+// or has to enroll because two-factor authentication is required.
+func sendChallenge(w http.ResponseWriter, r *http.Request, user User, device string) {
+	res := TwoFactorChallenge{
+		TwoFactor: true,
+		ExpiresIn: int(challengeLifetime.Seconds()),
+		Success:   true,
+	}
+	if !IsTwoFactorEnabled(user.Username) {
+		enrollment, err := EnrollTwoFactor(user.Username)
+		if err != nil {
+			log.Printf("[ERROR] %s\n", err)
+			SendError(w, r, err.Error())
+			return
+		}
+		res.EnrollmentRequired = true
+		res.Secret = enrollment.Secret
+		res.Uri = enrollment.Uri
+	}
+	id, err := newChallenge(user.Username, device, res.EnrollmentRequired)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	res.Challenge = id
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] Two-factor code asked to user %s\n", r.RemoteAddr, user.Username)
+	Response.SendJson(w, r, b)
+}
+
+// LoginTwoFactor is the second step of a login: the challenge given by Login and a code of the
+// authenticator or a recovery code are exchanged for the tokens. When the user was enrolling,
+// the code confirms the secret and the recovery codes come with the tokens.
+func LoginTwoFactor(w http.ResponseWriter, r *http.Request) {
+	var tl TwoFactorLogin
+	err := json.NewDecoder(r.Body).Decode(&tl)
+	if err != nil || tl.Challenge == "" || tl.Code == "" {
+		SendError(w, r, "Challenge or code missing")
+		return
+	}
+	c, ok := useChallenge(tl.Challenge)
+	if !ok {
+		SendUnauthorized(w, r)
+		return
+	}
+	ip := GetClientIp(r)
+	if wait := beginLogin(ip, c.username); wait > 0 {
+		log.Printf("[WARN][AUTH] Login blocked for user %q from %s\n", c.username, ip)
+		SendTooManyRequests(w, r, "Too many failed logins, try again later", int(math.Ceil(wait.Seconds())))
+		return
+	}
+	var codes []string
+	if c.enroll {
+		codes, err = ConfirmTwoFactor(c.username, tl.Code)
+		ok = err == nil
+	} else {
+		ok = VerifyTwoFactor(c.username, tl.Code)
+	}
+	if !ok {
+		loginFailed(ip, c.username)
+		log.Printf("[WARN][AUTH] Login failed for user %q from %s\n", c.username, ip)
+		SendUnauthorized(w, r)
+		return
+	}
+	closeChallenge(tl.Challenge)
+	loginSucceeded(ip, c.username)
+	res, err := OpenSession(c.username, c.device, r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	res.RecoveryCodes = codes
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] Login successful for user %s\n", r.RemoteAddr, c.username)
+	Response.SendJson(w, r, b)
+}
+
+func GetTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	twoFactorsMutex.Lock()
+	t := twoFactors[user.Username]
+	twoFactorsMutex.Unlock()
+	status := TwoFactorStatus{
+		Enabled:  t.Enabled,
+		Required: IsTwoFactorRequired(user),
+		Success:  true,
+	}
+	if t.Enabled {
+		status.RecoveryCodes = len(t.RecoveryCodes)
+	}
+	b, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
+
+// EnrollTwoFactorHandler returns a new secret and its otpauth URI, to confirm with ConfirmTwoFactorHandler.
+func EnrollTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := getAccountUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	enrollment, err := EnrollTwoFactor(user.Username)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	b, err := json.Marshal(enrollment)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Two-factor enrollment started by %s\n", user.Username)
+	Response.SendJson(w, r, b)
+}
+
+// ConfirmTwoFactorHandler enables the two-factor authentication and returns the recovery codes.
+// The other sessions of the user, opened with the password alone, are closed.
+func ConfirmTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	t, err := getAccountToken(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	c, err := parseToken(t)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	var tc TwoFactorCode
+	err = json.NewDecoder(r.Body).Decode(&tc)
+	if err != nil || tc.Code == "" {
+		SendError(w, r, "Code missing")
+		return
+	}
+	codes, err := ConfirmTwoFactor(c.Username, tc.Code)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	if err := RevokeUserSessions(c.Username, c.SessionId); err != nil {
+		log.Printf("[ERROR] %s\n", err)
+	}
+	b, err := json.Marshal(RecoveryCodes{
+		RecoveryCodes: codes,
+		Success:       true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Two-factor authentication enabled by %s\n", c.Username)
+	Response.SendJson(w, r, b)
+}
+
+// RecoveryCodesHandler replaces the recovery codes, a code of the authenticator is asked.
+func RecoveryCodesHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := getAccountUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	var tc TwoFactorCode
+	err = json.NewDecoder(r.Body).Decode(&tc)
+	if err != nil || tc.Code == "" {
+		SendError(w, r, "Code missing")
+		return
+	}
+	if !VerifyTwoFactor(user.Username, tc.Code) {
+		SendError(w, r, "Invalid code")
+		return
+	}
+	codes, err := RegenerateRecoveryCodes(user.Username)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	b, err := json.Marshal(RecoveryCodes{
+		RecoveryCodes: codes,
+		Success:       true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Recovery codes renewed by %s\n", user.Username)
+	Response.SendJson(w, r, b)
+}
+
+// DisableTwoFactorHandler turns off the two-factor authentication of the user, who gives a code
+// or a recovery code. The users managers can reset the one of another user with the u parameter.
+func DisableTwoFactorHandler(w http.ResponseWriter, r *http.Request) {
+	user, err := getAccountUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	username := r.URL.Query().Get("u")
+	if username != "" && username != user.Username {
+		if !HasPermission(user, PermManageUsers) {
+			log.Printf("[ERROR] Missing right for %s to disable the two-factor authentication of %s\n", user.Username, username)
+			SendError(w, r, "You are not allowed to do that")
+			return
+		}
+		if _, err := GetUserInfo(username); err != nil {
+			SendError(w, r, "User does not exist")
+			return
+		}
+	} else {
+		username = user.Username
+		if IsTwoFactorRequired(user) {
+			SendError(w, r, "Two-factor authentication is required for the administrators")
+			return
+		}
+		var tc TwoFactorCode
+		if IsTwoFactorEnabled(username) {
+			err = json.NewDecoder(r.Body).Decode(&tc)
+			if err != nil || tc.Code == "" {
+				SendError(w, r, "Code missing")
+				return
+			}
+			if !VerifyTwoFactor(username, tc.Code) {
+				SendError(w, r, "Invalid code")
+				return
+			}
+		}
+	}
+	if err := DisableTwoFactor(username); err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Two-factor authentication of %s disabled by %s\n", username, user.Username)
+	SendSuccess(w, r, "Two-factor authentication disabled!")
+}
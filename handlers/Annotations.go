@@ -0,0 +1,149 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"openify/AnnotationsManager"
+	"openify/Authentication"
+	"openify/Response"
+	"strconv"
+)
+
+type AnnotationResponse struct {
+	Annotation AnnotationsManager.Annotation `json:"annotation"`
+	Success    bool                          `json:"success"`
+}
+
+type StarredList struct {
+	Starred []AnnotationsManager.Annotation `json:"starred"`
+	Success bool                            `json:"success"`
+}
+
+// The annotated item is the file Id, its album or its artist depending on Type.
+// An artist can also be given by name.
+type EditedAnnotation struct {
+	Type          string `json:"type"`
+	Id            int    `json:"id"`
+	Artist        string `json:"artist"`
+	Starred       bool   `json:"starred"`
+	Rating        int    `json:"rating"`
+	Note          string `json:"note"`
+	StarredEdited bool   `json:"starred-edited"`
+	RatingEdited  bool   `json:"rating-edited"`
+	NoteEdited    bool   `json:"note-edited"`
+}
+
+func GetAnnotationTarget(user authentication.User, kind string, id int, artist string) (AnnotationsManager.Annotation, error) {
+	if kind == AnnotationsManager.ArtistAnnotation && artist != "" {
+		return AnnotationsManager.NewArtistAnnotation(artist), nil
+	}
+	t, err := GetUserTrack(user, id)
+	if err != nil {
+		return AnnotationsManager.Annotation{}, err
+	}
+	return AnnotationsManager.NewAnnotation(kind, t)
+}
+
+func SendAnnotation(w http.ResponseWriter, r *http.Request, a AnnotationsManager.Annotation) {
+	b, err := json.Marshal(AnnotationResponse{
+		Annotation: a,
+		Success:    true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
+
+func GetAnnotation(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	id := -1
+	if q.Get("id") != "" {
+		id, err = strconv.Atoi(q.Get("id"))
+		if err != nil {
+			authentication.SendError(w, r, "file ID is NaN")
+			return
+		}
+	}
+	target, err := GetAnnotationTarget(user, q.Get("type"), id, q.Get("artist"))
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Annotation of %s %s\n", r.RemoteAddr, target.Type, target.Name)
+	SendAnnotation(w, r, AnnotationsManager.GetAnnotation(user.Username, target))
+}
+
+func UpdateAnnotation(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	ea := EditedAnnotation{Id: -1}
+	err = json.NewDecoder(r.Body).Decode(&ea)
+	if err != nil {
+		authentication.SendError(w, r, "Annotation information missing (type, id)")
+		return
+	}
+	target, err := GetAnnotationTarget(user, ea.Type, ea.Id, ea.Artist)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	a, err := AnnotationsManager.EditAnnotation(user.Username, target, func(a *AnnotationsManager.Annotation) error {
+		if ea.StarredEdited {
+			AnnotationsManager.SetStarred(a, ea.Starred)
+		}
+		if ea.RatingEdited {
+			a.Rating = ea.Rating
+		}
+		if ea.NoteEdited {
+			a.Note = ea.Note
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Annotation of %s %s updated by %s\n", a.Type, a.Name, user.Username)
+	SendAnnotation(w, r, a)
+}
+
+func GetStarred(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	kind := r.URL.Query().Get("type")
+	if kind != "" && kind != AnnotationsManager.TrackAnnotation &&
+		kind != AnnotationsManager.AlbumAnnotation && kind != AnnotationsManager.ArtistAnnotation {
+		authentication.SendError(w, r, "Unknown annotation type, expected track, album or artist")
+		return
+	}
+	b, err := json.Marshal(StarredList{
+		Starred: AnnotationsManager.GetStarred(user.Username, kind),
+		Success: true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Starred items of %s\n", r.RemoteAddr, user.Username)
+	Response.SendJson(w, r, b)
+}
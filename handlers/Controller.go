@@ -5,13 +5,18 @@ import (
 	"errors"
 	"fmt"
 	"log"
+	"mime"
 	"net/http"
 	"openify/ConfigurationManager"
+	"openify/HistoryManager"
+	"openify/PlaylistsManager"
 	"openify/Response"
+	"openify/StreamManager"
 	"os"
 	"path/filepath"
 	"runtime"
 	"strconv"
+	"strings"
 
 	"openify/Authentication"
 	"openify/FilesManager"
@@ -20,17 +25,44 @@ import (
 )
 
 type Metadata struct {
-	Title       string `json:"title"`
-	Album       string `json:"album"`
-	Artist      string `json:"artist"`
-	AlbumArtist string `json:"album-artist"`
-	Composer    string `json:"composer"`
-	Year        int    `json:"year"`
-	Genre       string `json:"genre"`
-	Comment     string `json:"comment"`
-	Codec       string `json:"codec"`
-	Filename    string `json:"filename"`
-	Success     bool   `json:"success"`
+	Title       string                     `json:"title"`
+	Album       string                     `json:"album"`
+	Artist      string                     `json:"artist"`
+	AlbumArtist string                     `json:"album-artist"`
+	Composer    string                     `json:"composer"`
+	Year        int                        `json:"year"`
+	Genre       string                     `json:"genre"`
+	Comment     string                     `json:"comment"`
+	Codec       string                     `json:"codec"`
+	Filename    string                     `json:"filename"`
+	Playback    FilesManager.PlaybackHints `json:"playback"`
+	Lyrics      bool                       `json:"lyrics"`
+	Success     bool                       `json:"success"`
+}
+
+type LyricsResponse struct {
+	FilesManager.Lyrics
+	Success bool `json:"success"`
+}
+
+type AlbumTrack struct {
+	Id       int                        `json:"id"`
+	Title    string                     `json:"title"`
+	Artist   string                     `json:"artist"`
+	Track    int                        `json:"track"`
+	Disc     int                        `json:"disc"`
+	Filename string                     `json:"filename"`
+	Playback FilesManager.PlaybackHints `json:"playback"`
+}
+
+type Album struct {
+	Name        string       `json:"name"`
+	AlbumArtist string       `json:"album-artist"`
+	Year        int          `json:"year"`
+	AlbumGain   *float64     `json:"album-gain,omitempty"`
+	AlbumPeak   *float64     `json:"album-peak,omitempty"`
+	Tracks      []AlbumTrack `json:"tracks"`
+	Success     bool         `json:"success"`
 }
 
 type Version struct {
@@ -55,7 +87,17 @@ var version = Version{
 }
 
 func GetFilesList(w http.ResponseWriter, r *http.Request) {
-	b, err := json.Marshal(FilesManager.GetRoot())
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	root := FilesManager.GetRoot()
+	if authentication.IsRestricted(user) {
+		root = FilesManager.GetFilteredRoot(authentication.NewAccessChecker(user))
+	}
+	b, err := json.Marshal(root)
 	if err != nil {
 		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
 		authentication.SendError(w, r, err.Error())
@@ -65,45 +107,102 @@ func GetFilesList(w http.ResponseWriter, r *http.Request) {
 	Response.SendJson(w, r, b)
 }
 
-func GetFilePathFromID(r *http.Request) (string, error) {
+func GetFileIDFromRequest(r *http.Request) (int, error) {
 	ids, ok := r.URL.Query()["id"]
 	if !ok || len(ids[0]) < 1 {
-		return "", errors.New("file ID missing")
+		return 0, errors.New("file ID missing")
 	}
 	id, err := strconv.Atoi(ids[0])
 	if err != nil {
-		return "", errors.New("file ID is NaN")
+		return 0, errors.New("file ID is NaN")
 	}
-	path, err := FilesManager.GetPathById(id)
+	return id, nil
+}
+
+// GetFilePathFromID returns the absolute path of the requested file when the user can access it.
+func GetFilePathFromID(r *http.Request, user authentication.User) (string, error) {
+	id, err := GetFileIDFromRequest(r)
+	if err != nil {
+		return "", err
+	}
+	t, err := GetUserTrack(user, id)
 	if err != nil {
-		return "", errors.New("file ID is not found")
+		return "", err
 	}
-	return path, nil
+	return FilesManager.GetAbsolutePath(t.Path), nil
 }
 
-func GetFile(w http.ResponseWriter, r *http.Request) {
-	tokens, ok := r.URL.Query()["t"]
-	if !ok || len(tokens[0]) < 1 {
-		authentication.SendUnauthorized(w, r)
-		return
+// GetUserTrack returns a file of the library, the files hidden to the user are not found.
+func GetUserTrack(user authentication.User, id int) (FilesManager.Track, error) {
+	t, err := FilesManager.GetTrack(id)
+	if err != nil || !authentication.CanAccess(user, t.Path) {
+		return FilesManager.Track{}, errors.New("file ID is not found")
 	}
-	token:= tokens[0]
-	if authentication.IsLogged(token) {
-		path, err := GetFilePathFromID(r)
+	return t, nil
+}
+
+// FilterUserTracks removes the files hidden to the user.
+func FilterUserTracks(user authentication.User, tracks []FilesManager.Track) []FilesManager.Track {
+	if !authentication.IsRestricted(user) {
+		return tracks
+	}
+	canAccess := authentication.NewAccessChecker(user)
+	var result []FilesManager.Track
+	for _, t := range tracks {
+		if canAccess(t.Path) {
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// GetFile streams a file, or sends it as an attachment with download=true.
+func GetFile(w http.ResponseWriter, r *http.Request) {
+	user, err := GetFileUser(r)
+	if err == nil {
+		path, err := GetFilePathFromID(r, user)
 		if err != nil {
 			log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
 			authentication.SendError(w, r, err.Error())
 			return
 		}
+		permission := authentication.PermStream
+		if r.URL.Query().Get("download") == "true" {
+			permission = authentication.PermDownload
+			w.Header().Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filepath.Base(path)}))
+		}
+		if !authentication.HasPermission(user, permission) {
+			log.Printf("[ERROR] Missing right for %s to %s\n", user.Username, permission)
+			authentication.SendError(w, r, "You are not allowed to do that")
+			return
+		}
+		if !StreamManager.Acquire(user.Username) {
+			log.Printf("[WARN][%s] Too many concurrent streams for user %s\n", r.RemoteAddr, user.Username)
+			authentication.SendTooManyRequests(w, r, "Too many concurrent streams", StreamManager.GetRetryAfter())
+			return
+		}
+		defer StreamManager.Release(user.Username)
 		log.Printf("[INFO][SERVING][%s] <-- %s\n", r.RemoteAddr, path)
-		http.ServeFile(w, r, path)
+		tw := StreamManager.NewThrottledWriter(w, user.Username)
+		http.ServeFile(tw, r, path)
+		id, _ := GetFileIDFromRequest(r)
+		if t, err := FilesManager.GetTrack(id); err == nil {
+			rg := r.Header.Get("Range")
+			HistoryManager.RecordStream(user.Username, t, tw.Written(), rg == "" || strings.HasPrefix(rg, "bytes=0-"))
+		}
 	} else {
 		authentication.SendUnauthorized(w, r)
 	}
 }
 
 func GetMetaData(w http.ResponseWriter, r *http.Request) {
-	path, err := GetFilePathFromID(r)
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	path, err := GetFilePathFromID(r, user)
 	if err != nil {
 		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
 		authentication.SendError(w, r, err.Error())
@@ -125,6 +224,11 @@ func GetMetaData(w http.ResponseWriter, r *http.Request) {
 	} else {
 		metaDataResult = ToOpenifyMetadata(m, filepath.Base(path))
 	}
+	id, _ := GetFileIDFromRequest(r)
+	if t, err := FilesManager.GetTrack(id); err == nil {
+		metaDataResult.Playback = t.Playback
+		metaDataResult.Lyrics = t.HasLyrics
+	}
 	b, err := json.Marshal(metaDataResult)
 	if err != nil {
 		log.Printf("[ERROR] %s\n", err)
@@ -135,6 +239,92 @@ func GetMetaData(w http.ResponseWriter, r *http.Request) {
 	Response.SendJson(w, r, b)
 }
 
+func GetLyrics(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	id, err := GetFileIDFromRequest(r)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	t, err := GetUserTrack(user, id)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, "file ID is not found")
+		return
+	}
+	b, err := json.Marshal(LyricsResponse{
+		Lyrics:  FilesManager.ReadLyrics(t.Path),
+		Success: true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Lyrics\n", r.RemoteAddr)
+	Response.SendJson(w, r, b)
+}
+
+func GetAlbum(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	id, err := GetFileIDFromRequest(r)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	t, err := GetUserTrack(user, id)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, "file ID is not found")
+		return
+	}
+	album := Album{
+		Name:        t.Album,
+		AlbumArtist: t.AlbumArtist,
+		Year:        t.Year,
+		Tracks:      []AlbumTrack{},
+		Success:     true,
+	}
+	if album.AlbumArtist == "" {
+		album.AlbumArtist = t.Artist
+	}
+	for _, at := range FilterUserTracks(user, FilesManager.GetAlbumTracks(t)) {
+		if album.AlbumGain == nil {
+			album.AlbumGain = at.Playback.AlbumGain
+			album.AlbumPeak = at.Playback.AlbumPeak
+		}
+		album.Tracks = append(album.Tracks, AlbumTrack{
+			Id:       at.Id,
+			Title:    at.Title,
+			Artist:   at.Artist,
+			Track:    at.TrackNumber,
+			Disc:     at.DiscNumber,
+			Filename: filepath.Base(at.Path),
+			Playback: at.Playback,
+		})
+	}
+	b, err := json.Marshal(album)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Album\n", r.RemoteAddr)
+	Response.SendJson(w, r, b)
+}
+
 func ToOpenifyMetadata(md tag.Metadata, fn string) Metadata {
 	return Metadata{
 		Title:       md.Title(),
@@ -165,6 +355,7 @@ func GetControllerVersion(w http.ResponseWriter, r *http.Request) {
 func ReScanFolder(w http.ResponseWriter, r *http.Request) {
 	config := ConfigurationManager.GetConfiguration()
 	FilesManager.ScanFolder(config.DocumentRoot)
+	PlaylistsManager.ImportLibraryPlaylists()
 	GetFilesList(w, r)
 }
 
@@ -188,12 +379,31 @@ func About(w http.ResponseWriter, r *http.Request) {
 	Response.SendJson(w, r, b)
 }
 
+// PermissionMiddleware lets only the users having the permission reach the handler, it follows AuthMiddleware.
+func PermissionMiddleware(permission string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, err := authentication.GetRequestUser(r)
+		if err != nil {
+			authentication.SendUnauthorized(w, r)
+			return
+		}
+		if !authentication.HasPermission(user, permission) {
+			log.Printf("[ERROR][%s] Missing right for %s to %s\n", r.RemoteAddr, user.Username, permission)
+			authentication.SendError(w, r, "You are not allowed to do that")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func AuthMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		header:= r.Header.Get("authorization")
-		if len(header) > 7 {
-			token:= header[7:]
+		token, err := authentication.GetToken(r)
+		if err == nil {
 			if authentication.IsLogged(token) {
+				if name, username, ok := authentication.GetApiKeyName(token); ok {
+					log.Printf("[INFO][%s] <--  %s with API key %s of %s\n", r.RemoteAddr, r.URL.Path, name, username)
+				}
 				next.ServeHTTP(w, r)
 			} else {
 				authentication.SendUnauthorized(w, r)
@@ -210,17 +420,81 @@ func HandleRequests() {
 
 	mux:= http.NewServeMux()
 	mux.HandleFunc("/api/login", authentication.Login)
+	mux.HandleFunc("/api/login/two-factor", authentication.LoginTwoFactor)
+	mux.HandleFunc("/api/oidc/login", OpenIdLogin)
+	mux.HandleFunc("/api/oidc/callback", OpenIdCallback)
+	mux.HandleFunc("/.well-known/jwks.json", authentication.GetJwksHandler)
+	mux.HandleFunc("/api/logout", authentication.Logout)
+	mux.HandleFunc("/api/token/refresh", authentication.RefreshToken)
+	mux.Handle("/api/session/list", AuthMiddleware(http.HandlerFunc(authentication.GetSessionsHandler)))
+	mux.Handle("/api/session/revoke", AuthMiddleware(http.HandlerFunc(authentication.RevokeSessionHandler)))
+	mux.Handle("/api/api-key/create", AuthMiddleware(http.HandlerFunc(authentication.CreateApiKeyHandler)))
+	mux.Handle("/api/api-key/list", AuthMiddleware(http.HandlerFunc(authentication.GetApiKeysHandler)))
+	mux.Handle("/api/api-key/revoke", AuthMiddleware(http.HandlerFunc(authentication.RevokeApiKeyHandler)))
+	mux.Handle("/api/two-factor", AuthMiddleware(http.HandlerFunc(authentication.GetTwoFactorHandler)))
+	mux.Handle("/api/two-factor/enroll", AuthMiddleware(http.HandlerFunc(authentication.EnrollTwoFactorHandler)))
+	mux.Handle("/api/two-factor/confirm", AuthMiddleware(http.HandlerFunc(authentication.ConfirmTwoFactorHandler)))
+	mux.Handle("/api/two-factor/recovery-codes", AuthMiddleware(http.HandlerFunc(authentication.RecoveryCodesHandler)))
+	mux.Handle("/api/two-factor/disable", AuthMiddleware(http.HandlerFunc(authentication.DisableTwoFactorHandler)))
+	mux.Handle("/api/system/lockout/list", AuthMiddleware(PermissionMiddleware(authentication.PermManageUsers, http.HandlerFunc(authentication.GetLockoutsHandler))))
+	mux.Handle("/api/system/lockout/clear", AuthMiddleware(PermissionMiddleware(authentication.PermManageUsers, http.HandlerFunc(authentication.ClearLockoutHandler))))
+	mux.Handle("/api/system/jwt/rotate", AuthMiddleware(PermissionMiddleware(authentication.PermManageKeys, http.HandlerFunc(authentication.RotateKeysHandler))))
 	mux.HandleFunc("/api/get/file", GetFile)
+	mux.HandleFunc("/api/get/cover", GetCover)
+	mux.HandleFunc("/api/feed", GetFeed)
+	mux.Handle("/api/feed/create", AuthMiddleware(http.HandlerFunc(CreateFeed)))
 	mux.Handle("/api/list/files", AuthMiddleware(http.HandlerFunc(GetFilesList)))
 	mux.Handle("/api/get/metadata", AuthMiddleware(http.HandlerFunc(GetMetaData)))
+	mux.Handle("/api/get/album", AuthMiddleware(http.HandlerFunc(GetAlbum)))
+	mux.Handle("/api/get/lyrics", AuthMiddleware(http.HandlerFunc(GetLyrics)))
 	mux.Handle("/api/system/server/about", AuthMiddleware(http.HandlerFunc(About)))
-	mux.Handle("/api/system/files/scan", AuthMiddleware(http.HandlerFunc(ReScanFolder)))
-	mux.Handle("/api/system/user/register", AuthMiddleware(http.HandlerFunc(authentication.Register)))
+	mux.Handle("/api/system/files/scan", AuthMiddleware(PermissionMiddleware(authentication.PermScan, http.HandlerFunc(ReScanFolder))))
+	mux.Handle("/api/system/user/register", AuthMiddleware(PermissionMiddleware(authentication.PermManageUsers, http.HandlerFunc(authentication.Register))))
+	mux.Handle("/api/system/role/list", AuthMiddleware(http.HandlerFunc(authentication.GetRolesHandler)))
 	mux.HandleFunc("/api/system/controller/version", GetControllerVersion)
-	mux.Handle("/api/system/user/list", AuthMiddleware(http.HandlerFunc(authentication.GetListUsers)))
-	mux.Handle("/api/system/user/get", AuthMiddleware(http.HandlerFunc(authentication.GetUserInfoHandler)))
+	mux.Handle("/api/playlist/list", AuthMiddleware(http.HandlerFunc(GetPlaylists)))
+	mux.Handle("/api/playlist/get", AuthMiddleware(http.HandlerFunc(GetPlaylist)))
+	mux.Handle("/api/playlist/create", AuthMiddleware(http.HandlerFunc(CreatePlaylist)))
+	mux.Handle("/api/playlist/update", AuthMiddleware(http.HandlerFunc(UpdatePlaylist)))
+	mux.Handle("/api/playlist/remove", AuthMiddleware(http.HandlerFunc(RemovePlaylist)))
+	mux.Handle("/api/playlist/items/add", AuthMiddleware(EditPlaylistItems(AddToPlaylist)))
+	mux.Handle("/api/playlist/items/remove", AuthMiddleware(EditPlaylistItems(RemoveFromPlaylist)))
+	mux.Handle("/api/playlist/items/move", AuthMiddleware(EditPlaylistItems(MoveInPlaylist)))
+	mux.Handle("/api/playlist/export", AuthMiddleware(http.HandlerFunc(ExportPlaylist)))
+	mux.Handle("/api/radio/list", AuthMiddleware(http.HandlerFunc(GetRadioChannels)))
+	mux.HandleFunc("/api/radio/stream", StreamRadio)
+	mux.Handle("/api/history/now-playing", AuthMiddleware(http.HandlerFunc(GetNowPlaying)))
+	mux.Handle("/api/history/now-playing/update", AuthMiddleware(http.HandlerFunc(SetNowPlaying)))
+	mux.Handle("/api/history/scrobble", AuthMiddleware(http.HandlerFunc(Scrobble)))
+	mux.Handle("/api/history/recent", AuthMiddleware(http.HandlerFunc(GetRecentPlays)))
+	mux.Handle("/api/history/count", AuthMiddleware(http.HandlerFunc(GetPlayCount)))
+	mux.Handle("/api/queue", AuthMiddleware(http.HandlerFunc(PlayQueue)))
+	mux.Handle("/api/bookmark/list", AuthMiddleware(http.HandlerFunc(GetBookmarks)))
+	mux.Handle("/api/bookmark/update", AuthMiddleware(http.HandlerFunc(UpdateBookmark)))
+	mux.Handle("/api/bookmark/remove", AuthMiddleware(http.HandlerFunc(RemoveBookmark)))
+	mux.Handle("/api/share/create", AuthMiddleware(http.HandlerFunc(CreateShare)))
+	mux.Handle("/api/share/list", AuthMiddleware(http.HandlerFunc(GetShares)))
+	mux.Handle("/api/share/remove", AuthMiddleware(http.HandlerFunc(RemoveShare)))
+	mux.HandleFunc("/api/public/share", GetPublicShare)
+	mux.HandleFunc("/api/public/share/stream", StreamPublicShare)
+	mux.Handle("/api/recommend/random", AuthMiddleware(http.HandlerFunc(GetRandomTracks)))
+	mux.Handle("/api/recommend/radio", AuthMiddleware(http.HandlerFunc(GetRadio)))
+	mux.Handle("/api/recommend/album-artist", AuthMiddleware(http.HandlerFunc(GetMoreFromAlbumArtist)))
+	mux.Handle("/api/stats/top", AuthMiddleware(http.HandlerFunc(GetTopStats)))
+	mux.Handle("/api/stats/daily", AuthMiddleware(http.HandlerFunc(GetDailyStats)))
+	mux.Handle("/api/stats/new-artists", AuthMiddleware(http.HandlerFunc(GetNewArtistsStats)))
+	mux.Handle("/api/stats/review", AuthMiddleware(http.HandlerFunc(GetReview)))
+	mux.Handle("/api/system/stats/dashboard", AuthMiddleware(PermissionMiddleware(authentication.PermViewStats, http.HandlerFunc(GetDashboard))))
+	mux.Handle("/api/annotation/get", AuthMiddleware(http.HandlerFunc(GetAnnotation)))
+	mux.Handle("/api/annotation/update", AuthMiddleware(http.HandlerFunc(UpdateAnnotation)))
+	mux.Handle("/api/annotation/starred", AuthMiddleware(http.HandlerFunc(GetStarred)))
+	mux.Handle("/api/scrobbler/list", AuthMiddleware(http.HandlerFunc(GetScrobblers)))
+	mux.Handle("/api/scrobbler/update", AuthMiddleware(http.HandlerFunc(UpdateScrobbler)))
+	mux.Handle("/api/scrobbler/remove", AuthMiddleware(http.HandlerFunc(RemoveScrobbler)))
+	mux.Handle("/api/system/user/list", AuthMiddleware(PermissionMiddleware(authentication.PermViewUsers, http.HandlerFunc(authentication.GetListUsers))))
+	mux.Handle("/api/system/user/get", AuthMiddleware(PermissionMiddleware(authentication.PermViewUsers, http.HandlerFunc(authentication.GetUserInfoHandler))))
 	mux.Handle("/api/system/user/me", AuthMiddleware(http.HandlerFunc(authentication.GetLoggedUserHandler)))
-	mux.Handle("/api/system/user/remove", AuthMiddleware(http.HandlerFunc(authentication.RemoveUser)))
+	mux.Handle("/api/system/user/remove", AuthMiddleware(PermissionMiddleware(authentication.PermManageUsers, http.HandlerFunc(authentication.RemoveUser))))
 	mux.Handle("/api/system/user/update", AuthMiddleware(http.HandlerFunc(authentication.UpdateUser)))
 
 	err := http.ListenAndServe(fmt.Sprintf(":%s", config.Port), mux)
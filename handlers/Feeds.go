@@ -0,0 +1,320 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"openify/Authentication"
+	"openify/ConfigurationManager"
+	"openify/FilesManager"
+	"openify/Response"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type FeedLink struct {
+	Url     string `json:"url"`
+	Success bool   `json:"success"`
+}
+
+type Rss struct {
+	XMLName xml.Name   `xml:"rss"`
+	Version string     `xml:"version,attr"`
+	Itunes  string     `xml:"xmlns:itunes,attr"`
+	Channel RssChannel `xml:"channel"`
+}
+
+type RssChannel struct {
+	Title        string       `xml:"title"`
+	Link         string       `xml:"link"`
+	Description  string       `xml:"description"`
+	Generator    string       `xml:"generator"`
+	ItunesAuthor string       `xml:"itunes:author,omitempty"`
+	ItunesType   string       `xml:"itunes:type"`
+	ItunesImage  *ItunesImage `xml:"itunes:image,omitempty"`
+	Items        []RssItem    `xml:"item"`
+}
+
+type RssItem struct {
+	Title          string       `xml:"title"`
+	Guid           RssGuid      `xml:"guid"`
+	PubDate        string       `xml:"pubDate"`
+	Enclosure      RssEnclosure `xml:"enclosure"`
+	ItunesDuration string       `xml:"itunes:duration,omitempty"`
+	ItunesEpisode  int          `xml:"itunes:episode"`
+	ItunesAuthor   string       `xml:"itunes:author,omitempty"`
+	ItunesImage    *ItunesImage `xml:"itunes:image,omitempty"`
+}
+
+type RssGuid struct {
+	IsPermaLink bool   `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type RssEnclosure struct {
+	Url    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type ItunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+// GetBaseURL returns the URL used to reach the server, the PublicURL of the configuration
+// has to be set when the server is behind a proxy which does not forward the host.
+func GetBaseURL(r *http.Request) string {
+	if u := ConfigurationManager.GetConfiguration().PublicURL; u != "" {
+		return strings.TrimSuffix(u, "/")
+	}
+	scheme := "http"
+	if r.TLS != nil || r.Header.Get("X-Forwarded-Proto") == "https" {
+		scheme = "https"
+	}
+	return fmt.Sprintf("%s://%s", scheme, r.Host)
+}
+
+func GetFeedFolderFromRequest(r *http.Request) (string, error) {
+	folders, ok := r.URL.Query()["feed"]
+	if !ok || len(folders[0]) < 1 {
+		return "", errors.New("feed folder missing")
+	}
+	folder := strings.Trim(filepath.ToSlash(folders[0]), "/")
+	for _, part := range strings.Split(folder, "/") {
+		if part == ".." {
+			return "", errors.New("feed folder is invalid")
+		}
+	}
+	return folder, nil
+}
+
+// GetFeedQuery returns the parameters of a feed link, it is revoked with the other links of the user.
+func GetFeedQuery(user authentication.User, folder string) url.Values {
+	q := url.Values{}
+	q.Set("u", user.Username)
+	q.Set("feed", folder)
+	q.Set("s", authentication.SignUserValue(user, "feed:"+user.Username+":"+folder))
+	return q
+}
+
+// GetFeedUser checks the signature of a feed link and returns the user who created it.
+func GetFeedUser(r *http.Request) (authentication.User, string, error) {
+	folder, err := GetFeedFolderFromRequest(r)
+	if err != nil {
+		return authentication.User{}, "", err
+	}
+	q := r.URL.Query()
+	user, err := authentication.GetUserInfo(q.Get("u"))
+	if err != nil {
+		return authentication.User{}, "", errors.New("invalid feed signature")
+	}
+	if !authentication.IsValidUserSignature(user, "feed:"+user.Username+":"+folder, q.Get("s")) {
+		return authentication.User{}, "", errors.New("invalid feed signature")
+	}
+	return user, folder, nil
+}
+
+// GetFileUser returns the user of a request on a file, authenticated either
+// with a token or with a signed feed or playlist link. The signed links only
+// give access to the files of their feed or playlist.
+func GetFileUser(r *http.Request) (authentication.User, error) {
+	if _, ok := r.URL.Query()["playlist"]; ok {
+		return GetPlaylistLinkUser(r)
+	}
+	if _, ok := r.URL.Query()["feed"]; !ok {
+		return GetStreamUser(r)
+	}
+	user, folder, err := GetFeedUser(r)
+	if err != nil {
+		return authentication.User{}, err
+	}
+	id, err := GetFileIDFromRequest(r)
+	if err != nil {
+		return authentication.User{}, err
+	}
+	t, err := FilesManager.GetTrack(id)
+	if err != nil || (folder != "" && !strings.HasPrefix(filepath.ToSlash(t.Path), folder+"/")) {
+		return authentication.User{}, errors.New("file is not part of the feed")
+	}
+	return user, nil
+}
+
+func CreateFeed(w http.ResponseWriter, r *http.Request) {
+	t, err := authentication.GetToken(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	user, err := authentication.GetLoggedUser(t)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	folder, err := GetFeedFolderFromRequest(r)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	if len(FilterUserTracks(user, FilesManager.GetFolderTracks(folder))) == 0 {
+		authentication.SendError(w, r, "Folder does not exist or is empty")
+		return
+	}
+	link := FeedLink{
+		Url:     fmt.Sprintf("%s/api/feed?%s", GetBaseURL(r), GetFeedQuery(user, folder).Encode()),
+		Success: true,
+	}
+	b, err := json.Marshal(link)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Feed link for %s\n", r.RemoteAddr, folder)
+	Response.SendJson(w, r, b)
+}
+
+func GetFeed(w http.ResponseWriter, r *http.Request) {
+	user, folder, err := GetFeedUser(r)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendUnauthorized(w, r)
+		return
+	}
+	tracks := SortFeedTracks(FilterUserTracks(user, FilesManager.GetFolderTracks(folder)))
+	if len(tracks) == 0 {
+		authentication.SendError(w, r, "Folder does not exist or is empty")
+		return
+	}
+	base := GetBaseURL(r)
+	query := GetFeedQuery(user, folder).Encode()
+	feed := Rss{
+		Version: "2.0",
+		Itunes:  "http://www.itunes.com/dtds/podcast-1.0.dtd",
+		Channel: RssChannel{
+			Title:       filepath.Base(folder),
+			Link:        base,
+			Description: fmt.Sprintf("%s, served by Openify", folder),
+			Generator:   fmt.Sprintf("Openify Server %s", ConfigurationManager.GetVersion()),
+			ItunesType:  "serial",
+		},
+	}
+	if folder == "" {
+		feed.Channel.Title = "Openify"
+	}
+	first := tracks[0]
+	if first.Album != "" {
+		feed.Channel.Title = first.Album
+	}
+	feed.Channel.ItunesAuthor = first.AlbumArtist
+	if feed.Channel.ItunesAuthor == "" {
+		feed.Channel.ItunesAuthor = first.Artist
+	}
+	feed.Channel.ItunesImage = &ItunesImage{Href: fmt.Sprintf("%s/api/get/cover?id=%d&%s", base, first.Id, query)}
+
+	// The podcast applications sort the episodes by date,
+	// so the dates follow the order of the tracks.
+	published := first.Modified
+	for _, t := range tracks {
+		if t.Modified.Before(published) {
+			published = t.Modified
+		}
+	}
+	for i, t := range tracks {
+		title := t.Title
+		if title == "" {
+			title = strings.TrimSuffix(filepath.Base(t.Path), filepath.Ext(t.Path))
+		}
+		feed.Channel.Items = append(feed.Channel.Items, RssItem{
+			Title: title,
+			Guid: RssGuid{
+				IsPermaLink: false,
+				Value:       authentication.SignValue("guid:" + t.Path),
+			},
+			PubDate: published.Add(time.Duration(i) * time.Minute).UTC().Format(time.RFC1123Z),
+			Enclosure: RssEnclosure{
+				Url:    fmt.Sprintf("%s/api/get/file?id=%d&%s", base, t.Id, query),
+				Length: t.Size,
+				Type:   FilesManager.GetMimeType(t.Path),
+			},
+			ItunesDuration: FormatDuration(t.Duration),
+			ItunesEpisode:  i + 1,
+			ItunesAuthor:   t.Artist,
+			ItunesImage:    &ItunesImage{Href: fmt.Sprintf("%s/api/get/cover?id=%d&%s", base, t.Id, query)},
+		})
+	}
+	b, err := xml.MarshalIndent(feed, "", "  ")
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Feed %s\n", r.RemoteAddr, folder)
+	w.Header().Add("Content-Type", "application/rss+xml; charset=utf-8")
+	_, err = w.Write(append([]byte(xml.Header), b...))
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+	}
+}
+
+// SortFeedTracks orders the tracks by disc and track number, then by file name.
+func SortFeedTracks(tracks []FilesManager.Track) []FilesManager.Track {
+	sort.SliceStable(tracks, func(i, j int) bool {
+		if tracks[i].DiscNumber != tracks[j].DiscNumber {
+			return tracks[i].DiscNumber < tracks[j].DiscNumber
+		}
+		if tracks[i].TrackNumber != tracks[j].TrackNumber {
+			return tracks[i].TrackNumber < tracks[j].TrackNumber
+		}
+		return tracks[i].Path < tracks[j].Path
+	})
+	return tracks
+}
+
+// FormatDuration formats milliseconds as HH:MM:SS
+func FormatDuration(ms int) string {
+	if ms <= 0 {
+		return ""
+	}
+	s := ms / 1000
+	return fmt.Sprintf("%02d:%02d:%02d", s/3600, s/60%60, s%60)
+}
+
+func GetCover(w http.ResponseWriter, r *http.Request) {
+	user, err := GetFileUser(r)
+	if err != nil {
+		authentication.SendUnauthorized(w, r)
+		return
+	}
+	id, err := GetFileIDFromRequest(r)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	t, err := GetUserTrack(user, id)
+	if err != nil {
+		authentication.SendError(w, r, "file ID is not found")
+		return
+	}
+	p, err := FilesManager.ReadPicture(t.Path)
+	if err != nil {
+		log.Printf("[WARN][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, "No cover found")
+		return
+	}
+	w.Header().Add("Content-Type", p.MIMEType)
+	w.Header().Add("Content-Length", strconv.Itoa(len(p.Data)))
+	w.Header().Add("Cache-Control", "max-age=86400")
+	_, err = w.Write(p.Data)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+	}
+}
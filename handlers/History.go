@@ -0,0 +1,212 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"openify/Authentication"
+	"openify/FilesManager"
+	"openify/HistoryManager"
+	"openify/Response"
+	"strconv"
+	"time"
+)
+
+const defaultRecentPlays = 50
+
+// Time is a unix timestamp in seconds, the current time is used when it is 0.
+type PlayRequest struct {
+	Id     int    `json:"id"`
+	Time   int64  `json:"time"`
+	Player string `json:"player"`
+}
+
+type NowPlayingList struct {
+	Entries []HistoryManager.NowPlaying `json:"entries"`
+	Success bool                        `json:"success"`
+}
+
+type PlaysList struct {
+	Plays   []HistoryManager.Play `json:"plays"`
+	Success bool                  `json:"success"`
+}
+
+type ScrobbleResponse struct {
+	Recorded bool `json:"recorded"`
+	Success  bool `json:"success"`
+}
+
+type PlayCountResponse struct {
+	Id int `json:"id"`
+	HistoryManager.PlayCount
+	Success bool `json:"success"`
+}
+
+// GetHistoryUsername returns the user whose history is requested,
+// the users with view-stats can read the history of the other users.
+func GetHistoryUsername(r *http.Request, user authentication.User) (string, bool) {
+	username := r.URL.Query().Get("user")
+	if username == "" || username == user.Username {
+		return user.Username, true
+	}
+	return username, authentication.HasPermission(user, authentication.PermViewStats)
+}
+
+func readPlayRequest(w http.ResponseWriter, r *http.Request) (authentication.User, PlayRequest, FilesManager.Track, bool) {
+	var pr PlayRequest
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return user, pr, FilesManager.Track{}, false
+	}
+	err = json.NewDecoder(r.Body).Decode(&pr)
+	if err != nil {
+		authentication.SendError(w, r, "Play information missing (id)")
+		return user, pr, FilesManager.Track{}, false
+	}
+	t, err := GetUserTrack(user, pr.Id)
+	if err != nil {
+		authentication.SendError(w, r, "file ID is not found")
+		return user, pr, t, false
+	}
+	return user, pr, t, true
+}
+
+func SetNowPlaying(w http.ResponseWriter, r *http.Request) {
+	user, pr, t, ok := readPlayRequest(w, r)
+	if !ok {
+		return
+	}
+	HistoryManager.SetNowPlaying(user.Username, t, pr.Player)
+	log.Printf("[INFO][%s] %s is playing %s\n", r.RemoteAddr, user.Username, t.Path)
+	authentication.SendSuccess(w, r, "Now playing updated!")
+}
+
+// GetNowPlaying lists what the users are listening to, only the users with view-stats see the other users.
+func GetNowPlaying(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	list := NowPlayingList{
+		Entries: []HistoryManager.NowPlaying{},
+		Success: true,
+	}
+	for _, np := range HistoryManager.GetNowPlaying() {
+		if authentication.HasPermission(user, authentication.PermViewStats) || np.Username == user.Username {
+			list.Entries = append(list.Entries, np)
+		}
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Now playing\n", r.RemoteAddr)
+	Response.SendJson(w, r, b)
+}
+
+func Scrobble(w http.ResponseWriter, r *http.Request) {
+	user, pr, t, ok := readPlayRequest(w, r)
+	if !ok {
+		return
+	}
+	at := time.Now()
+	if pr.Time > 0 {
+		at = time.Unix(pr.Time, 0)
+		if at.After(time.Now().Add(time.Minute)) {
+			authentication.SendError(w, r, "The time of the play is in the future")
+			return
+		}
+	}
+	recorded, err := HistoryManager.Record(user.Username, t, at, "scrobble")
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	b, err := json.Marshal(ScrobbleResponse{
+		Recorded: recorded,
+		Success:  true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] %s played %s\n", r.RemoteAddr, user.Username, t.Path)
+	Response.SendJson(w, r, b)
+}
+
+func GetRecentPlays(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	username, ok := GetHistoryUsername(r, user)
+	if !ok {
+		authentication.SendError(w, r, "You are not allowed to do that")
+		return
+	}
+	limit := defaultRecentPlays
+	if l := r.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil {
+			authentication.SendError(w, r, "limit is NaN")
+			return
+		}
+	}
+	b, err := json.Marshal(PlaysList{
+		Plays:   HistoryManager.GetRecentPlays(username, limit),
+		Success: true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Recent plays of %s\n", r.RemoteAddr, username)
+	Response.SendJson(w, r, b)
+}
+
+func GetPlayCount(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	username, ok := GetHistoryUsername(r, user)
+	if !ok {
+		authentication.SendError(w, r, "You are not allowed to do that")
+		return
+	}
+	id, err := GetFileIDFromRequest(r)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	t, err := GetUserTrack(user, id)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	b, err := json.Marshal(PlayCountResponse{
+		Id:        id,
+		PlayCount: HistoryManager.GetPlayCount(username, t.Path),
+		Success:   true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Play count of %s\n", r.RemoteAddr, t.Path)
+	Response.SendJson(w, r, b)
+}
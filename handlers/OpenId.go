@@ -0,0 +1,73 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"net/url"
+	"openify/Authentication"
+	"openify/Response"
+	"strconv"
+)
+
+// OpenIdLogin sends the browser to the identity provider. The provider parameter chooses it when
+// several are configured, redirect is where the tokens are given after the login and device names
+// the session, like the device of Login.
+func OpenIdLogin(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	u, state, err := authentication.BeginOpenIdLogin(q.Get("provider"), GetBaseURL(r)+"/api/oidc/callback", q.Get("redirect"), q.Get("device"))
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	authentication.SetOpenIdStateCookie(w, r, state)
+	http.Redirect(w, r, u, http.StatusFound)
+}
+
+// OpenIdCallback opens the session of the user coming back from the identity provider. When the
+// login was started with a redirect, the browser is sent there with the tokens in the fragment of
+// the URL, which is not sent to the servers. The tokens are sent as JSON otherwise. Only the browser
+// which started the login can finish it, the others would be logged in to the account of someone else.
+func OpenIdCallback(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !authentication.IsOpenIdStateOfBrowser(r, q.Get("state")) {
+		log.Printf("[WARN][%s] OpenID login refused, the state is not the one of the browser\n", r.RemoteAddr)
+		authentication.SendUnauthorized(w, r)
+		return
+	}
+	authentication.ClearOpenIdStateCookie(w, r)
+	if e := q.Get("error"); e != "" {
+		log.Printf("[WARN][%s] OpenID login refused by the identity provider: %s %s\n", r.RemoteAddr, e, q.Get("error_description"))
+		authentication.SendUnauthorized(w, r)
+		return
+	}
+	user, device, redirect, err := authentication.FinishOpenIdLogin(q.Get("state"), q.Get("code"))
+	if err != nil {
+		log.Printf("[WARN][%s] OpenID login failed: %s\n", r.RemoteAddr, err)
+		authentication.SendUnauthorized(w, r)
+		return
+	}
+	res, err := authentication.OpenSession(user.Username, device, r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] Login successful for user %s with %s\n", r.RemoteAddr, user.Username, user.Provider)
+	if redirect != "" {
+		fragment := url.Values{}
+		fragment.Set("token", res.Token)
+		fragment.Set("refresh-token", res.RefreshToken)
+		fragment.Set("expires-in", strconv.Itoa(res.ExpiresIn))
+		http.Redirect(w, r, redirect+"#"+fragment.Encode(), http.StatusFound)
+		return
+	}
+	b, err := json.Marshal(res)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
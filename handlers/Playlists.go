@@ -0,0 +1,386 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"openify/Authentication"
+	"openify/PlaylistsManager"
+	"openify/Response"
+	"strings"
+)
+
+type PlaylistSummary struct {
+	Id       string `json:"id"`
+	Name     string `json:"name"`
+	Owner    string `json:"owner"`
+	Public   bool   `json:"public"`
+	Smart    bool   `json:"smart"`
+	Count    int    `json:"count"`
+	Duration int    `json:"duration"`
+}
+
+type PlaylistsList struct {
+	Playlists []PlaylistSummary `json:"playlists"`
+	Success   bool              `json:"success"`
+}
+
+type PlaylistResponse struct {
+	Playlist PlaylistsManager.Playlist `json:"playlist"`
+	Success  bool                      `json:"success"`
+}
+
+type NewPlaylist struct {
+	Name   string                      `json:"name"`
+	Public bool                        `json:"public"`
+	Smart  *PlaylistsManager.SmartRule `json:"smart"`
+}
+
+type EditedPlaylist struct {
+	Id           string                      `json:"id"`
+	Name         string                      `json:"name"`
+	Public       bool                        `json:"public"`
+	Smart        *PlaylistsManager.SmartRule `json:"smart"`
+	NameEdited   bool                        `json:"name-edited"`
+	PublicEdited bool                        `json:"public-edited"`
+	SmartEdited  bool                        `json:"smart-edited"`
+}
+
+type PlaylistItemsEdit struct {
+	Id        string `json:"id"`
+	Files     []int  `json:"files"`
+	Positions []int  `json:"positions"`
+	Position  int    `json:"position"`
+	From      int    `json:"from"`
+	To        int    `json:"to"`
+}
+
+// IsPlaylistsManager tells if the user can read and edit the playlists of the other users.
+func IsPlaylistsManager(user authentication.User) bool {
+	return authentication.HasPermission(user, authentication.PermManagePlaylists)
+}
+
+func GetPlaylistIDFromRequest(r *http.Request) string {
+	return r.URL.Query().Get("id")
+}
+
+// HideItems masks the items of a playlist hidden to the user as missing files. They are
+// kept so the positions used to edit the playlist do not change.
+func HideItems(user authentication.User, p PlaylistsManager.Playlist) PlaylistsManager.Playlist {
+	if !authentication.IsRestricted(user) {
+		return p
+	}
+	canAccess := authentication.NewAccessChecker(user)
+	items := make([]PlaylistsManager.Item, len(p.Items))
+	for i, item := range p.Items {
+		if !canAccess(item.Path) {
+			item = PlaylistsManager.Item{Id: -1, Missing: true}
+		}
+		items[i] = item
+	}
+	p.Items = items
+	return p
+}
+
+// GetUserPlaylist returns a playlist the user can read with the items hidden to the user masked.
+// The playlists of the library stored in a folder hidden to the user are not found.
+func GetUserPlaylist(user authentication.User, id string) (PlaylistsManager.Playlist, error) {
+	p, err := PlaylistsManager.GetPlaylist(id, user.Username, IsPlaylistsManager(user))
+	if err != nil {
+		return PlaylistsManager.Playlist{}, err
+	}
+	if p.Source != "" && !authentication.CanAccess(user, p.Source) {
+		return PlaylistsManager.Playlist{}, errors.New("playlist not found")
+	}
+	return HideItems(user, p), nil
+}
+
+func SendPlaylist(w http.ResponseWriter, r *http.Request, p PlaylistsManager.Playlist) {
+	if user, err := authentication.GetRequestUser(r); err == nil {
+		p = HideItems(user, p)
+	}
+	b, err := json.Marshal(PlaylistResponse{
+		Playlist: p,
+		Success:  true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
+
+func GetPlaylists(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	list := PlaylistsList{
+		Playlists: []PlaylistSummary{},
+		Success:   true,
+	}
+	canAccess := authentication.NewAccessChecker(user)
+	for _, p := range PlaylistsManager.GetPlaylists(user.Username, IsPlaylistsManager(user)) {
+		if p.Source != "" && !canAccess(p.Source) {
+			continue
+		}
+		list.Playlists = append(list.Playlists, ToPlaylistSummary(HideItems(user, p)))
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  List of playlists\n", r.RemoteAddr)
+	Response.SendJson(w, r, b)
+}
+
+func ToPlaylistSummary(p PlaylistsManager.Playlist) PlaylistSummary {
+	s := PlaylistSummary{
+		Id:     p.Id,
+		Name:   p.Name,
+		Owner:  p.Owner,
+		Public: p.Public,
+		Smart:  p.Smart != nil,
+		Count:  len(p.Items),
+	}
+	for _, item := range p.Items {
+		s.Duration += item.Duration
+	}
+	return s
+}
+
+func GetPlaylist(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	p, err := GetUserPlaylist(user, GetPlaylistIDFromRequest(r))
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Playlist %s\n", r.RemoteAddr, p.Id)
+	SendPlaylist(w, r, p)
+}
+
+func CreatePlaylist(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	var np NewPlaylist
+	err = json.NewDecoder(r.Body).Decode(&np)
+	if err != nil {
+		authentication.SendError(w, r, "Playlist information missing (name)")
+		return
+	}
+	p, err := PlaylistsManager.CreatePlaylist(np.Name, user.Username, np.Public, np.Smart)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Playlist %s created by %s\n", p.Id, user.Username)
+	SendPlaylist(w, r, p)
+}
+
+func UpdatePlaylist(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	var ep EditedPlaylist
+	err = json.NewDecoder(r.Body).Decode(&ep)
+	if err != nil {
+		authentication.SendError(w, r, "Playlist information missing")
+		return
+	}
+	p, err := PlaylistsManager.EditPlaylist(ep.Id, user.Username, IsPlaylistsManager(user), func(p *PlaylistsManager.Playlist) error {
+		if ep.NameEdited {
+			if ep.Name == "" {
+				return errors.New("playlist name missing")
+			}
+			p.Name = ep.Name
+		}
+		if ep.PublicEdited {
+			p.Public = ep.Public
+		}
+		// Removing the rule turns the playlist into an empty static playlist
+		if ep.SmartEdited {
+			if ep.Smart != nil {
+				if err := PlaylistsManager.ValidateSmartRule(*ep.Smart); err != nil {
+					return err
+				}
+			}
+			p.Smart = ep.Smart
+			p.Items = []PlaylistsManager.Item{}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Playlist %s updated by %s\n", p.Id, user.Username)
+	SendPlaylist(w, r, p)
+}
+
+func RemovePlaylist(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	id := GetPlaylistIDFromRequest(r)
+	err = PlaylistsManager.RemovePlaylist(id, user.Username, IsPlaylistsManager(user))
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Playlist %s removed by %s\n", id, user.Username)
+	authentication.SendSuccess(w, r, "Playlist removed!")
+}
+
+// EditPlaylistItems handles the routes changing the content of a playlist
+func EditPlaylistItems(edit func(user authentication.User, p *PlaylistsManager.Playlist, e PlaylistItemsEdit) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := authentication.GetRequestUser(r)
+		if err != nil {
+			log.Printf("[ERROR] %s\n", err)
+			authentication.SendError(w, r, err.Error())
+			return
+		}
+		e := PlaylistItemsEdit{Position: -1}
+		err = json.NewDecoder(r.Body).Decode(&e)
+		if err != nil {
+			authentication.SendError(w, r, "Playlist information missing")
+			return
+		}
+		p, err := PlaylistsManager.EditPlaylist(e.Id, user.Username, IsPlaylistsManager(user), func(p *PlaylistsManager.Playlist) error {
+			return edit(user, p, e)
+		})
+		if err != nil {
+			log.Printf("[ERROR] %s\n", err)
+			authentication.SendError(w, r, err.Error())
+			return
+		}
+		log.Printf("[INFO] Playlist %s edited by %s\n", p.Id, user.Username)
+		SendPlaylist(w, r, p)
+	}
+}
+
+func AddToPlaylist(user authentication.User, p *PlaylistsManager.Playlist, e PlaylistItemsEdit) error {
+	return PlaylistsManager.AddFiles(p, authentication.NewAccessChecker(user), e.Files, e.Position)
+}
+
+func RemoveFromPlaylist(user authentication.User, p *PlaylistsManager.Playlist, e PlaylistItemsEdit) error {
+	return PlaylistsManager.RemoveItems(p, e.Positions)
+}
+
+func MoveInPlaylist(user authentication.User, p *PlaylistsManager.Playlist, e PlaylistItemsEdit) error {
+	return PlaylistsManager.MoveItem(p, e.From, e.To)
+}
+
+// GetPlaylistQuery returns the parameters of the links of an exported playlist, they are revoked with the other links of the user.
+func GetPlaylistQuery(user authentication.User, id string) url.Values {
+	q := url.Values{}
+	q.Set("u", user.Username)
+	q.Set("playlist", id)
+	q.Set("s", authentication.SignUserValue(user, "playlist:"+user.Username+":"+id))
+	return q
+}
+
+// GetPlaylistLinkUser checks the signature of a link of an exported playlist
+// and returns its user if the requested file is part of the playlist.
+func GetPlaylistLinkUser(r *http.Request) (authentication.User, error) {
+	q := r.URL.Query()
+	id := q.Get("playlist")
+	user, err := authentication.GetUserInfo(q.Get("u"))
+	if err != nil {
+		return authentication.User{}, errors.New("invalid playlist signature")
+	}
+	if !authentication.IsValidUserSignature(user, "playlist:"+user.Username+":"+id, q.Get("s")) {
+		return authentication.User{}, errors.New("invalid playlist signature")
+	}
+	p, err := GetUserPlaylist(user, id)
+	if err != nil {
+		return authentication.User{}, err
+	}
+	fileId, err := GetFileIDFromRequest(r)
+	if err != nil {
+		return authentication.User{}, err
+	}
+	for _, item := range p.Items {
+		if item.Id == fileId && !item.Missing {
+			return user, nil
+		}
+	}
+	return authentication.User{}, errors.New("file is not part of the playlist")
+}
+
+func ExportPlaylist(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	p, err := GetUserPlaylist(user, GetPlaylistIDFromRequest(r))
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	base := GetBaseURL(r)
+	query := GetPlaylistQuery(user, p.Id).Encode()
+	stream := func(item PlaylistsManager.Item) string {
+		return fmt.Sprintf("%s/api/get/file?id=%d&%s", base, item.Id, query)
+	}
+	var b []byte
+	var contentType string
+	format := strings.ToLower(r.URL.Query().Get("format"))
+	switch format {
+	case "", "m3u8", "m3u":
+		format = "m3u8"
+		contentType = "audio/x-mpegurl; charset=utf-8"
+		b = PlaylistsManager.RenderM3U8(p, stream)
+	case "pls":
+		contentType = "audio/x-scpls"
+		b = PlaylistsManager.RenderPLS(p, stream)
+	case "xspf":
+		contentType = "application/xspf+xml"
+		b, err = PlaylistsManager.RenderXSPF(p, stream)
+		if err != nil {
+			log.Printf("[ERROR] %s\n", err)
+			authentication.SendError(w, r, err.Error())
+			return
+		}
+	default:
+		authentication.SendError(w, r, "Unknown playlist format")
+		return
+	}
+	log.Printf("[INFO][%s] <--  Playlist %s exported as %s\n", r.RemoteAddr, p.Id, format)
+	w.Header().Add("Content-Type", contentType)
+	w.Header().Add("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": p.Name + "." + format}))
+	_, err = w.Write(b)
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+	}
+}
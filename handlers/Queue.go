@@ -0,0 +1,175 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"openify/Authentication"
+	"openify/QueueManager"
+	"openify/Response"
+)
+
+type QueueResponse struct {
+	Queue   QueueManager.Queue `json:"queue"`
+	Message string             `json:"message,omitempty"`
+	Success bool               `json:"success"`
+}
+
+// Version is the version of the queue the client changed
+type EditedQueue struct {
+	Files    []int  `json:"files"`
+	Current  int    `json:"current"`
+	Position int    `json:"position"`
+	Device   string `json:"device"`
+	Version  int    `json:"version"`
+}
+
+type BookmarksList struct {
+	Bookmarks []QueueManager.Bookmark `json:"bookmarks"`
+	Success   bool                    `json:"success"`
+}
+
+type BookmarkResponse struct {
+	Bookmark QueueManager.Bookmark `json:"bookmark"`
+	Success  bool                  `json:"success"`
+}
+
+type EditedBookmark struct {
+	Id       int    `json:"id"`
+	Position int    `json:"position"`
+	Comment  string `json:"comment"`
+	Device   string `json:"device"`
+}
+
+func sendQueue(w http.ResponseWriter, r *http.Request, status int, qr QueueResponse) {
+	b, err := json.Marshal(qr)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJsonWithStatus(w, r, status, b)
+}
+
+// PlayQueue returns the play queue of the user with GET and replaces it with PUT.
+// A PUT made from an outdated version gets a 409 with the current queue.
+func PlayQueue(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		log.Printf("[INFO][%s] <--  Play queue of %s\n", r.RemoteAddr, user.Username)
+		sendQueue(w, r, http.StatusOK, QueueResponse{Queue: QueueManager.GetQueue(user.Username, authentication.NewAccessChecker(user)), Success: true})
+	case http.MethodPut:
+		var eq EditedQueue
+		err = json.NewDecoder(r.Body).Decode(&eq)
+		if err != nil {
+			authentication.SendError(w, r, "Play queue information missing (files, current, position, version)")
+			return
+		}
+		q, err := QueueManager.SetQueue(user.Username, authentication.NewAccessChecker(user), eq.Files, eq.Current, eq.Position, eq.Device, eq.Version)
+		if err == QueueManager.ErrVersionConflict {
+			log.Printf("[WARN][%s] Play queue of %s changed from an outdated version\n", r.RemoteAddr, user.Username)
+			sendQueue(w, r, http.StatusConflict, QueueResponse{Queue: q, Message: err.Error(), Success: false})
+			return
+		}
+		if err != nil {
+			log.Printf("[ERROR] %s\n", err)
+			authentication.SendError(w, r, err.Error())
+			return
+		}
+		log.Printf("[INFO] Play queue of %s updated from %s\n", user.Username, eq.Device)
+		sendQueue(w, r, http.StatusOK, QueueResponse{Queue: q, Success: true})
+	default:
+		w.Header().Set("Allow", "GET, PUT")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func GetBookmarks(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	b, err := json.Marshal(BookmarksList{
+		Bookmarks: QueueManager.GetBookmarks(user.Username, authentication.NewAccessChecker(user)),
+		Success:   true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Bookmarks of %s\n", r.RemoteAddr, user.Username)
+	Response.SendJson(w, r, b)
+}
+
+func UpdateBookmark(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	eb := EditedBookmark{Id: -1}
+	err = json.NewDecoder(r.Body).Decode(&eb)
+	if err != nil {
+		authentication.SendError(w, r, "Bookmark information missing (id, position)")
+		return
+	}
+	bookmark, err := QueueManager.SetBookmark(user.Username, authentication.NewAccessChecker(user), eb.Id, eb.Position, eb.Comment, eb.Device)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	b, err := json.Marshal(BookmarkResponse{
+		Bookmark: bookmark,
+		Success:  true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Bookmark on %s updated by %s\n", bookmark.Path, user.Username)
+	Response.SendJson(w, r, b)
+}
+
+// RemoveBookmark removes the bookmark of the file id, or of the file path when it is not in the library anymore.
+func RemoveBookmark(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	path := r.URL.Query().Get("path")
+	if path == "" {
+		id, err := GetFileIDFromRequest(r)
+		if err != nil {
+			authentication.SendError(w, r, err.Error())
+			return
+		}
+		t, err := GetUserTrack(user, id)
+		if err != nil {
+			authentication.SendError(w, r, err.Error())
+			return
+		}
+		path = t.Path
+	}
+	err = QueueManager.RemoveBookmark(user.Username, path)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Bookmark on %s removed by %s\n", path, user.Username)
+	authentication.SendSuccess(w, r, "Bookmark removed!")
+}
@@ -0,0 +1,139 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"openify/Authentication"
+	"openify/RadioManager"
+	"openify/Response"
+	"openify/StreamManager"
+	"strconv"
+)
+
+type ChannelsList struct {
+	Channels []RadioManager.ChannelInfo `json:"channels"`
+	Success  bool                       `json:"success"`
+}
+
+// GetStreamUser returns the user of a streaming request. The players cannot always
+// send the authorization header, so the token can also be given with the t parameter.
+func GetStreamUser(r *http.Request) (authentication.User, error) {
+	tokens, ok := r.URL.Query()["t"]
+	if ok && len(tokens[0]) > 0 {
+		return authentication.GetLoggedUser(tokens[0])
+	}
+	t, err := authentication.GetToken(r)
+	if err != nil {
+		return authentication.User{}, err
+	}
+	return authentication.GetLoggedUser(t)
+}
+
+// CanListen tells if the user can see every file played by a channel.
+func CanListen(user authentication.User, c *RadioManager.Channel) bool {
+	if c.GetPlaylist() == "" {
+		return authentication.CanAccessFolder(user, c.GetFolder())
+	}
+	for _, t := range c.GetTracks() {
+		if !authentication.CanAccess(user, t.Path) {
+			return false
+		}
+	}
+	return true
+}
+
+func GetRadioChannels(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	list := ChannelsList{
+		Channels: []RadioManager.ChannelInfo{},
+		Success:  true,
+	}
+	for _, c := range RadioManager.GetChannels() {
+		if CanListen(user, c) {
+			list.Channels = append(list.Channels, c.Info())
+		}
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Radio channels\n", r.RemoteAddr)
+	Response.SendJson(w, r, b)
+}
+
+func StreamRadio(w http.ResponseWriter, r *http.Request) {
+	user, err := GetStreamUser(r)
+	if err != nil {
+		authentication.SendUnauthorized(w, r)
+		return
+	}
+	if !authentication.HasPermission(user, authentication.PermStream) {
+		log.Printf("[ERROR] Missing right for %s to stream\n", user.Username)
+		authentication.SendError(w, r, "You are not allowed to do that")
+		return
+	}
+	names, ok := r.URL.Query()["c"]
+	if !ok || len(names[0]) < 1 {
+		authentication.SendError(w, r, "Channel missing")
+		return
+	}
+	c, err := RadioManager.GetChannel(names[0])
+	if err == nil && !CanListen(user, c) {
+		err = errors.New("channel not found")
+	}
+	if err != nil {
+		log.Printf("[ERROR][%s] %s\n", r.RemoteAddr, err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	if !StreamManager.Acquire(user.Username) {
+		log.Printf("[WARN][%s] Too many concurrent streams for user %s\n", r.RemoteAddr, user.Username)
+		authentication.SendTooManyRequests(w, r, "Too many concurrent streams", StreamManager.GetRetryAfter())
+		return
+	}
+	defer StreamManager.Release(user.Username)
+
+	w.Header().Set("Content-Type", c.GetContentType())
+	w.Header().Set("Cache-Control", "no-cache, no-store")
+	w.Header().Set("icy-name", c.Name)
+	w.Header().Set("icy-description", c.Description)
+	w.Header().Set("icy-pub", "0")
+	var out io.Writer = w
+	if r.Header.Get("Icy-MetaData") == "1" {
+		w.Header().Set("icy-metaint", strconv.Itoa(RadioManager.MetaInt))
+		out = RadioManager.NewIcyWriter(w, c)
+	}
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+
+	listener := c.Subscribe()
+	defer c.Unsubscribe(listener)
+	log.Printf("[INFO][STREAMING][%s] <-- Radio %s\n", r.RemoteAddr, c.Name)
+	for {
+		select {
+		case data, ok := <-listener.C:
+			if !ok {
+				log.Printf("[WARN][%s] Radio listener too slow, disconnected\n", r.RemoteAddr)
+				return
+			}
+			if _, err := out.Write(data); err != nil {
+				return
+			}
+			if flusher != nil {
+				flusher.Flush()
+			}
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
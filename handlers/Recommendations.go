@@ -0,0 +1,167 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"openify/Authentication"
+	"openify/FilesManager"
+	"openify/RecommendationManager"
+	"openify/Response"
+	"strconv"
+)
+
+type RecommendedTrack struct {
+	Id          int    `json:"id"`
+	Title       string `json:"title"`
+	Artist      string `json:"artist"`
+	AlbumArtist string `json:"album-artist"`
+	Album       string `json:"album"`
+	Genre       string `json:"genre"`
+	Year        int    `json:"year"`
+	Duration    int    `json:"duration"`
+}
+
+type Recommendations struct {
+	Tracks  []RecommendedTrack `json:"tracks"`
+	Success bool               `json:"success"`
+}
+
+func GetRecommendationLimit(r *http.Request) (int, error) {
+	limit, err := GetLimit(r, RecommendationManager.DefaultLimit)
+	if err != nil || limit <= 0 {
+		return 0, errors.New("limit must be a positive number")
+	}
+	if limit > RecommendationManager.MaxLimit {
+		limit = RecommendationManager.MaxLimit
+	}
+	return limit, nil
+}
+
+func SendRecommendations(w http.ResponseWriter, r *http.Request, tracks []FilesManager.Track) {
+	result := Recommendations{
+		Tracks:  []RecommendedTrack{},
+		Success: true,
+	}
+	for _, t := range tracks {
+		result.Tracks = append(result.Tracks, RecommendedTrack{
+			Id:          t.Id,
+			Title:       t.Title,
+			Artist:      t.Artist,
+			AlbumArtist: t.AlbumArtist,
+			Album:       t.Album,
+			Genre:       t.Genre,
+			Year:        t.Year,
+			Duration:    t.Duration,
+		})
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
+
+// GetRandomTracks accepts the filters genre, artist, album-artist, folder, from-year, to-year and unplayed=true.
+func GetRandomTracks(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	limit, err := GetRecommendationLimit(r)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	f := RecommendationManager.Filter{
+		Genre:       q.Get("genre"),
+		Artist:      q.Get("artist"),
+		AlbumArtist: q.Get("album-artist"),
+		Folder:      q.Get("folder"),
+		Unplayed:    q.Get("unplayed") == "true",
+	}
+	for param, year := range map[string]*int{"from-year": &f.FromYear, "to-year": &f.ToYear} {
+		if v := q.Get(param); v != "" {
+			*year, err = strconv.Atoi(v)
+			if err != nil {
+				authentication.SendError(w, r, param+" is NaN")
+				return
+			}
+		}
+	}
+	log.Printf("[INFO][%s] <--  Random tracks for %s\n", r.RemoteAddr, user.Username)
+	SendRecommendations(w, r, RecommendationManager.Random(user.Username, authentication.NewAccessChecker(user), f, limit))
+}
+
+// GetRadio seeds the radio with the file id, or the artist or genre name.
+func GetRadio(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	limit, err := GetRecommendationLimit(r)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	q := r.URL.Query()
+	seed := RecommendationManager.Seed{
+		Artist: q.Get("artist"),
+		Genre:  q.Get("genre"),
+	}
+	name := seed.Artist + seed.Genre
+	if q.Get("id") != "" {
+		id, err := GetFileIDFromRequest(r)
+		if err != nil {
+			authentication.SendError(w, r, err.Error())
+			return
+		}
+		t, err := GetUserTrack(user, id)
+		if err != nil {
+			authentication.SendError(w, r, err.Error())
+			return
+		}
+		seed.Track = &t
+		name = t.Title
+	}
+	if name == "" {
+		authentication.SendError(w, r, "Radio seed missing (id, artist or genre)")
+		return
+	}
+	log.Printf("[INFO][%s] <--  Radio of %s for %s\n", r.RemoteAddr, name, user.Username)
+	SendRecommendations(w, r, RecommendationManager.Radio(user.Username, authentication.NewAccessChecker(user), seed, limit))
+}
+
+func GetMoreFromAlbumArtist(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	limit, err := GetRecommendationLimit(r)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	id, err := GetFileIDFromRequest(r)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	t, err := GetUserTrack(user, id)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  More from the album artist of %s\n", r.RemoteAddr, t.Title)
+	SendRecommendations(w, r, RecommendationManager.MoreFromAlbumArtist(t, authentication.NewAccessChecker(user), limit))
+}
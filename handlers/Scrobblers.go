@@ -0,0 +1,124 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"openify/Authentication"
+	"openify/Response"
+	"openify/ScrobblerManager"
+	"time"
+)
+
+// The token is never sent back to the client
+type ScrobblerInfo struct {
+	Service   string    `json:"service"`
+	Url       string    `json:"url"`
+	Enabled   bool      `json:"enabled"`
+	LastError string    `json:"last-error"`
+	LastSent  time.Time `json:"last-sent"`
+	Pending   int       `json:"pending"`
+}
+
+type ScrobblersList struct {
+	Scrobblers []ScrobblerInfo `json:"scrobblers"`
+	Success    bool            `json:"success"`
+}
+
+// LastFmToken is the token given by the Last.fm authorization page,
+// it is exchanged for a session key. An empty token keeps the current one.
+type EditedScrobbler struct {
+	Service     string `json:"service"`
+	Token       string `json:"token"`
+	LastFmToken string `json:"lastfm-token"`
+	Enabled     bool   `json:"enabled"`
+}
+
+func GetScrobblers(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	list := ScrobblersList{
+		Scrobblers: []ScrobblerInfo{},
+		Success:    true,
+	}
+	for _, i := range ScrobblerManager.GetIntegrations(user.Username) {
+		list.Scrobblers = append(list.Scrobblers, ScrobblerInfo{
+			Service:   i.Service,
+			Url:       ScrobblerManager.GetServiceURL(i),
+			Enabled:   i.Enabled,
+			LastError: i.LastError,
+			LastSent:  i.LastSent,
+			Pending:   ScrobblerManager.GetPendingCount(user.Username, i.Service),
+		})
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Scrobblers of %s\n", r.RemoteAddr, user.Username)
+	Response.SendJson(w, r, b)
+}
+
+func UpdateScrobbler(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	var es EditedScrobbler
+	err = json.NewDecoder(r.Body).Decode(&es)
+	if err != nil {
+		authentication.SendError(w, r, "Scrobbler information missing (service, token)")
+		return
+	}
+	token := es.Token
+	if es.LastFmToken != "" && es.Service == ScrobblerManager.LastFmService {
+		token, err = ScrobblerManager.GetLastFmSession(es.LastFmToken)
+		if err != nil {
+			log.Printf("[ERROR] %s\n", err)
+			authentication.SendError(w, r, err.Error())
+			return
+		}
+	}
+	if existing, ok := ScrobblerManager.GetIntegration(user.Username, es.Service); ok && token == "" {
+		token = existing.Token
+	}
+	err = ScrobblerManager.SetIntegration(ScrobblerManager.Integration{
+		Username: user.Username,
+		Service:  es.Service,
+		Token:    token,
+		Enabled:  es.Enabled,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Scrobbler %s updated by %s\n", es.Service, user.Username)
+	authentication.SendSuccess(w, r, "Scrobbler updated!")
+}
+
+func RemoveScrobbler(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	service := r.URL.Query().Get("service")
+	err = ScrobblerManager.RemoveIntegration(user.Username, service)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Scrobbler %s removed by %s\n", service, user.Username)
+	authentication.SendSuccess(w, r, "Scrobbler removed!")
+}
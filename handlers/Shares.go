@@ -0,0 +1,405 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"openify/Authentication"
+	"openify/FilesManager"
+	"openify/Response"
+	"openify/ShareManager"
+	"openify/StreamManager"
+	"strings"
+	"time"
+)
+
+const defaultShareHours = 7 * 24
+
+// The shared item is the file Id or its album, the Folder or the Playlist depending on Type.
+type NewShare struct {
+	Type        string `json:"type"`
+	Id          int    `json:"id"`
+	Folder      string `json:"folder"`
+	Playlist    string `json:"playlist"`
+	Description string `json:"description"`
+	Password    string `json:"password"`
+	ExpiresIn   int    `json:"expires-in"` // hours
+	MaxPlays    int    `json:"max-plays"`
+}
+
+type ShareInfo struct {
+	Id          string    `json:"id"`
+	Owner       string    `json:"owner"`
+	Type        string    `json:"type"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Protected   bool      `json:"protected"`
+	Expires     time.Time `json:"expires"`
+	MaxPlays    int       `json:"max-plays"`
+	Plays       int       `json:"plays"`
+	Created     time.Time `json:"created"`
+	Url         string    `json:"url"`
+}
+
+type ShareResponse struct {
+	Share   ShareInfo `json:"share"`
+	Success bool      `json:"success"`
+}
+
+type SharesList struct {
+	Shares  []ShareInfo `json:"shares"`
+	Success bool        `json:"success"`
+}
+
+type SharedItem struct {
+	Id       int    `json:"id"`
+	Title    string `json:"title"`
+	Artist   string `json:"artist"`
+	Album    string `json:"album"`
+	Duration int    `json:"duration"`
+	Url      string `json:"url"`
+}
+
+type PublicShare struct {
+	Share   ShareInfo    `json:"share"`
+	Items   []SharedItem `json:"items"`
+	Success bool         `json:"success"`
+}
+
+func ToShareInfo(r *http.Request, s ShareManager.Share) ShareInfo {
+	return ShareInfo{
+		Id:          s.Id,
+		Owner:       s.Owner,
+		Type:        s.Type,
+		Name:        s.Name,
+		Description: s.Description,
+		Protected:   ShareManager.IsProtected(s),
+		Expires:     s.Expires,
+		MaxPlays:    s.MaxPlays,
+		Plays:       s.Plays,
+		Created:     s.Created,
+		Url:         fmt.Sprintf("%s/api/public/share?s=%s", GetBaseURL(r), s.Id),
+	}
+}
+
+// GetShareTracks returns the files of a share which are still in the library and that its owner can access.
+func GetShareTracks(s ShareManager.Share) ([]FilesManager.Track, error) {
+	owner, err := authentication.GetUserInfo(s.Owner)
+	if err != nil {
+		return nil, err
+	}
+	tracks, err := getShareTracks(owner, s)
+	return FilterUserTracks(owner, tracks), err
+}
+
+func getShareTracks(owner authentication.User, s ShareManager.Share) ([]FilesManager.Track, error) {
+	switch s.Type {
+	case ShareManager.FileShare:
+		t, err := FilesManager.GetTrackByPath(s.Target)
+		if err != nil {
+			return nil, errors.New("the shared file is not available anymore")
+		}
+		return []FilesManager.Track{t}, nil
+	case ShareManager.AlbumShare:
+		var tracks []FilesManager.Track
+		for _, t := range FilesManager.GetTracks() {
+			if t.Album != "" && FilesManager.AlbumKey(t) == s.Target {
+				tracks = append(tracks, t)
+			}
+		}
+		return SortFeedTracks(tracks), nil
+	case ShareManager.FolderShare:
+		return SortFeedTracks(FilesManager.GetFolderTracks(s.Target)), nil
+	case ShareManager.PlaylistShare:
+		p, err := GetUserPlaylist(owner, s.Target)
+		if err != nil {
+			return nil, errors.New("the shared playlist is not available anymore")
+		}
+		var tracks []FilesManager.Track
+		for _, item := range p.Items {
+			if t, err := FilesManager.GetTrack(item.Id); err == nil && !item.Missing {
+				tracks = append(tracks, t)
+			}
+		}
+		return tracks, nil
+	}
+	return nil, errors.New("unknown share type")
+}
+
+// newShareTarget checks that the user can read what it shares and returns the share without its secrets.
+func newShareTarget(user authentication.User, ns NewShare) (ShareManager.Share, error) {
+	s := ShareManager.Share{
+		Owner:       user.Username,
+		Type:        ns.Type,
+		Description: ns.Description,
+		MaxPlays:    ns.MaxPlays,
+	}
+	switch ns.Type {
+	case ShareManager.FileShare, ShareManager.AlbumShare:
+		t, err := GetUserTrack(user, ns.Id)
+		if err != nil {
+			return s, err
+		}
+		s.Target = t.Path
+		s.Name = t.Title
+		if ns.Type == ShareManager.AlbumShare {
+			if t.Album == "" {
+				return s, errors.New("the file has no album")
+			}
+			s.Target = FilesManager.AlbumKey(t)
+			s.Name = t.Album
+		}
+	case ShareManager.FolderShare:
+		folder := strings.Trim(ns.Folder, "/")
+		if len(FilterUserTracks(user, FilesManager.GetFolderTracks(folder))) == 0 {
+			return s, errors.New("folder does not exist or is empty")
+		}
+		s.Target = folder
+		s.Name = folder
+	case ShareManager.PlaylistShare:
+		p, err := GetUserPlaylist(user, ns.Playlist)
+		if err != nil {
+			return s, err
+		}
+		s.Target = p.Id
+		s.Name = p.Name
+	default:
+		return s, errors.New("unknown share type, expected file, album, folder or playlist")
+	}
+	return s, nil
+}
+
+func CreateShare(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	if !authentication.CanShare(user) {
+		log.Printf("[ERROR] Missing right for %s to share\n", user.Username)
+		authentication.SendError(w, r, "You are not allowed to do that")
+		return
+	}
+	ns := NewShare{Id: -1, ExpiresIn: defaultShareHours}
+	err = json.NewDecoder(r.Body).Decode(&ns)
+	if err != nil {
+		authentication.SendError(w, r, "Share information missing (type)")
+		return
+	}
+	s, err := newShareTarget(user, ns)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	s, err = ShareManager.CreateShare(s, ns.Password, time.Duration(ns.ExpiresIn)*time.Hour)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	b, err := json.Marshal(ShareResponse{
+		Share:   ToShareInfo(r, s),
+		Success: true,
+	})
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] %s %s shared by %s until %s\n", s.Type, s.Name, user.Username, s.Expires.Format(time.RFC3339))
+	Response.SendJson(w, r, b)
+}
+
+// GetShares lists the shares of the user, the users with manage-shares can list every share with all=true.
+func GetShares(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	owner := user.Username
+	if r.URL.Query().Get("all") == "true" && authentication.HasPermission(user, authentication.PermManageShares) {
+		owner = ""
+	}
+	list := SharesList{
+		Shares:  []ShareInfo{},
+		Success: true,
+	}
+	for _, s := range ShareManager.GetShares(owner) {
+		list.Shares = append(list.Shares, ToShareInfo(r, s))
+	}
+	b, err := json.Marshal(list)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Shares of %s\n", r.RemoteAddr, user.Username)
+	Response.SendJson(w, r, b)
+}
+
+func RemoveShare(w http.ResponseWriter, r *http.Request) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	id := r.URL.Query().Get("id")
+	err = ShareManager.RemoveShare(id, user.Username, authentication.HasPermission(user, authentication.PermManageShares))
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO] Share %s revoked by %s\n", id, user.Username)
+	authentication.SendSuccess(w, r, "Share revoked!")
+}
+
+// shareBlockedError is returned while the client has to wait before trying the password of a share again.
+type shareBlockedError struct {
+	wait time.Duration
+}
+
+func (e shareBlockedError) Error() string {
+	return "too many wrong share passwords"
+}
+
+// GetPublicShareRequest returns the share of an unauthenticated request. The password of a protected
+// share is given with the p parameter or the X-Share-Password header, the stream links use a signature instead.
+// The wrong passwords are limited like the failed logins.
+func GetPublicShareRequest(r *http.Request) (ShareManager.Share, error) {
+	q := r.URL.Query()
+	s, err := ShareManager.GetShare(q.Get("s"))
+	if err != nil {
+		return s, err
+	}
+	owner, err := authentication.GetUserInfo(s.Owner)
+	if err != nil || !authentication.CanShare(owner) {
+		return s, errors.New("share not found or expired")
+	}
+	if ShareManager.IsProtected(s) && !authentication.IsValidSignature("share:"+s.Id, q.Get("k")) {
+		password := q.Get("p")
+		if password == "" {
+			password = r.Header.Get("X-Share-Password")
+		}
+		if password == "" {
+			return s, errors.New("share password missing")
+		}
+		if wait := authentication.BeginSharePassword(r, s.Id); wait > 0 {
+			return s, shareBlockedError{wait: wait}
+		}
+		if !ShareManager.CheckPassword(s, password) {
+			authentication.SharePasswordFailed(r, s.Id)
+			return s, errors.New("wrong share password")
+		}
+		authentication.SharePasswordSucceeded(r, s.Id)
+	}
+	return s, nil
+}
+
+func sendShareRequestError(w http.ResponseWriter, r *http.Request, err error) {
+	log.Printf("[WARN][%s] %s\n", r.RemoteAddr, err)
+	if blocked, ok := err.(shareBlockedError); ok {
+		authentication.SendTooManyRequests(w, r, "Too many wrong passwords, try again later", int(math.Ceil(blocked.wait.Seconds())))
+		return
+	}
+	authentication.SendUnauthorized(w, r)
+}
+
+func GetPublicShare(w http.ResponseWriter, r *http.Request) {
+	s, err := GetPublicShareRequest(r)
+	if err != nil {
+		sendShareRequestError(w, r, err)
+		return
+	}
+	tracks, err := GetShareTracks(s)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	q := url.Values{}
+	q.Set("s", s.Id)
+	q.Set("k", authentication.SignValue("share:"+s.Id))
+	base := GetBaseURL(r)
+	result := PublicShare{
+		Share:   ToShareInfo(r, s),
+		Items:   []SharedItem{},
+		Success: true,
+	}
+	for _, t := range tracks {
+		result.Items = append(result.Items, SharedItem{
+			Id:       t.Id,
+			Title:    t.Title,
+			Artist:   t.Artist,
+			Album:    t.Album,
+			Duration: t.Duration,
+			Url:      fmt.Sprintf("%s/api/public/share/stream?id=%d&%s", base, t.Id, q.Encode()),
+		})
+	}
+	b, err := json.Marshal(result)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	log.Printf("[INFO][%s] <--  Share %s of %s\n", r.RemoteAddr, s.Name, s.Owner)
+	Response.SendJson(w, r, b)
+}
+
+// StreamPublicShare serves a shared file, its bandwidth and its streams count for the owner of the share.
+func StreamPublicShare(w http.ResponseWriter, r *http.Request) {
+	s, err := GetPublicShareRequest(r)
+	if err != nil {
+		sendShareRequestError(w, r, err)
+		return
+	}
+	id, err := GetFileIDFromRequest(r)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	tracks, err := GetShareTracks(s)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	var track *FilesManager.Track
+	for i := range tracks {
+		if tracks[i].Id == id {
+			track = &tracks[i]
+		}
+	}
+	if track == nil {
+		authentication.SendUnauthorized(w, r)
+		return
+	}
+	// Only the requests starting the file count as a play, not the seeks
+	if rg := r.Header.Get("Range"); rg == "" || strings.HasPrefix(rg, "bytes=0-") {
+		ok, err := ShareManager.StartPlay(s.Id, track.Path, authentication.GetClientIp(r))
+		if err != nil {
+			log.Printf("[ERROR] %s\n", err)
+		}
+		if !ok {
+			authentication.SendError(w, r, "This share reached its maximum number of plays")
+			return
+		}
+	} else if !ShareManager.CanPlay(s) {
+		authentication.SendError(w, r, "This share reached its maximum number of plays")
+		return
+	}
+	if !StreamManager.Acquire(s.Owner) {
+		log.Printf("[WARN][%s] Too many concurrent streams for user %s\n", r.RemoteAddr, s.Owner)
+		authentication.SendTooManyRequests(w, r, "Too many concurrent streams", StreamManager.GetRetryAfter())
+		return
+	}
+	defer StreamManager.Release(s.Owner)
+	log.Printf("[INFO][SHARE][%s] <-- %s\n", r.RemoteAddr, track.Path)
+	http.ServeFile(StreamManager.NewThrottledWriter(w, s.Owner), r, FilesManager.GetAbsolutePath(track.Path))
+}
@@ -0,0 +1,284 @@
+package Handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"openify/Authentication"
+	"openify/FilesManager"
+	"openify/HistoryManager"
+	"openify/Response"
+	"openify/StreamManager"
+	"strconv"
+	"time"
+)
+
+const defaultStatsDays = 30
+
+// The longest window of the daily statistics, they hold an entry for every day.
+const maxDailyDays = 366
+const defaultTopLimit = 10
+const reviewTopLimit = 5
+
+type TopResponse struct {
+	Kind    string                 `json:"kind"`
+	From    string                 `json:"from"`
+	To      string                 `json:"to"`
+	Top     []HistoryManager.Count `json:"top"`
+	Success bool                   `json:"success"`
+}
+
+type DailyResponse struct {
+	From    string                    `json:"from"`
+	To      string                    `json:"to"`
+	Days    []HistoryManager.DayCount `json:"days"`
+	Success bool                      `json:"success"`
+}
+
+type NewArtistsResponse struct {
+	From    string                     `json:"from"`
+	To      string                     `json:"to"`
+	Artists []HistoryManager.NewArtist `json:"artists"`
+	Success bool                       `json:"success"`
+}
+
+type ReviewResponse struct {
+	From       string                     `json:"from"`
+	To         string                     `json:"to"`
+	Plays      int                        `json:"plays"`
+	Time       int                        `json:"time"`
+	TopTracks  []HistoryManager.Count     `json:"top-tracks"`
+	TopArtists []HistoryManager.Count     `json:"top-artists"`
+	TopAlbums  []HistoryManager.Count     `json:"top-albums"`
+	TopGenres  []HistoryManager.Count     `json:"top-genres"`
+	NewArtists []HistoryManager.NewArtist `json:"new-artists"`
+	BusiestDay HistoryManager.DayCount    `json:"busiest-day"`
+	ActiveDays int                        `json:"active-days"`
+	Success    bool                       `json:"success"`
+}
+
+type DashboardPeriod struct {
+	Plays       int `json:"plays"`
+	Time        int `json:"time"`
+	ActiveUsers int `json:"active-users"`
+}
+
+type DashboardResponse struct {
+	Users           int                         `json:"users"`
+	Tracks          int                         `json:"tracks"`
+	LibrarySize     int64                       `json:"library-size"`
+	LibraryDuration int64                       `json:"library-duration"`
+	Today           DashboardPeriod             `json:"today"`
+	Week            DashboardPeriod             `json:"week"`
+	Month           DashboardPeriod             `json:"month"`
+	ActiveUsers     []string                    `json:"active-users"`
+	TopTracks       []HistoryManager.Count      `json:"top-tracks"`
+	TopArtists      []HistoryManager.Count      `json:"top-artists"`
+	NowPlaying      []HistoryManager.NowPlaying `json:"now-playing"`
+	Streams         int                         `json:"streams"`
+	Success         bool                        `json:"success"`
+}
+
+// GetStatsWindow returns the days of a statistics request: a whole year with the year
+// parameter, from and to given as YYYY-MM-DD, or the last days (30 by default).
+func GetStatsWindow(r *http.Request) (time.Time, time.Time, error) {
+	q := r.URL.Query()
+	now := time.Now()
+	if y := q.Get("year"); y != "" {
+		year, err := strconv.Atoi(y)
+		if err != nil {
+			return now, now, errors.New("year is NaN")
+		}
+		from := time.Date(year, time.January, 1, 0, 0, 0, 0, time.Local)
+		return from, from.AddDate(1, 0, -1), nil
+	}
+	to := now
+	if t := q.Get("to"); t != "" {
+		var err error
+		to, err = time.ParseInLocation("2006-01-02", t, time.Local)
+		if err != nil {
+			return now, now, errors.New("to must be formatted as YYYY-MM-DD")
+		}
+	}
+	days := defaultStatsDays
+	if d := q.Get("days"); d != "" {
+		var err error
+		days, err = strconv.Atoi(d)
+		if err != nil || days < 1 {
+			return now, now, errors.New("days must be a positive number")
+		}
+	}
+	from := to.AddDate(0, 0, 1-days)
+	if f := q.Get("from"); f != "" {
+		var err error
+		from, err = time.ParseInLocation("2006-01-02", f, time.Local)
+		if err != nil {
+			return now, now, errors.New("from must be formatted as YYYY-MM-DD")
+		}
+	}
+	if from.After(to) {
+		return now, now, errors.New("from is after to")
+	}
+	return from, to, nil
+}
+
+func GetLimit(r *http.Request, limit int) (int, error) {
+	if l := r.URL.Query().Get("limit"); l != "" {
+		return strconv.Atoi(l)
+	}
+	return limit, nil
+}
+
+// readStatsRequest returns the user and the days of a statistics request, it sends the error itself.
+func readStatsRequest(w http.ResponseWriter, r *http.Request) (string, time.Time, time.Time, bool) {
+	user, err := authentication.GetRequestUser(r)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return "", time.Time{}, time.Time{}, false
+	}
+	username, ok := GetHistoryUsername(r, user)
+	if !ok {
+		authentication.SendError(w, r, "You are not allowed to do that")
+		return "", time.Time{}, time.Time{}, false
+	}
+	from, to, err := GetStatsWindow(r)
+	if err != nil {
+		authentication.SendError(w, r, err.Error())
+		return "", time.Time{}, time.Time{}, false
+	}
+	return username, from, to, true
+}
+
+func sendStats(w http.ResponseWriter, r *http.Request, v interface{}) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("[ERROR] %s\n", err)
+		authentication.SendError(w, r, err.Error())
+		return
+	}
+	Response.SendJson(w, r, b)
+}
+
+func formatDay(t time.Time) string {
+	return t.In(time.Local).Format("2006-01-02")
+}
+
+func GetTopStats(w http.ResponseWriter, r *http.Request) {
+	username, from, to, ok := readStatsRequest(w, r)
+	if !ok {
+		return
+	}
+	kind := r.URL.Query().Get("kind")
+	switch kind {
+	case HistoryManager.TopTracks, HistoryManager.TopArtists, HistoryManager.TopAlbums, HistoryManager.TopGenres:
+	default:
+		authentication.SendError(w, r, "Unknown kind, expected tracks, artists, albums or genres")
+		return
+	}
+	limit, err := GetLimit(r, defaultTopLimit)
+	if err != nil {
+		authentication.SendError(w, r, "limit is NaN")
+		return
+	}
+	log.Printf("[INFO][%s] <--  Top %s of %s\n", r.RemoteAddr, kind, username)
+	sendStats(w, r, TopResponse{
+		Kind:    kind,
+		From:    formatDay(from),
+		To:      formatDay(to),
+		Top:     HistoryManager.GetTop(username, kind, from, to, limit),
+		Success: true,
+	})
+}
+
+func GetDailyStats(w http.ResponseWriter, r *http.Request) {
+	username, from, to, ok := readStatsRequest(w, r)
+	if !ok {
+		return
+	}
+	if !to.Before(from.AddDate(0, 0, maxDailyDays)) {
+		authentication.SendError(w, r, fmt.Sprintf("the daily statistics are limited to %d days", maxDailyDays))
+		return
+	}
+	log.Printf("[INFO][%s] <--  Daily listening of %s\n", r.RemoteAddr, username)
+	sendStats(w, r, DailyResponse{
+		From:    formatDay(from),
+		To:      formatDay(to),
+		Days:    HistoryManager.GetDaily(username, from, to),
+		Success: true,
+	})
+}
+
+func GetNewArtistsStats(w http.ResponseWriter, r *http.Request) {
+	username, from, to, ok := readStatsRequest(w, r)
+	if !ok {
+		return
+	}
+	log.Printf("[INFO][%s] <--  New artists of %s\n", r.RemoteAddr, username)
+	sendStats(w, r, NewArtistsResponse{
+		From:    formatDay(from),
+		To:      formatDay(to),
+		Artists: HistoryManager.GetNewArtists(username, from, to),
+		Success: true,
+	})
+}
+
+// GetReview sums up the listening of a user, usually over a year.
+func GetReview(w http.ResponseWriter, r *http.Request) {
+	username, from, to, ok := readStatsRequest(w, r)
+	if !ok {
+		return
+	}
+	review := ReviewResponse{
+		From:       formatDay(from),
+		To:         formatDay(to),
+		TopTracks:  HistoryManager.GetTop(username, HistoryManager.TopTracks, from, to, reviewTopLimit),
+		TopArtists: HistoryManager.GetTop(username, HistoryManager.TopArtists, from, to, reviewTopLimit),
+		TopAlbums:  HistoryManager.GetTop(username, HistoryManager.TopAlbums, from, to, reviewTopLimit),
+		TopGenres:  HistoryManager.GetTop(username, HistoryManager.TopGenres, from, to, reviewTopLimit),
+		NewArtists: HistoryManager.GetNewArtists(username, from, to),
+		Success:    true,
+	}
+	review.Plays, review.Time = HistoryManager.GetTotals(username, from, to)
+	for _, d := range HistoryManager.GetActiveDays(username, from, to) {
+		review.ActiveDays++
+		if d.Time > review.BusiestDay.Time {
+			review.BusiestDay = d
+		}
+	}
+	log.Printf("[INFO][%s] <--  Review of %s\n", r.RemoteAddr, username)
+	sendStats(w, r, review)
+}
+
+func getDashboardPeriod(from time.Time, to time.Time) DashboardPeriod {
+	p := DashboardPeriod{ActiveUsers: len(HistoryManager.GetActiveUsers(from, to))}
+	p.Plays, p.Time = HistoryManager.GetTotals("", from, to)
+	return p
+}
+
+// GetDashboard returns the statistics of the whole server, for the users with view-stats.
+func GetDashboard(w http.ResponseWriter, r *http.Request) {
+	now := time.Now()
+	month := now.AddDate(0, 0, 1-defaultStatsDays)
+	d := DashboardResponse{
+		Users:       len(authentication.GetUsernames()),
+		Today:       getDashboardPeriod(now, now),
+		Week:        getDashboardPeriod(now.AddDate(0, 0, -6), now),
+		Month:       getDashboardPeriod(month, now),
+		ActiveUsers: HistoryManager.GetActiveUsers(month, now),
+		TopTracks:   HistoryManager.GetTop("", HistoryManager.TopTracks, month, now, defaultTopLimit),
+		TopArtists:  HistoryManager.GetTop("", HistoryManager.TopArtists, month, now, defaultTopLimit),
+		NowPlaying:  HistoryManager.GetNowPlaying(),
+		Streams:     StreamManager.GetTotalStreams(),
+		Success:     true,
+	}
+	for _, t := range FilesManager.GetTracks() {
+		d.Tracks++
+		d.LibrarySize += t.Size
+		d.LibraryDuration += int64(t.Duration)
+	}
+	log.Printf("[INFO][%s] <--  Dashboard\n", r.RemoteAddr)
+	sendStats(w, r, d)
+}
@@ -2,10 +2,17 @@ package main
 
 import (
 	"fmt"
+	"openify/AnnotationsManager"
 	"openify/Authentication"
 	"openify/ConfigurationManager"
 	"openify/FilesManager"
 	"openify/Handlers"
+	"openify/HistoryManager"
+	"openify/PlaylistsManager"
+	"openify/QueueManager"
+	"openify/RadioManager"
+	"openify/ScrobblerManager"
+	"openify/ShareManager"
 	"runtime"
 )
 
@@ -16,6 +23,14 @@ func main() {
 	config := ConfigurationManager.OpenConfiguration()
 	_ = FilesManager.ScanFolder(config.DocumentRoot)
 	authentication.LoadUsers()
+	ScrobblerManager.StartScrobblers()
+	HistoryManager.LoadPlays()
+	AnnotationsManager.LoadAnnotations()
+	QueueManager.LoadQueues()
+	ShareManager.LoadShares()
+	PlaylistsManager.LoadPlaylists()
+	PlaylistsManager.ImportLibraryPlaylists()
+	RadioManager.StartChannels()
 	Handlers.HandleRequests()
 }
 